@@ -0,0 +1,114 @@
+// Package controller implements the controller mode of the handler, in which handler phases are run as experiments progress, instead of in Jobs launched for each phase.
+//
+// The controller watches iter8 experiments. It runs the start phase of an experiment whose target is a v1beta1 InferenceService, a TrainedModel, an Argo Rollout or an HTTPRoute before the experiment completes, and the finish phase after the experiment completes.
+// The completion of each phase is recorded in an experiment annotation, so that each phase is run exactly once for each experiment.
+package controller
+
+import (
+	"context"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/httproute"
+	"github.com/iter8-tools/iter8-kfserving-handler/rollout"
+	"github.com/iter8-tools/iter8-kfserving-handler/trainedmodel"
+	"github.com/iter8-tools/iter8-kfserving-handler/v1beta1"
+)
+
+// LeaderElectionID is the name of the resource used for electing the leader among controller replicas.
+const LeaderElectionID = "iter8-kfserving-handler"
+
+// RunFunc runs the given phase (start or finish) of the handler for the experiment with the given namespace and name, and returns the error which failed it, if any.
+type RunFunc func(phase string, namespace string, name string) error
+
+// Reconciler runs handler phases of experiments as they progress.
+type Reconciler struct {
+	// Client reads and annotates experiments; it should not read from a cache, so that completed phases are never run again.
+	Client client.Client
+	// Run runs handler phases.
+	Run RunFunc
+	// MaxConcurrentReconciles is the maximum number of experiments whose phases are run concurrently; it defaults to 1.
+	MaxConcurrentReconciles int
+}
+
+// SetupWithManager registers the reconciler with the given manager, so that it reconciles changes to experiments.
+func (r *Reconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&etc3.Experiment{}).
+		WithOptions(crcontroller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Complete(r)
+}
+
+// Reconcile runs the next phase of the given experiment, if any, and records its completion in the experiment.
+// Failed phases are retried with backoff.
+func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	etc3Exp := &etc3.Experiment{}
+	if err := r.Client.Get(ctx, req.NamespacedName, etc3Exp); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	exp := experiment.Builder(etc3Exp)
+	if exp.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+	phase, marker := nextPhase(exp)
+	if phase == "" {
+		return ctrl.Result{}, nil
+	}
+	ok, err := isHandled(r.Client, exp.GetTargetRef())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !ok {
+		// this experiment is not handled by this handler
+		return ctrl.Result{}, nil
+	}
+	logger := log.WithField("phase", phase).WithFields(exp.LogFields())
+	logger.Info("running phase")
+	if err := r.Run(phase, req.Namespace, req.Name); err != nil {
+		return ctrl.Result{}, err
+	}
+	// the phase may have updated the experiment; so, get it again before annotating it
+	if err := r.Client.Get(ctx, req.NamespacedName, etc3Exp); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := exp.SetAnnotation(ctx, r.Client, marker, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.Info("completed phase")
+	return ctrl.Result{}, nil
+}
+
+// isHandled returns true if the given target reference names a TrainedModel, an Argo Rollout, an HTTPRoute, or a v1beta1 InferenceService in the Kubernetes cluster.
+func isHandled(c client.Client, targetRef string) (bool, error) {
+	if trainedmodel.Kind.IsRef(targetRef) || rollout.Kind.IsRef(targetRef) || httproute.Kind.IsRef(targetRef) {
+		return true, nil
+	}
+	return v1beta1.IsInferenceService(c, targetRef)
+}
+
+// nextPhase returns the phase of the experiment which is due to be run, along with the annotation recording its completion.
+// It returns an empty phase if no phase is due.
+func nextPhase(exp *experiment.Experiment) (string, string) {
+	annotations := exp.GetAnnotations()
+	if _, ok := annotations[experiment.StartedAnnotation]; !ok {
+		if exp.IsCompleted() {
+			// the experiment completed before it could be started; there is nothing to finish
+			return "", ""
+		}
+		return "start", experiment.StartedAnnotation
+	}
+	if _, ok := annotations[experiment.FinishedAnnotation]; !ok && exp.IsCompleted() {
+		return "finish", experiment.FinishedAnnotation
+	}
+	return "", ""
+}
@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/iter8-tools/iter8ctl/utils"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+)
+
+func getK8sClientWithTargetFromFile(filePath string) (client.Client, error) {
+	data, err := ioutil.ReadFile(utils.CompletePath("../testdata", filePath))
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{
+		Object: make(map[string]interface{}),
+	}
+	err = json.Unmarshal(data, &u.Object)
+	if err != nil {
+		return nil, err
+	}
+	scheme := runtime.NewScheme()
+	etc3.AddToScheme(scheme)
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(u).Build(), nil
+}
+
+// runs records the phases run by a reconciler.
+type runs struct {
+	phases []string
+	err    error
+}
+
+func (r *runs) run(phase string, namespace string, name string) error {
+	r.phases = append(r.phases, phase+" "+namespace+"/"+name)
+	return r.err
+}
+
+func setUp(t *testing.T, target string) (client.Client, *Reconciler, *runs) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget(target).
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	r := &runs{}
+	return c, &Reconciler{Client: c, Run: r.run}, r
+}
+
+func reconcile(rec *Reconciler) error {
+	_, err := rec.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Namespace: "default", Name: "myexp"},
+	})
+	return err
+}
+
+func complete(t *testing.T, c client.Client) {
+	exp := &etc3.Experiment{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "myexp"}, exp); err != nil {
+		t.Fatal("Cannot get experiment", err)
+	}
+	exp.Status.Conditions = []*etc3.ExperimentCondition{{
+		Type:   "ExperimentCompleted",
+		Status: corev1.ConditionTrue,
+	}}
+	if err := c.Status().Update(context.Background(), exp); err != nil {
+		t.Fatal("Cannot complete experiment", err)
+	}
+}
+
+func getAnnotations(t *testing.T, c client.Client) map[string]string {
+	exp := &etc3.Experiment{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "myexp"}, exp); err != nil {
+		t.Fatal("Cannot get experiment", err)
+	}
+	return exp.GetAnnotations()
+}
+
+func TestReconcileRunsEachPhaseOnce(t *testing.T) {
+	c, rec, r := setUp(t, "default/my-model")
+	assert.NoError(t, reconcile(rec))
+	assert.NoError(t, reconcile(rec))
+	assert.Equal(t, []string{"start default/myexp"}, r.phases)
+	assert.Contains(t, getAnnotations(t, c), experiment.StartedAnnotation)
+
+	complete(t, c)
+	assert.NoError(t, reconcile(rec))
+	assert.NoError(t, reconcile(rec))
+	assert.Equal(t, []string{"start default/myexp", "finish default/myexp"}, r.phases)
+	assert.Contains(t, getAnnotations(t, c), experiment.FinishedAnnotation)
+}
+
+func TestReconcileRetriesFailedPhase(t *testing.T) {
+	c, rec, r := setUp(t, "default/my-model")
+	r.err = errors.New("phase failed")
+	assert.Error(t, reconcile(rec))
+	assert.NotContains(t, getAnnotations(t, c), experiment.StartedAnnotation)
+	r.err = nil
+	assert.NoError(t, reconcile(rec))
+	assert.Equal(t, []string{"start default/myexp", "start default/myexp"}, r.phases)
+	assert.Contains(t, getAnnotations(t, c), experiment.StartedAnnotation)
+}
+
+func TestReconcileIgnoresOtherTargets(t *testing.T) {
+	_, rec, r := setUp(t, "default/other-model")
+	assert.NoError(t, reconcile(rec))
+	assert.Empty(t, r.phases)
+}
+
+func TestReconcileIgnoresExperimentCompletedBeforeStart(t *testing.T) {
+	c, rec, r := setUp(t, "default/my-model")
+	complete(t, c)
+	assert.NoError(t, reconcile(rec))
+	assert.Empty(t, r.phases)
+}
+
+func TestReconcileDeletedExperiment(t *testing.T) {
+	c, rec, r := setUp(t, "default/my-model")
+	exp := &etc3.Experiment{}
+	exp.SetNamespace("default")
+	exp.SetName("myexp")
+	assert.NoError(t, c.Delete(context.Background(), exp))
+	assert.NoError(t, reconcile(rec))
+	assert.Empty(t, r.phases)
+}
@@ -3,13 +3,40 @@ package experiment
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"os"
 
 	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const (
+	// AssessedRevisionAnnotation is the experiment annotation recording the revision assessed in a single-version experiment.
+	AssessedRevisionAnnotation = "kfserving.iter8.tools/assessed-revision"
+	// SnapshotAnnotation is the experiment annotation recording the state of the target before the experiment changed it.
+	SnapshotAnnotation = "kfserving.iter8.tools/snapshot"
+	// ProgressAnnotation is the experiment annotation recording the steps of handler phases which have completed, so that a rerun of a phase can resume from where an earlier run left off.
+	ProgressAnnotation = "kfserving.iter8.tools/progress"
+	// VariablesAnnotation is the experiment annotation declaring variables of each version as a JSON object, which maps variable names to JSONPath expressions evaluated against the target.
+	VariablesAnnotation = "kfserving.iter8.tools/variables"
+	// CandidateAnnotation is the experiment annotation naming the candidate of an experiment whose versions are distinct objects, such as TrainedModels, in the namespace of the target.
+	CandidateAnnotation = "kfserving.iter8.tools/candidate"
+	// RouterAnnotation is the experiment annotation naming the Istio VirtualService which routes requests to the versions of the target, in the namespace of the target.
+	RouterAnnotation = "kfserving.iter8.tools/router"
+	// MatchAnnotation is the experiment annotation declaring the header or cookie of requests routed to the candidate, as a JSON object such as {"header": "x-iter8-canary", "value": "true"}.
+	MatchAnnotation = "kfserving.iter8.tools/match"
+	// RuleAnnotation is the experiment annotation naming the rule of the Gateway API HTTPRoute, whose backends are the versions of the target.
+	RuleAnnotation = "kfserving.iter8.tools/rule"
+	// StartedAnnotation is the experiment annotation recording the time at which the handler completed the start phase of the experiment in controller mode.
+	StartedAnnotation = "kfserving.iter8.tools/started"
+	// FinishedAnnotation is the experiment annotation recording the time at which the handler completed the finish phase of the experiment in controller mode.
+	FinishedAnnotation = "kfserving.iter8.tools/finished"
+)
+
 // Experiment is an enhancement of v2alpha1.Experiment struct, and supports various methods used in describing an experiment.
 type Experiment struct {
 	*etc3.Experiment
@@ -21,22 +48,37 @@ func Builder(exp *etc3.Experiment) *Experiment {
 }
 
 // GetExperiment returns a pointer to the experiment object fetched from the Kubernetes cluster.
+// The experiment is named by the environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE.
 func GetExperiment(c client.Client) (*Experiment, error) {
+	namespace, name, err := GetExperimentNameFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return GetExperimentByName(c, namespace, name)
+}
+
+// GetExperimentNameFromEnv returns the namespace and name of the experiment set in the environment variables EXPERIMENT_NAMESPACE and EXPERIMENT_NAME.
+func GetExperimentNameFromEnv() (string, string, error) {
 	if name, ok := os.LookupEnv("EXPERIMENT_NAME"); ok {
 		if namespace, ok := os.LookupEnv("EXPERIMENT_NAMESPACE"); ok {
-			etc3Exp := &etc3.Experiment{}
-			err := c.Get(context.Background(), client.ObjectKey{
-				Namespace: namespace,
-				Name:      name,
-			}, etc3Exp)
-			if err != nil {
-				return nil, errors.New("Cannot get experiment: " + err.Error())
-			}
-			exp := &Experiment{etc3Exp}
-			return exp, nil
+			return namespace, name, nil
 		}
 	}
-	return nil, errors.New("environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE need to be set to valid values")
+	return "", "", errors.New("environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE need to be set to valid values")
+}
+
+// GetExperimentByName returns a pointer to the experiment object with the given namespace and name fetched from the Kubernetes cluster.
+func GetExperimentByName(c client.Client, namespace string, name string) (*Experiment, error) {
+	etc3Exp := &etc3.Experiment{}
+	err := c.Get(context.Background(), client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}, etc3Exp)
+	if err != nil {
+		return nil, errors.New("Cannot get experiment: " + err.Error())
+	}
+	exp := &Experiment{etc3Exp}
+	return exp, nil
 }
 
 // GetTargetRef returns the target string for the experiment.
@@ -44,6 +86,15 @@ func (e *Experiment) GetTargetRef() string {
 	return e.Spec.Target
 }
 
+// LogFields returns the fields identifying the experiment and its target in log entries.
+func (e *Experiment) LogFields() log.Fields {
+	return log.Fields{
+		"experiment": e.Name,
+		"namespace":  e.Namespace,
+		"target":     e.Spec.Target,
+	}
+}
+
 // IsSingleVersion returns a boolean indicating if this is a single version experiment.
 func (e *Experiment) IsSingleVersion() bool {
 	if e.Spec.Strategy.Type == etc3.StrategyTypePerformance {
@@ -52,6 +103,21 @@ func (e *Experiment) IsSingleVersion() bool {
 	return false
 }
 
+// IsBlueGreen returns a boolean indicating if this experiment uses the BlueGreen strategy.
+func (e *Experiment) IsBlueGreen() bool {
+	return e.Spec.Strategy.Type == etc3.StrategyTypeBlueGreen
+}
+
+// IsCompleted returns a boolean indicating if the experiment has completed.
+func (e *Experiment) IsCompleted() bool {
+	for _, c := range e.Status.Conditions {
+		if c != nil && string(c.Type) == "ExperimentCompleted" {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
 // GetRecommendedBaseline returns the next baseline recommended in the experiment.
 func (e *Experiment) GetRecommendedBaseline() (string, error) {
 	if e.Status.RecommendedBaseline == nil {
@@ -68,6 +134,49 @@ func (e *Experiment) GetBaseline() (string, error) {
 	return e.Spec.VersionInfo.Baseline.Name, nil
 }
 
+// GetBaselineTag returns the value of the given tag of the baseline version in the experiment.
+func (e *Experiment) GetBaselineTag(key string) (string, error) {
+	if e.Spec.VersionInfo == nil {
+		return "", errors.New("versionInfo not found in experiment spec")
+	}
+	if e.Spec.VersionInfo.Baseline.Tags != nil {
+		if val, ok := (*e.Spec.VersionInfo.Baseline.Tags)[key]; ok {
+			return val, nil
+		}
+	}
+	return "", errors.New("tag " + key + " not found in baseline version of experiment")
+}
+
+// GetVersionTag returns the value of the given tag of the named version in the experiment.
+func (e *Experiment) GetVersionTag(version string, key string) (string, error) {
+	if e.Spec.VersionInfo == nil {
+		return "", errors.New("versionInfo not found in experiment spec")
+	}
+	versions := append([]etc3.VersionDetail{e.Spec.VersionInfo.Baseline}, e.Spec.VersionInfo.Candidates...)
+	for _, v := range versions {
+		if v.Name == version && v.Tags != nil {
+			if val, ok := (*v.Tags)[key]; ok {
+				return val, nil
+			}
+		}
+	}
+	return "", errors.New("tag " + key + " not found in version " + version + " of experiment")
+}
+
+// SetAnnotation sets an annotation of the experiment in the Kubernetes cluster, and updates the experiment object with the result.
+func (e *Experiment) SetAnnotation(ctx context.Context, c client.Client, key string, value string) error {
+	payload := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.New("unable to marshal experiment annotation patch")
+	}
+	return c.Patch(ctx, e.Experiment, client.RawPatch(types.MergePatchType, payloadBytes))
+}
+
 // SetVersionInfo sets version information for an experiment.
 func (e *Experiment) SetVersionInfo(versionInfo *etc3.VersionInfo) {
 }
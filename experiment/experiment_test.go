@@ -1,6 +1,7 @@
 package experiment
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -9,6 +10,7 @@ import (
 	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
 	"github.com/iter8-tools/iter8ctl/utils"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
 	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	client "sigs.k8s.io/controller-runtime/pkg/client"
 	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -81,6 +83,27 @@ func TestGetExperimentNonExistent(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetExperimentNameFromEnv(t *testing.T) {
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "myns")
+	namespace, name, err := GetExperimentNameFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "myns", namespace)
+	assert.Equal(t, "myexp", name)
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	_, _, err = GetExperimentNameFromEnv()
+	assert.Error(t, err)
+}
+
+func TestGetExperimentByName(t *testing.T) {
+	c := getK8sClientWithMyExp()
+	exp, err := GetExperimentByName(c, "myns", "myexp")
+	assert.NoError(t, err)
+	assert.Equal(t, "target", exp.GetTargetRef())
+	_, err = GetExperimentByName(c, "myns", "otherexp")
+	assert.Error(t, err)
+}
+
 func TestGetRecommendedBaseline(t *testing.T) {
 	data, err := ioutil.ReadFile(utils.CompletePath("../testdata", "experiment2.yaml"))
 	if err != nil {
@@ -128,6 +151,14 @@ func TestExpGetTargetRef(t *testing.T) {
 	assert.Equal(t, "target", e.GetTargetRef())
 }
 
+func TestLogFields(t *testing.T) {
+	e := Builder(buildMyExp())
+	fields := e.LogFields()
+	assert.Equal(t, "myexp", fields["experiment"])
+	assert.Equal(t, "myns", fields["namespace"])
+	assert.Equal(t, "target", fields["target"])
+}
+
 func TestIsSingleVersion(t *testing.T) {
 	exp := etc3.NewExperiment("myexp", "myns").
 		WithTarget("target").
@@ -157,3 +188,80 @@ func TestIsSingleVersion(t *testing.T) {
 	e = Builder(exp)
 	assert.False(t, e.IsSingleVersion())
 }
+
+func TestIsCompleted(t *testing.T) {
+	e := Builder(buildMyExp())
+	assert.False(t, e.IsCompleted())
+	e.Status.Conditions = []*etc3.ExperimentCondition{{
+		Type:   "ExperimentCompleted",
+		Status: corev1.ConditionFalse,
+	}}
+	assert.False(t, e.IsCompleted())
+	e.Status.Conditions[0].Status = corev1.ConditionTrue
+	assert.True(t, e.IsCompleted())
+}
+
+func TestGetBaselineTag(t *testing.T) {
+	exp := buildMyExp()
+	e := Builder(exp)
+	_, err := e.GetBaselineTag("revision")
+	assert.Error(t, err)
+	e.Spec.VersionInfo = &etc3.VersionInfo{
+		Baseline: etc3.VersionDetail{
+			Name: "default",
+			Tags: &map[string]string{"revision": "rev-1"},
+		},
+	}
+	rev, err := e.GetBaselineTag("revision")
+	assert.Equal(t, "rev-1", rev)
+	assert.NoError(t, err)
+	_, err = e.GetBaselineTag("image")
+	assert.Error(t, err)
+}
+
+func TestSetAnnotation(t *testing.T) {
+	c := getK8sClientWithMyExp()
+	e := Builder(buildMyExp())
+	err := e.SetAnnotation(context.Background(), c, AssessedRevisionAnnotation, "rev-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "rev-1", e.GetAnnotations()[AssessedRevisionAnnotation])
+	err = c.Get(context.Background(), client.ObjectKeyFromObject(e.Experiment), e.Experiment)
+	assert.NoError(t, err)
+	assert.Equal(t, "rev-1", e.GetAnnotations()[AssessedRevisionAnnotation])
+}
+
+func TestIsBlueGreen(t *testing.T) {
+	e := Builder(buildMyExp())
+	assert.False(t, e.IsBlueGreen())
+
+	exp := etc3.NewExperiment("myexp", "myns").
+		WithTarget("target").
+		WithStrategy(etc3.StrategyTypeBlueGreen).
+		Build()
+	e = Builder(exp)
+	assert.True(t, e.IsBlueGreen())
+}
+
+func TestGetVersionTag(t *testing.T) {
+	e := Builder(buildMyExp())
+	_, err := e.GetVersionTag("canary", "revision")
+	assert.Error(t, err)
+	e.Spec.VersionInfo = &etc3.VersionInfo{
+		Baseline: etc3.VersionDetail{
+			Name: "default",
+			Tags: &map[string]string{"revision": "rev-1"},
+		},
+		Candidates: []etc3.VersionDetail{{
+			Name: "canary",
+			Tags: &map[string]string{"revision": "rev-2"},
+		}},
+	}
+	rev, err := e.GetVersionTag("canary", "revision")
+	assert.Equal(t, "rev-2", rev)
+	assert.NoError(t, err)
+	rev, err = e.GetVersionTag("default", "revision")
+	assert.Equal(t, "rev-1", rev)
+	assert.NoError(t, err)
+	_, err = e.GetVersionTag("canary", "image")
+	assert.Error(t, err)
+}
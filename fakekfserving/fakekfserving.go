@@ -0,0 +1,276 @@
+// Package fakekfserving simulates the KFServing controller on top of a controller-runtime client, for tests of the handler.
+//
+// The simulated controller reacts to changes in the spec of v1beta1 InferenceServices made through its client. Each change marks the InferenceService as un-ready; after a configurable delay, the status of each component of the InferenceService is updated to reflect its canaryTrafficPercent, as KFServing does. Failures of patches and of readiness can be injected.
+package fakekfserving
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// components are the components of an InferenceService, along with their readiness conditions.
+var components = map[string]string{
+	"predictor":   "PredictorReady",
+	"transformer": "TransformerReady",
+	"explainer":   "ExplainerReady",
+}
+
+// inferenceServiceGVK is the group version kind of v1beta1 InferenceServices.
+var inferenceServiceGVK = schema.GroupVersionKind{
+	Group:   "serving.kubeflow.org",
+	Version: "v1beta1",
+	Kind:    "InferenceService",
+}
+
+// Client is a client.Client which simulates the KFServing controller.
+// Objects read and written by the client are stored in the underlying client.
+type Client struct {
+	client.Client
+	delay time.Duration
+	// reconciles which are due
+	reconciles sync.WaitGroup
+	mu         sync.Mutex // guards the fields below
+	// fail readiness of InferenceServices in reconciles
+	readinessFailure bool
+	// error returned by patches and updates of InferenceServices
+	patchErr error
+	// number of revisions created by the client
+	revisions int
+}
+
+// Builder returns a client which simulates the KFServing controller on top of the given client.
+// Status reflects changes to the spec of an InferenceService after one second by default.
+func Builder(c client.Client) *Client {
+	return &Client{
+		Client: c,
+		delay:  time.Second,
+	}
+}
+
+// SetDelay sets the duration after which status reflects changes to the spec of an InferenceService.
+// With a zero delay, status reflects these changes as soon as the change returns.
+func (c *Client) SetDelay(delay time.Duration) *Client {
+	c.delay = delay
+	return c
+}
+
+// SetReadinessFailure sets whether InferenceServices fail to become ready in subsequent reconciles.
+func (c *Client) SetReadinessFailure(fail bool) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readinessFailure = fail
+	return c
+}
+
+// SetPatchError sets the error returned by subsequent patches and updates of InferenceServices; a nil error lets them succeed.
+func (c *Client) SetPatchError(err error) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.patchErr = err
+	return c
+}
+
+// Wait waits for the reconciles which are due to complete.
+func (c *Client) Wait() {
+	c.reconciles.Wait()
+}
+
+// Patch patches the given object, and reconciles it if it is an InferenceService whose spec changed.
+func (c *Client) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.write(ctx, obj, func() error {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	})
+}
+
+// Update updates the given object, and reconciles it if it is an InferenceService whose spec changed.
+func (c *Client) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.write(ctx, obj, func() error {
+		return c.Client.Update(ctx, obj, opts...)
+	})
+}
+
+// write is a helper function that writes the given object using the given function, and reconciles it if it is an InferenceService whose spec changed.
+func (c *Client) write(ctx context.Context, obj client.Object, writeFunc func() error) error {
+	if obj.GetObjectKind().GroupVersionKind() != inferenceServiceGVK {
+		return writeFunc()
+	}
+	c.mu.Lock()
+	err := c.patchErr
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	key := client.ObjectKeyFromObject(obj)
+	before, err := c.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := writeFunc(); err != nil {
+		return err
+	}
+	after, err := c.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(before.Object["spec"], after.Object["spec"]) {
+		c.reconcile(key)
+	}
+	return nil
+}
+
+// CreateRevision simulates a change to the given component of the given InferenceService which creates a new revision of this component, and returns the name of this revision.
+// The new revision is rolled out immediately unless the component has a canaryTrafficPercent, in which case it becomes the canary.
+func (c *Client) CreateRevision(ctx context.Context, key client.ObjectKey, component string) (string, error) {
+	c.mu.Lock()
+	c.revisions++
+	rev := fmt.Sprintf("%s-%s-default-%05d", key.Name, component, c.revisions)
+	c.mu.Unlock()
+	err := c.updateStatus(ctx, key, func(isvc *unstructured.Unstructured) error {
+		for _, field := range []string{"latestCreatedRevision", "latestReadyRevision"} {
+			if err := unstructured.SetNestedField(isvc.Object, rev, "status", "components", component, field); err != nil {
+				return err
+			}
+		}
+		return rollout(isvc)
+	})
+	return rev, err
+}
+
+// reconcile is a helper function that marks the given InferenceService as un-ready, and updates its status to reflect its spec after the delay of the client.
+func (c *Client) reconcile(key client.ObjectKey) {
+	ctx := context.Background()
+	c.updateStatus(ctx, key, func(isvc *unstructured.Unstructured) error {
+		return setConditions(isvc, "Unknown")
+	})
+	if c.delay == 0 {
+		c.Reconcile(ctx, key)
+		return
+	}
+	c.reconciles.Add(1)
+	time.AfterFunc(c.delay, func() {
+		defer c.reconciles.Done()
+		c.Reconcile(ctx, key)
+	})
+}
+
+// Reconcile updates the status of the given InferenceService to reflect its spec, and marks it as ready unless readiness failure is set.
+func (c *Client) Reconcile(ctx context.Context, key client.ObjectKey) error {
+	c.mu.Lock()
+	status := "True"
+	if c.readinessFailure {
+		status = "False"
+	}
+	c.mu.Unlock()
+	return c.updateStatus(ctx, key, func(isvc *unstructured.Unstructured) error {
+		if err := rollout(isvc); err != nil {
+			return err
+		}
+		return setConditions(isvc, status)
+	})
+}
+
+// get is a helper function that gets the given InferenceService from the underlying client.
+func (c *Client) get(ctx context.Context, key client.ObjectKey) (*unstructured.Unstructured, error) {
+	isvc := &unstructured.Unstructured{}
+	isvc.SetGroupVersionKind(inferenceServiceGVK)
+	err := c.Client.Get(ctx, key, isvc)
+	return isvc, err
+}
+
+// updateStatus is a helper function that updates the given InferenceService in the underlying client using the given mutation, retrying on conflicts.
+func (c *Client) updateStatus(ctx context.Context, key client.ObjectKey, mutate func(*unstructured.Unstructured) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		isvc, err := c.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if err := mutate(isvc); err != nil {
+			return err
+		}
+		return c.Client.Update(ctx, isvc)
+	})
+}
+
+// rollout is a helper function that updates the revisions and traffic in the status of each component of the given InferenceService to reflect its canaryTrafficPercent.
+// Components without canaryTrafficPercent or without a rolled out revision roll out their latest created revision. Otherwise, the latest created revision receives canaryTrafficPercent of the traffic, and the latest rolled out revision receives the rest.
+func rollout(isvc *unstructured.Unstructured) error {
+	for component := range components {
+		if _, found, _ := unstructured.NestedMap(isvc.Object, "spec", component); !found {
+			continue
+		}
+		created, _, _ := unstructured.NestedString(isvc.Object, "status", "components", component, "latestCreatedRevision")
+		rolledOut, _, _ := unstructured.NestedString(isvc.Object, "status", "components", component, "latestRolledoutRevision")
+		p, found, err := unstructured.NestedInt64(isvc.Object, "spec", component, "canaryTrafficPercent")
+		if err != nil {
+			return err
+		}
+		// the first revision of a component is rolled out, whether or not it has a canaryTrafficPercent
+		if !found || rolledOut == "" {
+			rolledOut = created
+		}
+		traffic := []interface{}{map[string]interface{}{
+			"latestRevision": true,
+			"percent":        int64(100),
+			"revisionName":   created,
+		}}
+		if created != rolledOut {
+			// tagged routes are served at the host of the component, prefixed by their tag
+			host := isvc.GetName() + "-" + component + "-default." + isvc.GetNamespace() + ".example.com"
+			traffic = []interface{}{map[string]interface{}{
+				"latestRevision": true,
+				"percent":        p,
+				"revisionName":   created,
+				"tag":            "latest",
+				"url":            "http://latest-" + host,
+			}, map[string]interface{}{
+				"latestRevision": false,
+				"percent":        100 - p,
+				"revisionName":   rolledOut,
+				"tag":            "prev",
+				"url":            "http://prev-" + host,
+			}}
+		}
+		if err := unstructured.SetNestedField(isvc.Object, rolledOut, "status", "components", component, "latestRolledoutRevision"); err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedSlice(isvc.Object, traffic, "status", "components", component, "traffic"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setConditions is a helper function that sets the status of the Ready condition of the given InferenceService, and of the readiness conditions of its components, to the given status.
+func setConditions(isvc *unstructured.Unstructured, status string) error {
+	types := map[string]bool{"Ready": true}
+	for component, condition := range components {
+		if _, found, _ := unstructured.NestedMap(isvc.Object, "spec", component); found {
+			types[condition] = true
+		}
+	}
+	conditions, _, err := unstructured.NestedSlice(isvc.Object, "status", "conditions")
+	if err != nil {
+		return err
+	}
+	for _, c := range conditions {
+		if cond, ok := c.(map[string]interface{}); ok && types[fmt.Sprint(cond["type"])] {
+			cond["status"] = status
+			delete(types, fmt.Sprint(cond["type"]))
+		}
+	}
+	for conditionType := range types {
+		conditions = append(conditions, map[string]interface{}{
+			"type":   conditionType,
+			"status": status,
+		})
+	}
+	return unstructured.SetNestedSlice(isvc.Object, conditions, "status", "conditions")
+}
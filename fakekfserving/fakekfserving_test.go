@@ -0,0 +1,114 @@
+package fakekfserving
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/iter8-tools/iter8ctl/utils"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var key = client.ObjectKey{Namespace: "default", Name: "my-model"}
+
+func getClientWithTargetFromFile(t *testing.T, filePath string) *Client {
+	data, err := ioutil.ReadFile(utils.CompletePath("../testdata", filePath))
+	if err != nil {
+		t.Fatal("Cannot read target from file", err)
+	}
+	u := &unstructured.Unstructured{
+		Object: make(map[string]interface{}),
+	}
+	if err = json.Unmarshal(data, &u.Object); err != nil {
+		t.Fatal("Cannot unmarshal target", err)
+	}
+	return Builder(fake.NewClientBuilder().WithObjects(u).Build()).SetDelay(10 * time.Millisecond)
+}
+
+func getReady(t *testing.T, c *Client) string {
+	isvc, err := c.get(context.Background(), key)
+	if err != nil {
+		t.Fatal("Cannot get target", err)
+	}
+	conditions, _, _ := unstructured.NestedSlice(isvc.Object, "status", "conditions")
+	for _, cond := range conditions {
+		if cond.(map[string]interface{})["type"] == "Ready" {
+			return cond.(map[string]interface{})["status"].(string)
+		}
+	}
+	return ""
+}
+
+func patchSpec(t *testing.T, c *Client, patch string) error {
+	isvc, err := c.get(context.Background(), key)
+	if err != nil {
+		t.Fatal("Cannot get target", err)
+	}
+	return c.Patch(context.Background(), isvc, client.RawPatch(types.MergePatchType, []byte(patch)))
+}
+
+func TestReconcileCanaryTrafficPercent(t *testing.T) {
+	c := getClientWithTargetFromFile(t, "canaryv1beta1.json")
+	assert.NoError(t, patchSpec(t, c, `{"spec":{"predictor":{"canaryTrafficPercent":20}}}`))
+	assert.Equal(t, "Unknown", getReady(t, c))
+	c.Wait()
+	assert.Equal(t, "True", getReady(t, c))
+	isvc, _ := c.get(context.Background(), key)
+	traffic, _, _ := unstructured.NestedSlice(isvc.Object, "status", "components", "predictor", "traffic")
+	assert.Equal(t, int64(20), traffic[0].(map[string]interface{})["percent"])
+	assert.Equal(t, int64(80), traffic[1].(map[string]interface{})["percent"])
+
+	// the canary is rolled out once canaryTrafficPercent is removed
+	assert.NoError(t, patchSpec(t, c, `{"spec":{"predictor":{"canaryTrafficPercent":null}}}`))
+	c.Wait()
+	isvc, _ = c.get(context.Background(), key)
+	rev, _, _ := unstructured.NestedString(isvc.Object, "status", "components", "predictor", "latestRolledoutRevision")
+	assert.Equal(t, "my-model-predictor-default-zwjbq", rev)
+}
+
+func TestMetadataChangesAreNotReconciled(t *testing.T) {
+	c := getClientWithTargetFromFile(t, "canaryv1beta1.json")
+	assert.NoError(t, patchSpec(t, c, `{"metadata":{"annotations":{"key":"value"}}}`))
+	assert.Equal(t, "True", getReady(t, c))
+}
+
+func TestCreateRevision(t *testing.T) {
+	c := getClientWithTargetFromFile(t, "canaryv1beta1.json")
+	rev, err := c.CreateRevision(context.Background(), key, "predictor")
+	assert.NoError(t, err)
+	assert.Equal(t, "my-model-predictor-default-00001", rev)
+	isvc, _ := c.get(context.Background(), key)
+	created, _, _ := unstructured.NestedString(isvc.Object, "status", "components", "predictor", "latestCreatedRevision")
+	rolledOut, _, _ := unstructured.NestedString(isvc.Object, "status", "components", "predictor", "latestRolledoutRevision")
+	// the target has canaryTrafficPercent; so, the new revision is the canary
+	assert.Equal(t, rev, created)
+	assert.Equal(t, "my-model-predictor-default-wl2cv", rolledOut)
+}
+
+func TestInjectedFailures(t *testing.T) {
+	c := getClientWithTargetFromFile(t, "canaryv1beta1.json")
+	c.SetReadinessFailure(true)
+	assert.NoError(t, patchSpec(t, c, `{"spec":{"predictor":{"canaryTrafficPercent":20}}}`))
+	c.Wait()
+	assert.Equal(t, "False", getReady(t, c))
+
+	c.SetPatchError(errors.New("injected"))
+	assert.Error(t, patchSpec(t, c, `{"spec":{"predictor":{"canaryTrafficPercent":30}}}`))
+	c.SetPatchError(nil).SetReadinessFailure(false)
+	assert.NoError(t, patchSpec(t, c, `{"spec":{"predictor":{"canaryTrafficPercent":30}}}`))
+	c.Wait()
+	assert.Equal(t, "True", getReady(t, c))
+}
+
+func TestZeroDelayReconcilesSynchronously(t *testing.T) {
+	c := getClientWithTargetFromFile(t, "canaryv1beta1.json").SetDelay(0)
+	assert.NoError(t, patchSpec(t, c, `{"spec":{"predictor":{"canaryTrafficPercent":20}}}`))
+	assert.Equal(t, "True", getReady(t, c))
+}
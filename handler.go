@@ -2,21 +2,54 @@
 //
 // It enables set up and completion of iter8-kfserving experiments. For more details on how it is invoked during experiments, see https://github.com/iter8-tools/iter8-kfserving/wiki/Under-the-Hood.
 //
-// CLI usage: `handler start` and `handler finish`
+// CLI usage: `handler start`, `handler finish`, `handler serve`, `handler controller` and `handler simulate --experiment exp.yaml --target isvc.yaml --phase start|finish`
 //
-// In the above usage commands, handler is the built executable. Both these commands expect environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE to be set.
+// In the above usage commands, handler is the built executable. The start and finish commands expect environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE to be set. The serve and controller commands run these commands for experiments as a long-running service (see package server) or controller (see package controller), and the simulate command runs them in an in-memory cluster in which KFServing is simulated, printing the changes they make.
+//
+// The target of an experiment is a v1beta1 InferenceService, a TrainedModel, an Argo Rollout or a Gateway API HTTPRoute; see the package of each kind for details. Other environment variables of the handler are documented where they are read.
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
 
+	"github.com/iter8-tools/iter8-kfserving-handler/controller"
 	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/fakekfserving"
+	"github.com/iter8-tools/iter8-kfserving-handler/httproute"
 	"github.com/iter8-tools/iter8-kfserving-handler/k8sclient"
+	"github.com/iter8-tools/iter8-kfserving-handler/metrics"
+	"github.com/iter8-tools/iter8-kfserving-handler/replay"
+	"github.com/iter8-tools/iter8-kfserving-handler/rollout"
+	"github.com/iter8-tools/iter8-kfserving-handler/server"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/tracing"
+	"github.com/iter8-tools/iter8-kfserving-handler/trainedmodel"
 	"github.com/iter8-tools/iter8-kfserving-handler/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // OSExiter interface enables exiting the current program.
@@ -34,6 +67,12 @@ var osExiter OSExiter
 // k8s enables the use of fake clients in tests.
 var k8s k8sclient.K8s
 
+// shutdownTracing flushes pending spans to the OTLP collector; it is nil if spans are not exported.
+var shutdownTracing func(context.Context) error
+
+// logger is the logger of the handler process.
+var logger *log.Entry
+
 // stdin enables dependency injection for console input.
 var stdin io.Reader
 
@@ -50,64 +89,543 @@ func init() {
 	stdout = os.Stdout
 	stderr = os.Stderr
 	// logging
-	logLevel, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
-	if err != nil {
-		log.SetOutput(ioutil.Discard)
+	configureLogging()
+	// osExiter
+	osExiter = &iter8OS{}
+	// k8s
+	k8s = &k8sclient.Iter8K8s{}
+}
+
+// configureLogging sends logs to stderr in the format specified by LOG_FORMAT, at the level specified by LOG_LEVEL.
+// Warnings and errors are logged if LOG_LEVEL is unset or invalid.
+func configureLogging() {
+	log.SetOutput(stderr)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
 	} else {
-		log.SetOutput(stdout)
 		log.SetFormatter(&log.TextFormatter{
 			FullTimestamp: true,
 		})
-		log.SetReportCaller(true)
-		log.SetLevel(logLevel)
 	}
-	// osExiter
-	osExiter = &iter8OS{}
-	// k8s
-	k8s = &k8sclient.Iter8K8s{}
+	log.SetReportCaller(true)
+	logLevel, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		logLevel = log.WarnLevel
+	}
+	log.SetLevel(logLevel)
+	logger = log.NewEntry(log.StandardLogger())
 }
 
-// main serves as the entry point for handler CLI.
-func main() {
-	// h := handler.Builder(stdin, stdout, stderr)
-	if len(os.Args) < 2 {
-		log.Error("expected 'start' or 'finish' subcommands")
-		osExiter.Exit(1)
-	} else if os.Args[1] == "start" || os.Args[1] == "finish" {
+// getSecondsFromEnv returns the duration specified in seconds by the given environment variable.
+// It returns false if the environment variable is unset or is not a non-negative integer.
+func getSecondsFromEnv(key string) (time.Duration, bool) {
+	if val, ok := os.LookupEnv(key); ok {
+		secs, err := strconv.ParseUint(val, 10, 32)
+		if err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+		logger.Warn("ignoring invalid value of "+key+": ", val)
+	}
+	return 0, false
+}
+
+// getMaxConcurrentReconciles returns the maximum number of experiments for which the controller runs handler phases concurrently.
+// It is set by MAX_CONCURRENT_RECONCILES, and defaults to 4 if this environment variable is unset or is not a positive integer.
+func getMaxConcurrentReconciles() int {
+	if val, ok := os.LookupEnv("MAX_CONCURRENT_RECONCILES"); ok {
+		n, err := strconv.ParseUint(val, 10, 16)
+		if err == nil && n > 0 {
+			return int(n)
+		}
+		logger.Warn("ignoring invalid value of MAX_CONCURRENT_RECONCILES: ", val)
+	}
+	return 4
+}
+
+// flushMetrics pushes the metrics recorded by the given recorder to the Pushgateway at PUSHGATEWAY_URL, and writes them to the file METRICS_TEXTFILE, if these environment variables are set.
+// Failure to flush metrics does not fail the handler run.
+func flushMetrics(recorder *metrics.Recorder) {
+	if url, ok := os.LookupEnv("PUSHGATEWAY_URL"); ok {
+		if err := recorder.Push(url); err != nil {
+			logger.Warn("unable to push metrics: ", err)
+		}
+	}
+	if filename, ok := os.LookupEnv("METRICS_TEXTFILE"); ok {
+		if err := recorder.WriteToTextfile(filename); err != nil {
+			logger.Warn("unable to write metrics: ", err)
+		}
+	}
+}
+
+// startTracing sets up export of spans to the OTLP collector at OTEL_EXPORTER_OTLP_ENDPOINT, if this environment variable is set.
+// Failure to set up tracing does not fail the handler run.
+func startTracing() {
+	shutdownTracing = nil
+	if endpoint, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+		shutdown, err := tracing.Init(context.Background(), endpoint)
+		if err != nil {
+			logger.Warn("unable to set up tracing: ", err)
+			return
+		}
+		shutdownTracing = shutdown
+	}
+}
+
+// flushTraces flushes pending spans to the OTLP collector.
+func flushTraces() {
+	if shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Warn("unable to export spans: ", err)
+		}
+		shutdownTracing = nil
+	}
+}
+
+// run runs the given phase (start or finish) of the handler for the experiment returned by getExperiment, and logs and returns the error which failed it, if any.
+// It also returns the recorder of the metrics of the run, which is nil if the experiment cannot be fetched. The span of the run continues the trace propagated in the experiment.
+// If noWait is true, the run neither waits for a candidate nor verifies cutovers, unless the environment variables of the handler set these waits.
+func run(phase string, c client.Client, getExperiment func(client.Client) (*experiment.Experiment, error), noWait bool) (recorder *metrics.Recorder, err error) {
+	runLogger := log.WithField("phase", phase)
+	// fetch the iter8 experiment
+	start := time.Now()
+	exp, err := getExperiment(c)
+	// the span of this run continues the trace propagated in the experiment;
+	// so, it starts only after the experiment is fetched
+	ctx := context.Background()
+	if err == nil {
+		ctx = tracing.ContextFromAnnotations(ctx, exp.GetAnnotations())
+	}
+	ctx, runSpan := tracing.Start(ctx, "handler."+phase, trace.WithTimestamp(start))
+	defer func() {
+		tracing.End(runSpan, err)
+	}()
+	_, span := tracing.Start(ctx, "experiment.GetExperiment", trace.WithTimestamp(start))
+	tracing.End(span, err)
+	if err != nil {
+		runLogger.Error("cannot get experiment: ", err)
+		return nil, err
+	}
+	runLogger = runLogger.WithFields(exp.LogFields())
+	targetRef := exp.GetTargetRef()
+	recorder = metrics.NewRecorder(phase, targetKind(targetRef)).SetExperiment(exp.GetNamespace(), exp.GetName())
+	// construct a target object for the kind of the target
+	targ := newTarget(targetRef, phase, ctx, recorder, noWait)
+	targ.SetK8sClient(c).SetExperiment(exp).Fetch(targetRef)
+	if phase == "start" { // handle start
+		// this is the start handler logic
+		// refuse to run alongside another experiment on the same target
+		targ.Claim()
+		claimed := targ.Error() == nil
+		if !exp.IsSingleVersion() {
+			// refuse to compare a revision against itself
+			targ.EnsureCandidate().SnapshotTrafficState()
+		}
+		targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+		runLogger.Trace("Set version info in experiment")
+		if claimed && targ.Error() != nil {
+			// a failed experiment does not hold on to its target
+			targ.Release()
+		}
+	} else { // handle finish
+		// this is the finish handler logic
+		if exp.IsSingleVersion() {
+			targ.RecordAssessedVersion()
+			runLogger.Trace("Recorded assessed version")
+		} else {
+			targ.SetNewBaseline()
+			runLogger.Trace("Set new baseline")
+		}
+		// the target is released even if the finish phase failed
+		targ.Release()
+	}
+	if targ.Error() != nil {
+		runLogger.Error(targ.Error())
+	}
+	return recorder, targ.Error()
+}
+
+// targetKind returns the canonical kind of the target which newTarget constructs for the given target reference, such as Rollout, which labels the metrics of a handler run.
+// References of other kinds, including references without a kind, name InferenceServices.
+func targetKind(targetRef string) string {
+	for _, k := range []*target.ObjectKind{trainedmodel.Kind, rollout.Kind, httproute.Kind} {
+		if k.IsRef(targetRef) {
+			return k.GVK.Kind
+		}
+	}
+	return "InferenceService"
+}
+
+// newTarget returns a target for the kind named by the given target reference, configured by the environment variables of the handler.
+// References without a kind name v1beta1 InferenceServices. For these, FINISH_MODE=promote promotes a winning candidate instead of shifting all traffic to it, and VERSION_TAG_PATHS replaces the version tags by a JSON object mapping tag names to JSONPath expressions evaluated against the Revision of each version.
+func newTarget(targetRef string, phase string, ctx context.Context, recorder *metrics.Recorder, noWait bool) target.Target {
+	if trainedmodel.Kind.IsRef(targetRef) {
+		targ := trainedmodel.TargetBuilder()
+		configureBase(&targ.Base, phase, ctx, recorder, noWait)
+		return targ
+	}
+	if rollout.Kind.IsRef(targetRef) {
+		targ := rollout.TargetBuilder()
+		configureBase(&targ.Base, phase, ctx, recorder, noWait)
+		return targ
+	}
+	if httproute.Kind.IsRef(targetRef) {
+		targ := httproute.TargetBuilder()
+		configureBase(&targ.Base, phase, ctx, recorder, noWait)
+		return targ
+	}
+	targ := v1beta1.TargetBuilder()
+	configureBase(&targ.Base, phase, ctx, recorder, noWait)
+	if mode, ok := os.LookupEnv("FINISH_MODE"); ok {
+		targ.SetFinishMode(v1beta1.FinishMode(mode))
+	}
+	if paths, ok := os.LookupEnv("VERSION_TAG_PATHS"); ok {
+		tagPaths := map[string]string{}
+		if err := json.Unmarshal([]byte(paths), &tagPaths); err != nil {
+			logger.Warn("ignoring invalid value of VERSION_TAG_PATHS: ", err)
+		} else {
+			targ.SetTagPaths(tagPaths)
+		}
+	}
+	return targ
+}
+
+// configureBase configures the state shared by targets of each kind from the environment variables of the handler.
+// CANDIDATE_WAIT_SECONDS sets the maximum wait for a candidate in the start phase (180 sec by default), and VERIFICATION_WINDOW_SECONDS sets the window in which the readiness of the target is verified after a BlueGreen cutover (60 sec by default).
+// If noWait is true, the candidate wait and verification window are zero unless set by these variables.
+func configureBase(b *target.Base, phase string, ctx context.Context, recorder *metrics.Recorder, noWait bool) {
+	// the target adds the fields of the experiment to its log entries
+	b.SetRecorder(recorder).SetContext(ctx).SetLogger(log.WithField("phase", phase)).SetResumable(true)
+	if noWait {
+		b.SetCandidateWait(0).SetVerificationWindow(0)
+	}
+	if wait, ok := getSecondsFromEnv("CANDIDATE_WAIT_SECONDS"); ok {
+		b.SetCandidateWait(wait)
+	}
+	if window, ok := getSecondsFromEnv("VERIFICATION_WINDOW_SECONDS"); ok {
+		b.SetVerificationWindow(window)
+	}
+}
+
+// runJob runs the given phase (start or finish) of the handler for the experiment named by the environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE, and exits with code 1 if it fails.
+// If RECORD_CASSETTE is set, the requests of the run to the Kubernetes API server are recorded, along with their responses, in a cassette written to this file.
+func runJob(phase string) {
+	logger = log.WithField("phase", phase)
+	var recorder *metrics.Recorder
+	startTracing()
+	namespace, name, err := experiment.GetExperimentNameFromEnv()
+	if err != nil {
+		logger.Error("cannot get experiment: ", err)
+	} else {
 		// get a k8s client;
 		// in a normal invocation, this will use in-cluster k8s config
 		// in tests, this will be a fake client
-		client, err := k8s.GetClient()
-		// fetch the iter8 experiment
-		exp, err := experiment.GetExperiment(client)
-		if err != nil {
-			log.Error("cannot get experiment", err)
-			osExiter.Exit(1)
-		}
-		targetRef := exp.GetTargetRef()
-		// construct a target object
-		var targ = v1beta1.TargetBuilder()
-		targ.SetK8sClient(client).SetExperiment(exp).Fetch(targetRef)
-		if os.Args[1] == "start" { // handle start
-			// this is the start handler logic
-			targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
-			log.Trace("Set version info in experiment")
-			log.Trace("Target error: ", targ.Error())
-		} else { // handle finish
-			if exp.IsSingleVersion() {
-				osExiter.Exit(0)
+		var c client.Client
+		if c, err = k8s.GetClient(); err != nil {
+			logger.Error("cannot get k8s client: ", err)
+		} else {
+			path, record := os.LookupEnv("RECORD_CASSETTE")
+			if record {
+				// record API interactions of this phase
+				c = replay.RecorderBuilder(c)
 			}
-			// this is the finish handler logic
-			targ.SetNewBaseline()
-			log.Trace("Set new baseline")
-			log.Trace("Target error: ", targ.Error())
+			recorder, err = run(phase, c, getExperimentByName(namespace, name), false)
+			if record {
+				saveCassette(c.(*replay.Recorder), path)
+			}
+		}
+	}
+	flushMetrics(recorder)
+	flushTraces()
+	if err != nil {
+		osExiter.Exit(1)
+	}
+}
+
+// saveCassette saves the API interactions recorded by the given recorder in the given file.
+// A cassette in which some interactions could not be recorded is not saved, since tests replaying it would fail on the missing interactions.
+func saveCassette(rc *replay.Recorder, path string) {
+	if err := rc.Err(); err != nil {
+		logger.Error("cannot record cassette: ", err)
+		return
+	}
+	if err := rc.Cassette().Save(path); err != nil {
+		logger.Error("cannot save cassette: ", err)
+	}
+}
+
+// getExperimentByName returns a function which fetches the experiment with the given namespace and name.
+func getExperimentByName(namespace string, name string) func(client.Client) (*experiment.Experiment, error) {
+	return func(c client.Client) (*experiment.Experiment, error) {
+		return experiment.GetExperimentByName(c, namespace, name)
+	}
+}
+
+// runWithMetrics returns a function which runs handler phases using the given k8s client, and flushes the metrics of each phase after it is run.
+func runWithMetrics(c client.Client) func(string, string, string) error {
+	return func(phase string, namespace string, name string) error {
+		recorder, err := run(phase, c, getExperimentByName(namespace, name), false)
+		flushMetrics(recorder)
+		return err
+	}
+}
+
+// exitWithError logs the given error which prevents the handler from running, flushes pending spans, and exits with code 1.
+func exitWithError(msg string, err error) {
+	logger.Error(msg, err)
+	flushTraces()
+	osExiter.Exit(1)
+}
+
+// newServer returns a handler service which runs handler phases using the given k8s client.
+func newServer(c client.Client) *server.Server {
+	return server.Builder(runWithMetrics(c))
+}
+
+// serve runs handler phases requested through the HTTP API of the handler service at SERVE_ADDRESS, until the handler receives SIGTERM or SIGINT.
+func serve() {
+	logger = log.WithField("phase", "serve")
+	startTracing()
+	c, err := k8s.GetClient()
+	if err != nil {
+		exitWithError("cannot get k8s client: ", err)
+		return
+	}
+	srv := newServer(c)
+	addr, ok := os.LookupEnv("SERVE_ADDRESS")
+	if !ok {
+		addr = ":8080"
+	}
+	// on SIGTERM or SIGINT, stop accepting requests and wait for running phases to complete
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		<-signals
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logger.Warn("unable to shut down handler service: ", err)
+		}
+		close(stopped)
+	}()
+	logger.Info("serving handler API at ", addr)
+	if err := srv.ListenAndServe(addr); err != http.ErrServerClosed {
+		exitWithError("cannot serve handler API: ", err)
+		return
+	}
+	<-stopped
+	flushTraces()
+}
+
+// runController runs handler phases as experiments progress, until the handler receives SIGTERM or SIGINT.
+// Among the replicas of the controller, only the elected leader runs handler phases; LEADER_ELECTION_NAMESPACE sets the namespace of the leader election lock when the controller runs outside a cluster.
+// MAX_CONCURRENT_RECONCILES sets the maximum number of experiments for which handler phases run concurrently.
+func runController() {
+	logger = log.WithField("phase", "controller")
+	startTracing()
+	c, err := k8s.GetClient()
+	if err != nil {
+		exitWithError("cannot get k8s client: ", err)
+		return
+	}
+	cfg, err := config.GetConfig()
+	if err != nil {
+		exitWithError("cannot get k8s config: ", err)
+		return
+	}
+	scheme := runtime.NewScheme()
+	if err := etc3.AddToScheme(scheme); err != nil {
+		exitWithError("cannot add experiments to scheme: ", err)
+		return
+	}
+	options := ctrl.Options{
+		Scheme:           scheme,
+		LeaderElection:   true,
+		LeaderElectionID: controller.LeaderElectionID,
+		// handler metrics are pushed or written to a file
+		MetricsBindAddress: "0",
+	}
+	if namespace, ok := os.LookupEnv("LEADER_ELECTION_NAMESPACE"); ok {
+		options.LeaderElectionNamespace = namespace
+	}
+	mgr, err := ctrl.NewManager(cfg, options)
+	if err != nil {
+		exitWithError("cannot create controller manager: ", err)
+		return
+	}
+	// completed phases are recorded in experiments;
+	// so, experiments are read without a cache, to avoid running a completed phase again
+	reconciler := &controller.Reconciler{
+		Client:                  c,
+		Run:                     runWithMetrics(c),
+		MaxConcurrentReconciles: getMaxConcurrentReconciles(),
+	}
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		exitWithError("cannot set up controller: ", err)
+		return
+	}
+	logger.Info("starting controller")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		exitWithError("cannot run controller: ", err)
+		return
+	}
+	flushTraces()
+}
+
+// simulate runs the phase of the handler given by the --phase flag for the experiment and InferenceService in the YAML files given by the --experiment and --target flags, in an in-memory cluster in which KFServing is simulated.
+// It prints the resulting objects along with their changes, and exits with code 1 if the phase fails.
+func simulate(args []string) {
+	logger = log.WithField("phase", "simulate")
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	expFile := flags.String("experiment", "", "YAML file of the experiment")
+	targetFile := flags.String("target", "", "YAML file of the InferenceService targeted by the experiment")
+	phase := flags.String("phase", "start", "phase of the handler to simulate: start or finish")
+	if err := flags.Parse(args); err != nil {
+		exitWithError("invalid flags: ", err)
+		return
+	}
+	if *expFile == "" || *targetFile == "" || (*phase != "start" && *phase != "finish") {
+		exitWithError("invalid flags: ", errors.New("expected --experiment <file> --target <file> --phase start|finish"))
+		return
+	}
+	exp := &etc3.Experiment{}
+	if err := readYAML(*expFile, exp); err != nil {
+		exitWithError("cannot read experiment: ", err)
+		return
+	}
+	isvc := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	if err := readYAML(*targetFile, &isvc.Object); err != nil {
+		exitWithError("cannot read target: ", err)
+		return
+	}
+	c, err := simulatedClient(exp, isvc)
+	if err != nil {
+		exitWithError("cannot simulate cluster: ", err)
+		return
+	}
+	before, err := getSimulatedObjects(c, exp, isvc)
+	if err != nil {
+		exitWithError("cannot get objects: ", err)
+		return
+	}
+	// run logs the error which failed the phase;
+	// the simulation neither waits for a candidate nor verifies cutovers, unless asked to
+	_, runErr := run(*phase, c, getExperimentByName(exp.Namespace, exp.Name), true)
+	after, err := getSimulatedObjects(c, exp, isvc)
+	if err != nil {
+		exitWithError("cannot get objects: ", err)
+		return
+	}
+	if err := printSimulation(stdout, before, after); err != nil {
+		exitWithError("cannot print objects: ", err)
+		return
+	}
+	if runErr != nil {
+		osExiter.Exit(1)
+	}
+}
+
+// readYAML reads the object in the given YAML file into obj.
+func readYAML(filename string, obj interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, obj)
+}
+
+// simulatedClient returns an in-memory k8s client holding the given experiment and InferenceService, in which KFServing is simulated.
+// An InferenceService without status is given a ready revision of each of its components.
+func simulatedClient(exp *etc3.Experiment, isvc *unstructured.Unstructured) (client.Client, error) {
+	scheme := runtime.NewScheme()
+	if err := etc3.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	c := fakekfserving.Builder(fake.NewClientBuilder().WithScheme(scheme).WithObjects(exp, isvc).Build()).SetDelay(0)
+	if _, found := isvc.Object["status"]; found {
+		return c, nil
+	}
+	ctx := context.Background()
+	key := client.ObjectKeyFromObject(isvc)
+	for _, component := range []string{"predictor", "transformer", "explainer"} {
+		if _, found, _ := unstructured.NestedMap(isvc.Object, "spec", component); found {
+			if _, err := c.CreateRevision(ctx, key, component); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, c.Reconcile(ctx, key)
+}
+
+// getSimulatedObjects returns the given experiment and InferenceService as currently held by the given client.
+func getSimulatedObjects(c client.Client, exp *etc3.Experiment, isvc *unstructured.Unstructured) ([]map[string]interface{}, error) {
+	ctx := context.Background()
+	e := &etc3.Experiment{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(exp), e); err != nil {
+		return nil, err
+	}
+	e.SetGroupVersionKind(etc3.GroupVersion.WithKind("Experiment"))
+	expObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(e)
+	if err != nil {
+		return nil, err
+	}
+	i := &unstructured.Unstructured{}
+	i.SetGroupVersionKind(isvc.GroupVersionKind())
+	if err := c.Get(ctx, client.ObjectKeyFromObject(isvc), i); err != nil {
+		return nil, err
+	}
+	objs := []map[string]interface{}{expObj, i.Object}
+	for _, obj := range objs {
+		// resource versions change with each write; so, they are not printed
+		unstructured.RemoveNestedField(obj, "metadata", "resourceVersion")
+	}
+	return objs, nil
+}
+
+// printSimulation writes the given objects resulting from a simulation as YAML documents, each preceded by comments which show its changes from the respective object before the simulation.
+func printSimulation(w io.Writer, before []map[string]interface{}, after []map[string]interface{}) error {
+	for i, obj := range after {
+		if i > 0 {
+			fmt.Fprintln(w, "---")
 		}
-		if targ.Error() != nil {
-			log.Error(targ.Error())
-			osExiter.Exit(1)
+		u := &unstructured.Unstructured{Object: obj}
+		fmt.Fprintf(w, "# %s %s/%s\n", u.GetKind(), u.GetNamespace(), u.GetName())
+		if diff := cmp.Diff(before[i], obj); diff == "" {
+			fmt.Fprintln(w, "# no changes")
+		} else {
+			fmt.Fprintln(w, "# changes (-before +after):")
+			for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+				fmt.Fprintln(w, "#", line)
+			}
+		}
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
 		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// main serves as the entry point for handler CLI.
+func main() {
+	// h := handler.Builder(stdin, stdout, stderr)
+	if len(os.Args) < 2 {
+		log.Error("expected 'start', 'finish', 'serve', 'controller' or 'simulate' subcommands")
+		osExiter.Exit(1)
+	} else if os.Args[1] == "start" || os.Args[1] == "finish" {
+		runJob(os.Args[1])
+	} else if os.Args[1] == "serve" {
+		serve()
+	} else if os.Args[1] == "controller" {
+		runController()
+	} else if os.Args[1] == "simulate" {
+		simulate(os.Args[2:])
 	} else {
-		log.Error("expected 'start' or 'finish' subcommands")
+		log.Error("expected 'start', 'finish', 'serve', 'controller' or 'simulate' subcommands")
 		osExiter.Exit(1)
 	}
 }
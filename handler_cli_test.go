@@ -26,7 +26,7 @@ var _ = Describe("Handler", func() {
 
 			It("should result in an error message", func() {
 				cmd.Run()
-				Expect(outbuf.String()).Should(ContainSubstring("expected 'start' or 'finish' subcommands"))
+				Expect(errbuf.String()).Should(ContainSubstring("expected 'start', 'finish', 'serve', 'controller' or 'simulate' subcommands"))
 			})
 		})
 
@@ -39,7 +39,7 @@ var _ = Describe("Handler", func() {
 
 			It("should result in an error message", func() {
 				cmd.Run()
-				Expect(outbuf.String()).Should(ContainSubstring("expected 'start' or 'finish' subcommands"))
+				Expect(errbuf.String()).Should(ContainSubstring("expected 'start', 'finish', 'serve', 'controller' or 'simulate' subcommands"))
 			})
 		})
 
@@ -52,7 +52,23 @@ var _ = Describe("Handler", func() {
 
 			It("should result in an error message", func() {
 				cmd.Run()
-				Expect(outbuf.String()).Should(ContainSubstring("environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE need to be set to valid values"))
+				Expect(errbuf.String()).Should(ContainSubstring("environment variables EXPERIMENT_NAME and EXPERIMENT_NAMESPACE need to be set to valid values"))
+				Expect(outbuf.String()).Should(BeEmpty())
+			})
+		})
+
+		Context("With 'start' subcommand, JSON log format and no log level", func() {
+			cmd := exec.Command(utils.CompletePath("", "handler"), "start")
+			cmd.Env = append(os.Environ(), "LOG_FORMAT=json", "LOG_LEVEL=")
+			outbuf, errbuf := bytes.Buffer{}, bytes.Buffer{}
+			cmd.Stderr = &errbuf
+			cmd.Stdout = &outbuf
+
+			It("should result in a JSON error message with the phase", func() {
+				cmd.Run()
+				Expect(errbuf.String()).Should(ContainSubstring(`"level":"error"`))
+				Expect(errbuf.String()).Should(ContainSubstring(`"phase":"start"`))
+				Expect(outbuf.String()).Should(BeEmpty())
 			})
 		})
 
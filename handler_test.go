@@ -1,24 +1,43 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
 	"github.com/iter8-tools/iter8ctl/utils"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/replay"
+	"github.com/iter8-tools/iter8-kfserving-handler/server"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/oteltest"
+	"go.opentelemetry.io/otel/trace"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
 )
 
+var recordCassettes = flag.Bool("record", false, "record cassettes of Kubernetes API interactions in testdata/cassettes instead of replaying them")
+
 func getK8sClientWithTargetFromFile(filePath string) (client.Client, error) {
 	data, err := ioutil.ReadFile(utils.CompletePath("testdata", filePath))
 	if err != nil {
@@ -48,12 +67,27 @@ func (k *myk8s) GetClient() (client.Client, error) {
 var expectedVersionInfo = &etc3.VersionInfo{
 	Baseline: etc3.VersionDetail{
 		Name: "default",
-		Tags: &map[string]string{"revision": "my-model-predictor-default-wl2cv"},
+		Tags: &map[string]string{
+			"revision":         "my-model-predictor-default-wl2cv",
+			"namespace":        "default",
+			"inferenceService": "my-model",
+			"component":        "predictor",
+		},
 	},
 	Candidates: []etc3.VersionDetail{
 		{
 			Name: "canary",
-			Tags: &map[string]string{"revision": "my-model-predictor-default-zwjbq"},
+			Tags: &map[string]string{
+				"revision":         "my-model-predictor-default-zwjbq",
+				"namespace":        "default",
+				"inferenceService": "my-model",
+				"component":        "predictor",
+				"framework":        "tensorflow",
+				"runtimeVersion":   "1.14.0",
+				"storageUri":       "gs://kfserving-samples/models/tensorflow/flowers-2",
+				"cpuRequest":       "1",
+				"memoryRequest":    "2Gi",
+			},
 			WeightObjRef: &v1.ObjectReference{
 				Kind:       "InferenceService",
 				Namespace:  "default",
@@ -105,6 +139,68 @@ func TestMain(t *testing.T) {
 	assert.Equal(t, expectedVersionInfo, exp.Spec.VersionInfo)
 }
 
+func TestMainStartResumes(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	k8s = &myk8s{c}
+	os.Args = []string{"./handler", "start"}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	main()
+	isvc := &unstructured.Unstructured{}
+	isvc.SetAPIVersion("serving.kubeflow.org/v1beta1")
+	isvc.SetKind("InferenceService")
+	c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "my-model"}, isvc)
+	isvcVersion := isvc.GetResourceVersion()
+	// a rerun of start skips the completed steps
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "my-model"}, isvc)
+	assert.Equal(t, isvcVersion, isvc.GetResourceVersion())
+	c.Get(context.Background(), client.ObjectKeyFromObject(exp), exp)
+	assert.Equal(t, `["InitializeTrafficSplit","SetVersionInfoInExperiment"]`, exp.GetAnnotations()[experiment.ProgressAnnotation])
+	assert.Equal(t, expectedVersionInfo, exp.Spec.VersionInfo)
+}
+
+func TestMainStartLocked(t *testing.T) {
+	initTestOS()
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	for _, name := range []string{"myexp", "otherexp"} {
+		exp := etc3.NewExperiment(name, "default").
+			WithTarget("default/my-model").
+			WithStrategy(etc3.StrategyTypeCanary).
+			Build()
+		err = c.Create(context.Background(), exp)
+		if err != nil {
+			t.Fatal("Cannot populate fake cluster with experiment", err)
+		}
+	}
+	k8s = &myk8s{c}
+	os.Args = []string{"./handler", "start"}
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	main()
+	// the target is claimed by myexp
+	os.Setenv("EXPERIMENT_NAME", "otherexp")
+	assert.PanicsWithValue(t, "Exiting with error code 1", func() { main() })
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+}
+
 func TestMainNoArgs(t *testing.T) {
 	initTestOS()
 	k8s = &myk8s{fake.NewClientBuilder().Build()}
@@ -126,8 +222,41 @@ func TestMainCannotGetExperiment(t *testing.T) {
 	assert.Panics(t, func() { main() })
 }
 
+func TestMainNoCandidate(t *testing.T) {
+	initTestOS()
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	k8s = &myk8s{c}
+	os.Args = []string{"./handler", "start"}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	os.Setenv("CANDIDATE_WAIT_SECONDS", "0")
+	assert.PanicsWithValue(t, "Exiting with error code 1", func() { main() })
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	os.Unsetenv("CANDIDATE_WAIT_SECONDS")
+	c.Get(context.Background(), client.ObjectKeyFromObject(exp), exp)
+	assert.Nil(t, exp.Spec.VersionInfo)
+	// the failed start releases the target
+	isvc := &unstructured.Unstructured{}
+	isvc.SetAPIVersion("serving.kubeflow.org/v1beta1")
+	isvc.SetKind("InferenceService")
+	c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "my-model"}, isvc)
+	assert.NotContains(t, isvc.GetAnnotations(), "kfserving.iter8.tools/lock")
+}
+
 func TestMainSingleVersionFinish(t *testing.T) {
-	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
 	if err != nil {
 		t.Fatal("Cannot get k8s client with target from file")
 	}
@@ -140,10 +269,53 @@ func TestMainSingleVersionFinish(t *testing.T) {
 		t.Fatal("Cannot populate fake cluster with experiment", err)
 	}
 	k8s = &myk8s{c}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	os.Args = []string{"./handler", "start"}
+	main()
 	os.Args = []string{"./handler", "finish"}
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	c.Get(context.Background(), client.ObjectKeyFromObject(exp), exp)
+	assert.Equal(t, &etc3.VersionInfo{
+		Baseline: etc3.VersionDetail{
+			Name: "default",
+			Tags: &map[string]string{
+				"revision":         "my-model-predictor-default-wl2cv",
+				"namespace":        "default",
+				"inferenceService": "my-model",
+				"component":        "predictor",
+				"framework":        "tensorflow",
+				"runtimeVersion":   "1.14.0",
+				"storageUri":       "gs://kfserving-samples/models/tensorflow/flowers",
+				"cpuRequest":       "1",
+				"memoryRequest":    "2Gi",
+			},
+		},
+	}, exp.Spec.VersionInfo)
+	assert.Equal(t, "my-model-predictor-default-wl2cv", exp.GetAnnotations()["kfserving.iter8.tools/assessed-revision"])
+}
+
+func TestMainSingleVersionStartWithCanary(t *testing.T) {
+	initTestOS()
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypePerformance).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	k8s = &myk8s{c}
+	os.Args = []string{"./handler", "start"}
 	os.Setenv("EXPERIMENT_NAME", "myexp")
 	os.Setenv("EXPERIMENT_NAMESPACE", "default")
-	assert.PanicsWithValue(t, "Normal exit", func() { main() })
+	assert.PanicsWithValue(t, "Exiting with error code 1", func() { main() })
 	os.Unsetenv("EXPERIMENT_NAME")
 	os.Unsetenv("EXPERIMENT_NAMESPACE")
 }
@@ -169,3 +341,486 @@ func TestMainFinishError(t *testing.T) {
 	os.Unsetenv("EXPERIMENT_NAME")
 	os.Unsetenv("EXPERIMENT_NAMESPACE")
 }
+
+func TestMainFinishBaselineRestoresSnapshot(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	isvc := &unstructured.Unstructured{}
+	isvc.SetAPIVersion("serving.kubeflow.org/v1beta1")
+	isvc.SetKind("InferenceService")
+	isvc.SetNamespace("default")
+	isvc.SetName("my-model")
+	err = c.Patch(context.Background(), isvc, client.RawPatch(types.MergePatchType,
+		[]byte(`{"spec":{"predictor":{"canaryTrafficPercent":null}}}`)))
+	if err != nil {
+		t.Fatal("Cannot remove canaryTrafficPercent from target", err)
+	}
+	k8s = &myk8s{c}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	os.Args = []string{"./handler", "start"}
+	main()
+	c.Get(context.Background(), client.ObjectKeyFromObject(isvc), isvc)
+	i, b, _ := unstructured.NestedInt64(isvc.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(1), i)
+	// the baseline wins
+	err = c.Patch(context.Background(), exp, client.RawPatch(types.MergePatchType,
+		[]byte(`{"status":{"recommendedBaseline":"default"}}`)))
+	if err != nil {
+		t.Fatal("Cannot set recommended baseline", err)
+	}
+	os.Args = []string{"./handler", "finish"}
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	c.Get(context.Background(), client.ObjectKeyFromObject(isvc), isvc)
+	_, b, _ = unstructured.NestedInt64(isvc.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.False(t, b)
+}
+
+func TestMainLogsJSON(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	rb := "default"
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	exp.Status.RecommendedBaseline = &rb
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	buf := &bytes.Buffer{}
+	stderr = buf
+	os.Setenv("LOG_FORMAT", "json")
+	os.Unsetenv("LOG_LEVEL")
+	configureLogging()
+	defer func() {
+		stderr = os.Stderr
+		os.Unsetenv("LOG_FORMAT")
+		configureLogging()
+	}()
+
+	k8s = &myk8s{c}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	os.Args = []string{"./handler", "finish"}
+	// the experiment has no traffic state snapshot; so, finish logs a warning
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+
+	scanner := bufio.NewScanner(buf)
+	assert.True(t, scanner.Scan())
+	entry := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+	assert.Equal(t, "warning", entry["level"])
+	assert.Equal(t, "finish", entry["phase"])
+	assert.Equal(t, "myexp", entry["experiment"])
+	assert.Equal(t, "default", entry["namespace"])
+	assert.Equal(t, "default/my-model", entry["target"])
+}
+
+func TestServeStart(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	srv := newServer(c)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/start", "application/json",
+		bytes.NewBufferString(`{"name": "myexp", "namespace": "default"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	srv.Wait()
+	c.Get(context.Background(), client.ObjectKeyFromObject(exp), exp)
+	assert.Equal(t, expectedVersionInfo, exp.Spec.VersionInfo)
+	resp, err = http.Get(ts.URL + "/status?namespace=default&name=myexp&phase=start")
+	assert.NoError(t, err)
+	status := server.Status{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.Equal(t, server.StateSucceeded, status.State)
+
+	// the error which failed a phase is reported
+	resp, err = http.Post(ts.URL+"/start", "application/json",
+		bytes.NewBufferString(`{"name": "otherexp", "namespace": "default"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	srv.Wait()
+	resp, err = http.Get(ts.URL + "/status?namespace=default&name=otherexp&phase=start")
+	assert.NoError(t, err)
+	status = server.Status{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.Equal(t, server.StateFailed, status.State)
+	assert.NotEmpty(t, status.Error)
+}
+
+func TestMainFlushesMetrics(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	var path string
+	// stub Pushgateway
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	textfile := filepath.Join(dir, "handler.prom")
+
+	k8s = &myk8s{c}
+	os.Args = []string{"./handler", "start"}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	os.Setenv("PUSHGATEWAY_URL", gateway.URL)
+	os.Setenv("METRICS_TEXTFILE", textfile)
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	os.Unsetenv("PUSHGATEWAY_URL")
+	os.Unsetenv("METRICS_TEXTFILE")
+	assert.Equal(t, "/metrics/job/iter8-kfserving-handler/instance/start", path)
+	data, err := ioutil.ReadFile(textfile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `iter8_kfserving_handler_operations_total{experiment="myexp",experiment_namespace="default",operation="set_canary_traffic_percent",outcome="success",phase="start",target_kind="InferenceService"} 1`)
+	assert.Contains(t, string(data), `iter8_kfserving_handler_operations_total{experiment="myexp",experiment_namespace="default",operation="set_version_info",outcome="success",phase="start",target_kind="InferenceService"} 1`)
+}
+
+func TestGetMaxConcurrentReconciles(t *testing.T) {
+	assert.Equal(t, 4, getMaxConcurrentReconciles())
+	defer os.Unsetenv("MAX_CONCURRENT_RECONCILES")
+	os.Setenv("MAX_CONCURRENT_RECONCILES", "10")
+	assert.Equal(t, 10, getMaxConcurrentReconciles())
+	for _, val := range []string{"0", "-1", "many"} {
+		os.Setenv("MAX_CONCURRENT_RECONCILES", val)
+		assert.Equal(t, 4, getMaxConcurrentReconciles(), val)
+	}
+}
+
+func TestTargetKind(t *testing.T) {
+	for ref, kind := range map[string]string{
+		"default/my-model":                        "InferenceService",
+		"isvc/default/my-model":                   "InferenceService",
+		"rollouts.argoproj.io/default/my-rollout": "Rollout",
+		"Rollout/default/my-rollout":              "Rollout",
+		"ro/default/my-rollout":                   "Rollout",
+		"TrainedModel/default/my-model":           "TrainedModel",
+		"tm/default/my-model":                     "TrainedModel",
+		"httproutes/default/my-route":             "HTTPRoute",
+	} {
+		assert.Equal(t, kind, targetKind(ref), ref)
+	}
+}
+
+func TestConfigureBaseNoWait(t *testing.T) {
+	b := target.BaseBuilder(nil, "InferenceService", "inference service")
+	configureBase(&b, "start", context.Background(), nil, true)
+	assert.Equal(t, uint(0), b.CandidateRetries)
+	assert.Equal(t, uint(0), b.VerifyRetries)
+	// waits set by environment variables are kept
+	os.Setenv("CANDIDATE_WAIT_SECONDS", "30")
+	defer os.Unsetenv("CANDIDATE_WAIT_SECONDS")
+	b = target.BaseBuilder(nil, "InferenceService", "inference service")
+	configureBase(&b, "start", context.Background(), nil, true)
+	assert.Equal(t, uint(3), b.CandidateRetries)
+	assert.Equal(t, uint(0), b.VerifyRetries)
+}
+
+func TestMainTracesFromExperimentAnnotation(t *testing.T) {
+	sr := new(oteltest.StandardSpanRecorder)
+	otel.SetTracerProvider(oteltest.NewTracerProvider(oteltest.WithSpanRecorder(sr)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	exp.SetAnnotations(map[string]string{
+		"iter8.tools/traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	})
+	err = c.Create(context.Background(), exp)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	k8s = &myk8s{c}
+	os.Args = []string{"./handler", "start"}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+
+	names := map[string]bool{}
+	for _, span := range sr.Completed() {
+		names[span.Name()] = true
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID.String())
+	}
+	for _, name := range []string{"handler.start", "experiment.GetExperiment", "v1beta1.Fetch", "v1beta1.SetCanaryTrafficPercent", "v1beta1.EnsureReadiness", "v1beta1.SetVersionInfoInExperiment", "k8s.Get", "k8s.Patch"} {
+		assert.True(t, names[name], "missing span "+name)
+	}
+}
+
+func TestMainStartCassette(t *testing.T) {
+	path := utils.CompletePath("testdata/cassettes", "start-canary.json")
+	var replayer *replay.Replayer
+	if *recordCassettes {
+		c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+		if err != nil {
+			t.Fatal("Cannot get k8s client with target from file")
+		}
+		exp := etc3.NewExperiment("myexp", "default").
+			WithTarget("default/my-model").
+			WithStrategy(etc3.StrategyTypeCanary).
+			Build()
+		err = c.Create(context.Background(), exp)
+		if err != nil {
+			t.Fatal("Cannot populate fake cluster with experiment", err)
+		}
+		k8s = &myk8s{c}
+		os.Setenv("RECORD_CASSETTE", path)
+		defer os.Unsetenv("RECORD_CASSETTE")
+	} else {
+		cassette, err := replay.LoadCassette(path)
+		if err != nil {
+			t.Fatal("Cannot load cassette", err)
+		}
+		scheme := runtime.NewScheme()
+		etc3.AddToScheme(scheme)
+		replayer = replay.ReplayerBuilder(cassette, scheme)
+		k8s = &myk8s{replayer}
+	}
+	os.Args = []string{"./handler", "start"}
+	os.Setenv("EXPERIMENT_NAME", "myexp")
+	os.Setenv("EXPERIMENT_NAMESPACE", "default")
+	main()
+	os.Unsetenv("EXPERIMENT_NAME")
+	os.Unsetenv("EXPERIMENT_NAMESPACE")
+	if replayer != nil {
+		// the start command makes exactly the recorded requests
+		assert.NoError(t, replayer.Done())
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata/golden instead of comparing with them")
+
+// golden is the outcome of a handler phase which is compared with golden files.
+type golden struct {
+	// Error is the error which failed the phase, if any.
+	Error string `json:"error,omitempty"`
+	// VersionInfo is the versionInfo of the experiment after the phase.
+	VersionInfo *etc3.VersionInfo `json:"versionInfo"`
+	// Writes are the requests of the phase which changed the cluster, without their responses.
+	Writes []replay.Interaction `json:"writes"`
+}
+
+// checkGolden compares the given value, marshaled as JSON, with the golden file of the given name; if -update is set, the golden file is updated instead.
+func checkGolden(t *testing.T, name string, value interface{}) {
+	path := utils.CompletePath("testdata/golden", name+".json")
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		t.Fatal("Cannot marshal golden value", err)
+	}
+	data = append(data, '\n')
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal("Cannot create golden directory", err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal("Cannot update golden file", err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Cannot read golden file; run tests with -update to create it", err)
+	}
+	assert.Equal(t, string(expected), string(data), "golden file "+name+" differs; run tests with -update to update it")
+}
+
+// runGolden runs the given phase of the handler for an experiment with the given strategy, whose target is the InferenceService in the given fixture, and returns its outcome.
+// The finish phase is run after the start phase and the recommendation of a new baseline.
+func runGolden(t *testing.T, fixture string, strategy etc3.StrategyType, phase string) *golden {
+	c, err := getK8sClientWithTargetFromFile(fixture)
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(strategy).
+		Build()
+	if err = c.Create(context.Background(), exp); err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	getExperiment := getExperimentByName("default", "myexp")
+	if phase == "finish" {
+		run("start", c, getExperiment, false)
+		rb := "canary"
+		if strategy == etc3.StrategyTypePerformance {
+			rb = "default"
+		}
+		err = c.Patch(context.Background(), exp, client.RawPatch(types.MergePatchType,
+			[]byte(`{"status":{"recommendedBaseline":"`+rb+`"}}`)))
+		if err != nil {
+			t.Fatal("Cannot recommend baseline", err)
+		}
+	}
+	rc := replay.RecorderBuilder(c)
+	g := &golden{Writes: []replay.Interaction{}}
+	if _, err := run(phase, rc, getExperiment, false); err != nil {
+		g.Error = err.Error()
+	}
+	for _, i := range rc.Cassette().Interactions {
+		if i.Verb != "get" && i.Verb != "list" {
+			i.Response = nil
+			g.Writes = append(g.Writes, i)
+		}
+	}
+	c.Get(context.Background(), client.ObjectKeyFromObject(exp), exp)
+	g.VersionInfo = exp.Spec.VersionInfo
+	return g
+}
+
+func TestGolden(t *testing.T) {
+	// do not wait for candidates or verify cutovers
+	os.Setenv("CANDIDATE_WAIT_SECONDS", "0")
+	os.Setenv("VERIFICATION_WINDOW_SECONDS", "0")
+	defer os.Unsetenv("CANDIDATE_WAIT_SECONDS")
+	defer os.Unsetenv("VERIFICATION_WINDOW_SECONDS")
+	for _, fixture := range []string{"canaryv1beta1", "nocandidatev1beta1", "transformerv1beta1"} {
+		for _, strategy := range []etc3.StrategyType{etc3.StrategyTypeCanary, etc3.StrategyTypeBlueGreen, etc3.StrategyTypePerformance} {
+			for _, phase := range []string{"start", "finish"} {
+				name := fixture + "-" + strings.ToLower(string(strategy)) + "-" + phase
+				t.Run(name, func(t *testing.T) {
+					checkGolden(t, name, runGolden(t, fixture+".json", strategy, phase))
+				})
+			}
+		}
+	}
+}
+
+// simulateMain runs the simulate command with the given flags, which prints to out.
+func simulateMain(t *testing.T, out *bytes.Buffer, args ...string) {
+	stdout = out
+	t.Cleanup(func() { stdout = os.Stdout })
+	os.Args = append([]string{"./handler", "simulate"}, args...)
+	main()
+}
+
+// simulatedObjects returns the experiment and InferenceService printed by the simulate command.
+func simulatedObjects(t *testing.T, out string) (*etc3.Experiment, *unstructured.Unstructured) {
+	docs := strings.Split(out, "\n---\n")
+	assert.Len(t, docs, 2)
+	exp := &etc3.Experiment{}
+	if err := yaml.Unmarshal([]byte(docs[0]), exp); err != nil {
+		t.Fatal("Cannot unmarshal experiment", err)
+	}
+	isvc := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	if err := yaml.Unmarshal([]byte(docs[1]), &isvc.Object); err != nil {
+		t.Fatal("Cannot unmarshal target", err)
+	}
+	return exp, isvc
+}
+
+func TestSimulateStart(t *testing.T) {
+	initTestOS()
+	out := &bytes.Buffer{}
+	simulateMain(t, out, "--experiment", utils.CompletePath("testdata", "experiment2.yaml"),
+		"--target", utils.CompletePath("testdata", "sklearn-iris.yaml"), "--phase", "start")
+	assert.Contains(t, out.String(), "# Experiment kfserving-test/sklearn-iris-experiment-1\n# changes (-before +after):\n")
+	assert.Contains(t, out.String(), "# InferenceService kfserving-test/sklearn-iris\n# changes (-before +after):\n")
+	exp, isvc := simulatedObjects(t, out.String())
+	assert.Equal(t, "sklearn-iris-predictor-default-4x9zm", (*exp.Spec.VersionInfo.Baseline.Tags)["revision"])
+	assert.Contains(t, isvc.GetAnnotations()["kfserving.iter8.tools/lock"], `"name":"sklearn-iris-experiment-1"`)
+}
+
+func TestSimulateFinish(t *testing.T) {
+	initTestOS()
+	out := &bytes.Buffer{}
+	simulateMain(t, out, "--experiment", utils.CompletePath("testdata", "experiment2.yaml"),
+		"--target", utils.CompletePath("testdata", "sklearn-iris.yaml"), "--phase", "finish")
+	_, isvc := simulatedObjects(t, out.String())
+	// the canary wins
+	// numbers are unmarshalled from YAML as floats
+	percent, _, _ := unstructured.NestedFieldNoCopy(isvc.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.Equal(t, float64(100), percent)
+	ready, _, _ := unstructured.NestedSlice(isvc.Object, "status", "conditions")
+	assert.Contains(t, ready, map[string]interface{}{"type": "Ready", "status": "True"})
+}
+
+func TestSimulateTargetWithoutStatus(t *testing.T) {
+	initTestOS()
+	data, err := ioutil.ReadFile(utils.CompletePath("testdata", "sklearn-iris.yaml"))
+	if err != nil {
+		t.Fatal("Cannot read target", err)
+	}
+	target := filepath.Join(t.TempDir(), "isvc.yaml")
+	spec := strings.Split(string(data), "status:")[0]
+	if err := ioutil.WriteFile(target, []byte(spec), 0644); err != nil {
+		t.Fatal("Cannot write target", err)
+	}
+	out := &bytes.Buffer{}
+	// the target has a single revision; so, there is no candidate
+	assert.PanicsWithValue(t, "Exiting with error code 1", func() {
+		simulateMain(t, out, "--experiment", utils.CompletePath("testdata", "experiment2.yaml"), "--target", target)
+	})
+	_, isvc := simulatedObjects(t, out.String())
+	rev, _, _ := unstructured.NestedString(isvc.Object, "status", "components", "predictor", "latestRolledoutRevision")
+	assert.Equal(t, "sklearn-iris-predictor-default-00001", rev)
+}
+
+func TestSimulateInvalidFlags(t *testing.T) {
+	initTestOS()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	for _, args := range [][]string{
+		{"--target", "isvc.yaml"},
+		{"--experiment", "exp.yaml", "--target", "isvc.yaml", "--phase", "rollback"},
+		{"--unknown"},
+		{"--experiment", "missing.yaml", "--target", "missing.yaml"},
+	} {
+		assert.PanicsWithValue(t, "Exiting with error code 1", func() { simulateMain(t, &bytes.Buffer{}, args...) }, args)
+	}
+}
@@ -0,0 +1,529 @@
+// Package httproute provides types and methods for experiments on Kubernetes Gateway API HTTPRoutes, which split traffic between the backends of their rules.
+//
+// The target of an experiment is an HTTPRoute, referred to as httproutes/<namespace>/<name>, and the experiment annotation kfserving.iter8.tools/rule names the rule of the HTTPRoute whose backends are the versions. The first backendRef of the rule is the baseline, and each of the other backendRefs is a candidate, in order.
+//
+// The target splits traffic by setting the weights of the backendRefs of the rule. After each change, the HTTPRoute needs to be accepted by each of its parents, with its references resolved.
+package httproute
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/tracing"
+)
+
+// Kind is the kind of Gateway API HTTPRoutes, which are referred to as httproutes/<namespace>/<name>.
+var Kind = &target.ObjectKind{
+	GVK: schema.GroupVersionKind{
+		Group:   "gateway.networking.k8s.io",
+		Version: "v1",
+		Kind:    "HTTPRoute",
+	},
+	Resource: "httproutes",
+}
+
+// Snapshot records the weights of the backendRefs of the rule before an experiment changes them.
+type Snapshot struct {
+	// Weights are the weights of the baseline and candidate backendRefs, each of which is nil if the backendRef had no weight.
+	Weights []*int64 `json:"weights"`
+}
+
+// Target is an enhancement of Gateway API HTTPRoute, which splits traffic between the baseline and candidate backends of a rule.
+type Target struct {
+	target.Base
+	route *unstructured.Unstructured
+}
+
+// TargetBuilder returns an initial HTTPRoute target struct pointer.
+func TargetBuilder() *Target {
+	t := &Target{}
+	t.Base = target.BaseBuilder(t, "httproute", "http route")
+	return t
+}
+
+// Fetch fetches the HTTPRoute object from the Kubernetes cluster and populates the target struct with it.
+// HTTPRoute may be unavailable at the start of this call. So, Fetch periodically attempts to fetch the HTTPRoute object for 180 sec.
+// If it does not succeed in 180 secs, the method returns after setting an error.
+func (t *Target) Fetch(targetRef string) target.Target {
+	if route := t.FetchObject(Kind, targetRef); route != nil {
+		t.route = route
+	}
+	return t
+}
+
+// getRule is a helper function that returns the index of the rule of the HTTPRoute named by the experiment, along with the backendRefs of this rule.
+func getRule(t *Target) (int, []interface{}, error) {
+	name, ok := t.Exp.GetAnnotations()[experiment.RuleAnnotation]
+	if !ok || name == "" {
+		return 0, nil, errors.New("experiment on HTTPRoute needs annotation " + experiment.RuleAnnotation)
+	}
+	rules, _, err := unstructured.NestedSlice(t.route.Object, "spec", "rules")
+	if err != nil {
+		return 0, nil, errors.New("invalid rules in HTTPRoute " + t.route.GetName() + "; " + err.Error())
+	}
+	for i, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok || rule["name"] != name {
+			continue
+		}
+		backendRefs, _, err := unstructured.NestedSlice(rule, "backendRefs")
+		if err != nil || len(backendRefs) == 0 {
+			return 0, nil, errors.New("rule " + name + " of HTTPRoute " + t.route.GetName() + " needs a backendRef for the baseline")
+		}
+		return i, backendRefs, nil
+	}
+	return 0, nil, errors.New("HTTPRoute " + t.route.GetName() + " has no rule named " + name)
+}
+
+// getWeights is a helper function that returns the weights of the backendRefs of the rule, each of which is nil if the backendRef has no weight.
+func getWeights(t *Target) ([]*int64, error) {
+	_, backendRefs, err := getRule(t)
+	if err != nil {
+		return nil, err
+	}
+	weights := []*int64{}
+	for _, b := range backendRefs {
+		backendRef, _ := b.(map[string]interface{})
+		w, found, err := unstructured.NestedInt64(backendRef, "weight")
+		if err != nil {
+			return nil, errors.New("invalid weight in HTTPRoute " + t.route.GetName() + "; " + err.Error())
+		}
+		if !found {
+			weights = append(weights, nil)
+			continue
+		}
+		weights = append(weights, &w)
+	}
+	return weights, nil
+}
+
+// setWeights is a helper function that sets the given weights of the backendRefs of the rule.
+func setWeights(t *Target, weights []*int64) error {
+	index, _, err := getRule(t)
+	if err != nil {
+		return err
+	}
+	payloadBytes, err := target.WeightsPatch(t.route.Object, []string{"spec", "rules"}, index, "backendRefs", weights)
+	if err != nil || payloadBytes == nil {
+		return err
+	}
+	return t.Patch(t.route, client.RawPatch(types.JSONPatchType, payloadBytes))
+}
+
+// isAccepted is a helper function that checks if the HTTPRoute is accepted by each of its parents, with its references resolved.
+// Conditions which were observed for an earlier generation of the HTTPRoute are stale, and do not count.
+func isAccepted(route *unstructured.Unstructured) bool {
+	parents, _, err := unstructured.NestedSlice(route.Object, "status", "parents")
+	if err != nil || len(parents) == 0 {
+		return false
+	}
+	for _, p := range parents {
+		parent, _ := p.(map[string]interface{})
+		conditions, _, _ := unstructured.NestedSlice(parent, "conditions")
+		for _, ctype := range []string{"Accepted", "ResolvedRefs"} {
+			if !hasCondition(route, conditions, ctype) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasCondition is a helper function that checks if the given conditions of a parent of the HTTPRoute include a condition of the given type, which has "Status" true for the current generation of the HTTPRoute.
+func hasCondition(route *unstructured.Unstructured, conditions []interface{}, ctype string) bool {
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		if condition["type"] != ctype {
+			continue
+		}
+		if observed, found, _ := unstructured.NestedInt64(condition, "observedGeneration"); found && observed < route.GetGeneration() {
+			return false
+		}
+		return condition["status"] == "True"
+	}
+	return false
+}
+
+// isServing is a helper function for fetching the HTTPRoute and checking if it is accepted.
+func isServing(t *Target) bool {
+	t.Fetch(t.Exp.GetTargetRef())
+	return t.Err == nil && isAccepted(t.route)
+}
+
+// ensureReadiness ensures that the HTTPRoute is accepted by each of its parents, with its references resolved.
+// It periodically fetches the HTTPRoute and checks its conditions.
+// Returns true if readiness is reached in 180 sec and false otherwise.
+func ensureReadiness(t *Target) (ready bool) {
+	defer t.StartSpan("EnsureReadiness")()
+	defer func(start time.Time) {
+		t.Observe("ensure_readiness", start, ready)
+	}(time.Now())
+	return t.Poll(t.Retries, func() bool { return isServing(t) })
+}
+
+// hasWeights is a helper function for fetching the HTTPRoute, and checking if it is accepted and its rule has the given weights.
+func hasWeights(t *Target, weights []*int64) bool {
+	if !isServing(t) {
+		return false
+	}
+	current, err := getWeights(t)
+	return err == nil && reflect.DeepEqual(current, weights)
+}
+
+// SetWeights sets the given weights of the baseline and candidate backendRefs of the rule.
+// After this step, the handler waits for (<=) 180 sec to ensure the HTTPRoute is accepted.
+// If any of the above steps fail, the method returns after setting an error.
+func (t *Target) SetWeights(weights []*int64) target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("SetWeights")()
+	defer func(start time.Time) {
+		t.Observe("set_candidate_weight", start, t.Err == nil)
+	}(time.Now())
+	if t.route == nil {
+		t.Err = errors.New("unable to set traffic split; uninitialized http route object")
+		return t
+	}
+	if t.Err = setWeights(t, weights); t.Err != nil {
+		return t
+	}
+	if !ensureReadiness(t) && t.Err == nil {
+		t.Err = errors.New("post-patch: unable to ensure readiness of http route even after 180 seconds")
+	}
+	return t
+}
+
+// candidateWeights is a helper function that returns the weights of the given number of backendRefs, which send the given percentage of traffic to each candidate, and the rest to the baseline.
+func candidateWeights(n int, p int64) []*int64 {
+	b := 100 - int64(n-1)*p
+	weights := []*int64{&b}
+	for j := 1; j < n; j++ {
+		weights = append(weights, &p)
+	}
+	return weights
+}
+
+// winnerWeights is a helper function that returns the weights of the given number of backendRefs, which send all traffic to the backendRef with the given index.
+func winnerWeights(n int, winner int) []*int64 {
+	none, all := int64(0), int64(100)
+	weights := []*int64{}
+	for j := 0; j < n; j++ {
+		if j == winner {
+			weights = append(weights, &all)
+			continue
+		}
+		weights = append(weights, &none)
+	}
+	return weights
+}
+
+// InitializeTrafficSplit initializes traffic split for the target.
+// Each candidate receives 1% of the traffic, or 0% in BlueGreen experiments.
+// Single-version experiments leave the HTTPRoute untouched.
+func (t *Target) InitializeTrafficSplit() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("InitializeTrafficSplit")()
+	if t.Exp != nil && t.Exp.IsSingleVersion() {
+		return t
+	}
+	if t.route == nil {
+		t.Err = errors.New("unable to set traffic split; uninitialized http route object")
+		return t
+	}
+	_, backendRefs, err := getRule(t)
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	p := int64(1)
+	if t.Exp != nil && t.Exp.IsBlueGreen() {
+		p = 0
+	}
+	weights := candidateWeights(len(backendRefs), p)
+	if t.Resume("InitializeTrafficSplit", func() bool { return hasWeights(t, weights) }) {
+		return t
+	}
+	defer t.Complete("InitializeTrafficSplit")
+	return t.SetWeights(weights)
+}
+
+// EnsureCandidate ensures that the rule of the HTTPRoute has a backendRef for a candidate, after the backendRef of the baseline.
+// The candidate may not have been added at the start of this call. So, EnsureCandidate periodically fetches the HTTPRoute until the candidate wait (180 sec by default) elapses.
+// If the candidate does not appear within this duration, the method returns after setting an error; this error is a *target.NoCandidateError if the rule has a single backendRef.
+func (t *Target) EnsureCandidate() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("EnsureCandidate")()
+	if t.Exp == nil {
+		t.Err = errors.New("method EnsureCandidate called on a target with nil experiment")
+		return t
+	}
+	if t.route == nil {
+		t.Err = errors.New("unable to find candidate; uninitialized http route object")
+		return t
+	}
+	// Fetch retries on its own; so, each check gets the HTTPRoute in a single attempt
+	var backendRefs []interface{}
+	var err error
+	if t.Poll(t.CandidateRetries, func() bool {
+		var route *unstructured.Unstructured
+		if route, err = t.Refetch(t.route); err != nil {
+			err = errors.New("unable to fetch target; " + err.Error())
+			return false
+		}
+		t.route = route
+		_, backendRefs, err = getRule(t)
+		return err == nil && len(backendRefs) > 1
+	}) || t.Err != nil {
+		return t
+	}
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	baseline, _ := backendRefs[0].(map[string]interface{})
+	t.Err = &target.NoCandidateError{Revision: fmt.Sprint(baseline["name"])}
+	return t
+}
+
+// candidateName is a helper function that returns the name of the version of the candidate with the given index.
+// The first candidate is named canary, and the others are numbered after it, such as canary-2.
+func candidateName(i int) string {
+	if i == 0 {
+		return "canary"
+	}
+	return fmt.Sprintf("canary-%d", i+1)
+}
+
+// versionTags is a helper function that returns the tags of the version served by the given backendRef of the HTTPRoute.
+// Tags which are absent from the backendRef are omitted.
+func versionTags(route *unstructured.Unstructured, backendRef map[string]interface{}) *map[string]string {
+	tags := map[string]string{
+		"httpRoute": route.GetName(),
+		"namespace": route.GetNamespace(),
+	}
+	for tag, field := range map[string]string{
+		"backend":   "name",
+		"namespace": "namespace",
+		"kind":      "kind",
+		"port":      "port",
+	} {
+		if val, ok := backendRef[field]; ok {
+			tags[tag] = fmt.Sprint(val)
+		}
+	}
+	return &tags
+}
+
+// weightObjRef is a helper function that returns the reference to the weight of the backendRef of the rule with the given index.
+func weightObjRef(t *Target, index int, backendRef int) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       Kind.GVK.Kind,
+		Namespace:  t.route.GetNamespace(),
+		Name:       t.route.GetName(),
+		APIVersion: t.route.GetAPIVersion(),
+		FieldPath:  fmt.Sprintf("/spec/rules/%d/backendRefs/%d/weight", index, backendRef),
+	}
+}
+
+// GetVersionInfo constructs the VersionInfo object based on the target and returns it.
+// The WeightObjRefs of the baseline and candidates refer to the weights of their backendRefs in the rule.
+func (t *Target) GetVersionInfo() (_ *etc3.VersionInfo, err error) {
+	_, span := tracing.Start(t.Ctx, "httproute.GetVersionInfo")
+	defer func() {
+		tracing.End(span, err)
+	}()
+	if t.route == nil {
+		return nil, errors.New("unable to get version info; uninitialized http route object")
+	}
+	index, backendRefs, err := getRule(t)
+	if err != nil {
+		return nil, err
+	}
+	baseline, _ := backendRefs[0].(map[string]interface{})
+	if t.Exp.IsSingleVersion() {
+		return &etc3.VersionInfo{
+			Baseline: etc3.VersionDetail{
+				Name: "default",
+				Tags: versionTags(t.route, baseline),
+			},
+		}, nil
+	}
+	if len(backendRefs) < 2 {
+		return nil, &target.NoCandidateError{Revision: fmt.Sprint(baseline["name"])}
+	}
+	vi := &etc3.VersionInfo{
+		Baseline: etc3.VersionDetail{
+			Name:         "default",
+			Tags:         versionTags(t.route, baseline),
+			WeightObjRef: weightObjRef(t, index, 0),
+		},
+	}
+	for j, b := range backendRefs[1:] {
+		backendRef, _ := b.(map[string]interface{})
+		vi.Candidates = append(vi.Candidates, etc3.VersionDetail{
+			Name:         candidateName(j),
+			Tags:         versionTags(t.route, backendRef),
+			WeightObjRef: weightObjRef(t, index, j+1),
+		})
+	}
+	return vi, nil
+}
+
+// SetVersionInfoInExperiment sets version info in the experiment associated with this target.
+func (t *Target) SetVersionInfoInExperiment() target.Target {
+	t.SetVersionInfo(t.GetVersionInfo)
+	return t
+}
+
+// winnerIndex is a helper function that returns the index of the backendRef of the given recommended baseline in the rule, among the given number of backendRefs.
+func winnerIndex(recommendedBaseline string, n int) (int, error) {
+	if recommendedBaseline == "default" {
+		return 0, nil
+	}
+	for j := 1; j < n; j++ {
+		if candidateName(j-1) == recommendedBaseline {
+			return j, nil
+		}
+	}
+	return 0, errors.New("recommended baseline " + recommendedBaseline + " is not a version of the target")
+}
+
+// recommendedWeights is a helper function that returns the weights of the backendRefs of the rule which send all traffic to the given recommended baseline.
+func recommendedWeights(t *Target, recommendedBaseline string) ([]*int64, error) {
+	_, backendRefs, err := getRule(t)
+	if err != nil {
+		return nil, err
+	}
+	winner, err := winnerIndex(recommendedBaseline, len(backendRefs))
+	if err != nil {
+		return nil, err
+	}
+	return winnerWeights(len(backendRefs), winner), nil
+}
+
+// SetNewBaseline sets a new baseline within the target.
+// A winning candidate receives all traffic; in BlueGreen experiments, the HTTPRoute is verified to stay accepted for the verification window after this cutover, and the cutover is reverted otherwise.
+// Otherwise, the weights of the backendRefs before the experiment are restored.
+func (t *Target) SetNewBaseline() target.Target {
+	t.SetBaseline(t.route, target.BaselineSteps{
+		IsSet: func(recommended string) bool {
+			if recommended == "default" {
+				return isRestored(t)
+			}
+			weights, err := recommendedWeights(t, recommended)
+			return err == nil && hasWeights(t, weights)
+		},
+		IsRestored: func() bool { return isRestored(t) },
+		Restore:    func() { t.RestoreTrafficState() },
+		Shift: func(recommended string) {
+			weights, err := recommendedWeights(t, recommended)
+			if err != nil {
+				t.Err = err
+				return
+			}
+			t.SetWeights(weights)
+		},
+		IsReady: func() bool { return isServing(t) },
+		Unready: "http route became un-ready after cutover",
+	})
+	return t
+}
+
+// snapshotWeights is a helper function that returns the weights recorded in the snapshot annotation of the experiment, or the weights which send all traffic to the baseline among the given number of backendRefs if the experiment has no snapshot.
+func snapshotWeights(t *Target, n int) ([]*int64, error) {
+	snapshot := Snapshot{}
+	found, err := t.GetSnapshot(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return winnerWeights(n, 0), nil
+	}
+	if len(snapshot.Weights) != n {
+		return nil, errors.New("traffic state snapshot needs the weights of " + fmt.Sprint(n) + " backendRefs")
+	}
+	return snapshot.Weights, nil
+}
+
+// isRestored is a helper function for fetching the target and checking if it is accepted with the weights recorded in the snapshot annotation of the experiment.
+func isRestored(t *Target) bool {
+	_, backendRefs, err := getRule(t)
+	if err != nil {
+		return false
+	}
+	weights, err := snapshotWeights(t, len(backendRefs))
+	return err == nil && hasWeights(t, weights)
+}
+
+// RecordAssessedVersion records the backend assessed in a single-version experiment as an annotation of the experiment.
+// The assessed backend is the baseline recorded in the versionInfo of the experiment during start.
+func (t *Target) RecordAssessedVersion() target.Target {
+	t.RecordAssessed("backend")
+	return t
+}
+
+// SnapshotTrafficState records the weights of the backendRefs of the rule in the snapshot annotation of the experiment.
+func (t *Target) SnapshotTrafficState() target.Target {
+	t.Snapshot(t.route, func() (interface{}, error) {
+		weights, err := getWeights(t)
+		return Snapshot{Weights: weights}, err
+	})
+	return t
+}
+
+// RestoreTrafficState restores the weights of the backendRefs recorded in the snapshot annotation of the experiment.
+// Weights which were absent when the snapshot was recorded are removed from the HTTPRoute.
+// Experiments without a snapshot are restored by sending all traffic to the baseline.
+// After this step, the handler waits for (<=) 180 sec to ensure the HTTPRoute is accepted.
+func (t *Target) RestoreTrafficState() target.Target {
+	t.Restore(t.route, func() {
+		if _, ok := t.Exp.GetAnnotations()[experiment.SnapshotAnnotation]; !ok {
+			t.LogEntry().Warn("traffic state snapshot not found in experiment; shifting all traffic to baseline")
+		}
+		_, backendRefs, err := getRule(t)
+		if err != nil {
+			t.Err = err
+			return
+		}
+		weights, err := snapshotWeights(t, len(backendRefs))
+		if err != nil {
+			t.Err = err
+			return
+		}
+		t.SetWeights(weights)
+	})
+	return t
+}
+
+// Claim claims the HTTPRoute for the experiment by recording the experiment in its lock annotation.
+// If the HTTPRoute is claimed by another experiment which still exists, the method returns after setting a *target.LockedError.
+func (t *Target) Claim() target.Target {
+	t.ClaimObject(t.route)
+	return t
+}
+
+// Release releases the claim of the experiment on the HTTPRoute by removing its lock annotation.
+// Locks held by other experiments are left unchanged.
+func (t *Target) Release() target.Target {
+	t.ReleaseObject(func() *unstructured.Unstructured {
+		t.Fetch(t.Exp.GetTargetRef())
+		return t.route
+	})
+	return t
+}
@@ -0,0 +1,209 @@
+package httproute
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/target/targettest"
+)
+
+// getTarget returns a resumable target which is fetched for an experiment with the given strategy and annotations, created in the given client.
+func getTarget(t *testing.T, c client.Client, strategy etc3.StrategyType, annotations map[string]string) *Target {
+	exp := targettest.NewExperiment(t, c, "httproutes/default/iris-route", strategy, annotations)
+	targ := TargetBuilder()
+	targ.SetResumable(true)
+	targettest.Fetch(t, targ, c, exp)
+	return targ
+}
+
+// ruled returns the annotations of an experiment on the iris rule.
+func ruled() map[string]string {
+	return map[string]string{experiment.RuleAnnotation: "iris"}
+}
+
+// getRoute returns the HTTPRoute in the given client.
+func getRoute(t *testing.T, c client.Client) *unstructured.Unstructured {
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(Kind.GVK)
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "iris-route"}, route); err != nil {
+		t.Fatal("Cannot get http route", err)
+	}
+	return route
+}
+
+// getBackendWeights returns the weights of the backendRefs of the iris rule of the HTTPRoute in the given client.
+func getBackendWeights(t *testing.T, c client.Client) []interface{} {
+	rules, _, _ := unstructured.NestedSlice(getRoute(t, c).Object, "spec", "rules")
+	backendRefs := rules[1].(map[string]interface{})["backendRefs"].([]interface{})
+	weights := []interface{}{}
+	for _, b := range backendRefs {
+		weights = append(weights, b.(map[string]interface{})["weight"])
+	}
+	return weights
+}
+
+// addBackend adds a backendRef for a candidate with the given name to the iris rule of the HTTPRoute in the given client.
+func addBackend(t *testing.T, c client.Client, name string) {
+	patch := `[{"op":"add","path":"/spec/rules/1/backendRefs/-","value":{"name":"` + name + `","port":80}}]`
+	assert.NoError(t, c.Patch(context.Background(), getRoute(t, c), client.RawPatch(types.JSONPatchType, []byte(patch))))
+}
+
+func TestStartAndFinish(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, ruled())
+	targ.Claim().EnsureCandidate().SnapshotTrafficState()
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(99), int64(1)}, getBackendWeights(t, c))
+	assert.Equal(t, `{"weights":[100,null]}`, targ.Exp.GetAnnotations()[experiment.SnapshotAnnotation])
+	assert.Contains(t, getRoute(t, c).GetAnnotations(), target.LockAnnotation)
+
+	exp := &etc3.Experiment{}
+	c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "myexp"}, exp)
+	vi := exp.Spec.VersionInfo
+	assert.Equal(t, map[string]string{
+		"httpRoute": "iris-route",
+		"backend":   "iris-v1",
+		"namespace": "default",
+		"port":      "80",
+	}, *vi.Baseline.Tags)
+	assert.Equal(t, "canary", vi.Candidates[0].Name)
+	assert.Equal(t, "iris-v2", (*vi.Candidates[0].Tags)["backend"])
+	assert.Equal(t, "/spec/rules/1/backendRefs/0/weight", vi.Baseline.WeightObjRef.FieldPath)
+	assert.Equal(t, "/spec/rules/1/backendRefs/1/weight", vi.Candidates[0].WeightObjRef.FieldPath)
+	assert.Equal(t, "gateway.networking.k8s.io/v1", vi.Candidates[0].WeightObjRef.APIVersion)
+
+	// the candidate wins
+	assert.NoError(t, c.Patch(context.Background(), exp, client.RawPatch(types.MergePatchType, []byte(`{"status":{"recommendedBaseline":"canary"}}`))))
+	next := TargetBuilder()
+	next.SetK8sClient(c).SetExperiment(experiment.Builder(exp)).Fetch(exp.Spec.Target)
+	next.SetNewBaseline().Release()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, []interface{}{int64(0), int64(100)}, getBackendWeights(t, c))
+	assert.NotContains(t, getRoute(t, c).GetAnnotations(), target.LockAnnotation)
+}
+
+func TestMultipleCandidates(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	addBackend(t, c, "iris-v3")
+	targ := getTarget(t, c, etc3.StrategyTypeABN, ruled())
+	targ.SnapshotTrafficState().InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(98), int64(1), int64(1)}, getBackendWeights(t, c))
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "canary-2", vi.Candidates[1].Name)
+	assert.Equal(t, "iris-v3", (*vi.Candidates[1].Tags)["backend"])
+	assert.Equal(t, "/spec/rules/1/backendRefs/2/weight", vi.Candidates[1].WeightObjRef.FieldPath)
+
+	recommended := "canary-2"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(0), int64(0), int64(100)}, getBackendWeights(t, c))
+
+	targ.Err = nil
+	recommended = "canary-3"
+	targ.SetNewBaseline()
+	assert.EqualError(t, targ.Err, "recommended baseline canary-3 is not a version of the target")
+}
+
+func TestFinishBaselineRestoresSnapshot(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	annotations := ruled()
+	annotations[experiment.SnapshotAnnotation] = `{"weights":[100,null]}`
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, annotations)
+	targ.SetWeights(candidateWeights(2, 40))
+	assert.Equal(t, []interface{}{int64(60), int64(40)}, getBackendWeights(t, c))
+	recommended := "default"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	// the candidate had no weight before the experiment
+	assert.Equal(t, []interface{}{int64(100), nil}, getBackendWeights(t, c))
+
+	// a rerun is skipped, since the weights are verified
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, `["SetNewBaseline"]`, targ.Exp.GetAnnotations()[experiment.ProgressAnnotation])
+}
+
+func TestEnsureCandidateErrors(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, map[string]string{})
+	targ.CandidateRetries = 0
+	targ.EnsureCandidate()
+	assert.EqualError(t, targ.Err, "experiment on HTTPRoute needs annotation "+experiment.RuleAnnotation)
+
+	// the rule has a single backendRef
+	targ.Err = nil
+	targ.Exp.SetAnnotations(map[string]string{experiment.RuleAnnotation: "healthz"})
+	targ.EnsureCandidate()
+	var nce *target.NoCandidateError
+	assert.True(t, errors.As(targ.Err, &nce))
+	assert.Equal(t, "iris-health", nce.Revision)
+
+	targ.Err = nil
+	targ.Exp.SetAnnotations(map[string]string{experiment.RuleAnnotation: "other"})
+	targ.EnsureCandidate()
+	assert.EqualError(t, targ.Err, "HTTPRoute iris-route has no rule named other")
+}
+
+func TestBlueGreenCutoverReverted(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	targ := getTarget(t, c, etc3.StrategyTypeBlueGreen, ruled())
+	targ.EnsureCandidate().SnapshotTrafficState().InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(100), int64(0)}, getBackendWeights(t, c))
+
+	// the references of the route become unresolved; so, neither the cutover nor its revert is ready
+	route := getRoute(t, c)
+	assert.NoError(t, c.Patch(context.Background(), route, client.RawPatch(types.JSONPatchType,
+		[]byte(`[{"op":"replace","path":"/status/parents/0/conditions/1/status","value":"False"}]`))))
+	targ.Retries = 0
+	recommended := "canary"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+	targ.SetNewBaseline()
+	assert.Error(t, targ.Err)
+	assert.Contains(t, targ.Err.Error(), "unable to revert cutover")
+	assert.Equal(t, []interface{}{int64(100), nil}, getBackendWeights(t, c))
+}
+
+func TestIsAccepted(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	route := getRoute(t, c)
+	assert.True(t, isAccepted(route))
+
+	// the conditions are stale
+	route.SetGeneration(3)
+	assert.False(t, isAccepted(route))
+
+	// the route has no parents
+	unstructured.RemoveNestedField(route.Object, "status")
+	assert.False(t, isAccepted(route))
+}
+
+func TestSingleVersion(t *testing.T) {
+	c := targettest.NewClient(t, "httproute.json")
+	targ := getTarget(t, c, etc3.StrategyTypePerformance, ruled())
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(100), nil}, getBackendWeights(t, c))
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Empty(t, vi.Candidates)
+
+	targ.Exp.Spec.VersionInfo = vi
+	targ.RecordAssessedVersion()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, "iris-v1", targ.Exp.GetAnnotations()[experiment.AssessedRevisionAnnotation])
+}
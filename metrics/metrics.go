@@ -0,0 +1,102 @@
+// Package metrics enables instrumentation of handler runs with Prometheus metrics.
+//
+// Handler runs are short-lived. So, metrics are recorded in a registry local to the run, and are either pushed to a Prometheus Pushgateway or written to a file in Prometheus textfile format when the run exits.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Job is the Pushgateway job under which handler metrics are pushed.
+const Job = "iter8-kfserving-handler"
+
+// labels of all handler metrics
+var labels = []string{"operation", "phase", "target_kind", "outcome", "experiment_namespace", "experiment"}
+
+// Recorder records metrics of a handler run.
+// Methods of Recorder may be called on a nil recorder, in which case they do nothing.
+type Recorder struct {
+	registry   *prometheus.Registry
+	operations *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+	phase      string
+	targetKind string
+	// namespace and name of the experiment of the run
+	namespace string
+	name      string
+}
+
+// NewRecorder returns a recorder for a handler run of the given phase (start or finish) and target kind.
+func NewRecorder(phase string, targetKind string) *Recorder {
+	r := &Recorder{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iter8_kfserving_handler_operations_total",
+			Help: "Number of handler operations.",
+		}, labels),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "iter8_kfserving_handler_operation_duration_seconds",
+			Help: "Duration of handler operations in seconds, including waits and retries.",
+			// readiness waits may last up to 180 sec
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, labels),
+		phase:      phase,
+		targetKind: targetKind,
+	}
+	r.registry.MustRegister(r.operations, r.durations)
+	return r
+}
+
+// SetExperiment sets the namespace and name of the experiment of the handler run, which label the recorded metrics.
+func (r *Recorder) SetExperiment(namespace string, name string) *Recorder {
+	if r == nil {
+		return nil
+	}
+	r.namespace = namespace
+	r.name = name
+	return r
+}
+
+// Observe records the outcome of an operation, and its duration since the given start time.
+func (r *Recorder) Observe(operation string, start time.Time, success bool) {
+	if r == nil {
+		return
+	}
+	outcome := "success"
+	if !success {
+		outcome = "failure"
+	}
+	l := prometheus.Labels{
+		"operation":            operation,
+		"phase":                r.phase,
+		"target_kind":          r.targetKind,
+		"outcome":              outcome,
+		"experiment_namespace": r.namespace,
+		"experiment":           r.name,
+	}
+	r.operations.With(l).Inc()
+	r.durations.With(l).Observe(time.Since(start).Seconds())
+}
+
+// Push pushes the recorded metrics to the Pushgateway at the given URL.
+// Metrics of each phase are pushed to their own group, so that a finish run does not replace the metrics pushed by a start run.
+// Groups are not keyed by experiment, since the Pushgateway keeps groups until they are deleted, and a group per experiment would outlive the experiment.
+func (r *Recorder) Push(url string) error {
+	if r == nil {
+		return nil
+	}
+	return push.New(url, Job).Gatherer(r.registry).
+		Grouping("instance", r.phase).
+		Push()
+}
+
+// WriteToTextfile writes the recorded metrics to the given file in Prometheus textfile format.
+func (r *Recorder) WriteToTextfile(filename string) error {
+	if r == nil {
+		return nil
+	}
+	return prometheus.WriteToTextfile(filename, r.registry)
+}
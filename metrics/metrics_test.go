@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.Observe("fetch", time.Now(), true)
+	assert.NoError(t, r.Push("http://localhost:9091"))
+	assert.NoError(t, r.WriteToTextfile("metrics.prom"))
+}
+
+func TestWriteToTextfile(t *testing.T) {
+	r := NewRecorder("start", "InferenceService").SetExperiment("default", "myexp")
+	r.Observe("fetch", time.Now(), true)
+	r.Observe("ensure_readiness", time.Now(), false)
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "handler.prom")
+	assert.NoError(t, r.WriteToTextfile(filename))
+	data, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `iter8_kfserving_handler_operations_total{experiment="myexp",experiment_namespace="default",operation="fetch",outcome="success",phase="start",target_kind="InferenceService"} 1`)
+	assert.Contains(t, string(data), `iter8_kfserving_handler_operations_total{experiment="myexp",experiment_namespace="default",operation="ensure_readiness",outcome="failure",phase="start",target_kind="InferenceService"} 1`)
+	assert.Contains(t, string(data), `iter8_kfserving_handler_operation_duration_seconds_count{experiment="myexp",experiment_namespace="default",operation="fetch",outcome="success",phase="start",target_kind="InferenceService"} 1`)
+}
+
+func TestPush(t *testing.T) {
+	var method, path string
+	var length int
+	// stub Pushgateway
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method = req.Method
+		path = req.URL.Path
+		body, _ := ioutil.ReadAll(req.Body)
+		length = len(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	r := NewRecorder("finish", "InferenceService").SetExperiment("default", "myexp")
+	r.Observe("set_canary_traffic_percent", time.Now(), true)
+	assert.NoError(t, r.Push(gateway.URL))
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, map[string]string{
+		"job":      Job,
+		"instance": "finish",
+	}, groupingKey(path))
+	assert.Less(t, 0, length)
+}
+
+func TestPushExperiments(t *testing.T) {
+	var mu sync.Mutex
+	groups := map[string]string{}
+	// stub Pushgateway, which replaces the metrics of a group on each push to it
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		groups[groupingKey(req.URL.Path)["instance"]] = string(body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	r1 := NewRecorder("start", "InferenceService").SetExperiment("default", "exp1")
+	r1.Observe("set_canary_traffic_percent", time.Now(), true)
+	r2 := NewRecorder("finish", "InferenceService").SetExperiment("default", "exp2")
+	r2.Observe("set_canary_traffic_percent", time.Now(), false)
+	assert.NoError(t, r1.Push(gateway.URL))
+	assert.NoError(t, r2.Push(gateway.URL))
+	// one group per phase, whose metrics are labeled with their experiment
+	assert.Len(t, groups, 2)
+	assert.Contains(t, groups["start"], "exp1")
+	assert.NotContains(t, groups["start"], "exp2")
+	assert.Contains(t, groups["finish"], "exp2")
+}
+
+// groupingKey returns the job and grouping labels in the given Pushgateway path, whose labels may be in any order.
+func groupingKey(path string) map[string]string {
+	key := map[string]string{}
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	for i := 0; i+1 < len(parts); i += 2 {
+		key[parts[i]] = parts[i+1]
+	}
+	return key
+}
+
+func TestPushError(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gateway.Close()
+
+	r := NewRecorder("finish", "InferenceService")
+	assert.Error(t, r.Push(gateway.URL))
+}
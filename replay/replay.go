@@ -0,0 +1,410 @@
+// Package replay records the interactions of the handler with the Kubernetes API server in cassettes, and replays them in tests.
+//
+// A Recorder is a client.Client which records each request made through it, along with its response, in a cassette.
+// A Replayer is a client.Client which serves the responses recorded in a cassette, and verifies that requests are made in the recorded order.
+// So, tests using a Replayer fail if the handler makes unexpected requests, such as extra writes.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// Cassette is a sequence of interactions with the Kubernetes API server.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a request to the Kubernetes API server along with its response.
+type Interaction struct {
+	// Verb is one of get, list, create, update, patch, delete and deleteAllOf.
+	Verb string `json:"verb"`
+	// Subresource is status for requests made through the status writer of the client.
+	Subresource string `json:"subresource,omitempty"`
+	APIVersion  string `json:"apiVersion"`
+	Kind        string `json:"kind"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+	// PatchType is the type of the patch of patch requests.
+	PatchType types.PatchType `json:"patchType,omitempty"`
+	// Body is the patch of patch requests, and the object of create and update requests.
+	Body json.RawMessage `json:"body,omitempty"`
+	// Response is the object returned by the request, if it succeeded.
+	Response json.RawMessage `json:"response,omitempty"`
+	// Error is the status of the error returned by the request, if it failed.
+	Error *metav1.Status `json:"error,omitempty"`
+}
+
+// LoadCassette reads a cassette from the given file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cassette := &Cassette{}
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return nil, errors.New("unable to unmarshal cassette; " + err.Error())
+	}
+	return cassette, nil
+}
+
+// Save writes the cassette to the given file.
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.New("unable to marshal cassette; " + err.Error())
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// newInteraction is a helper function that returns an interaction for the given request, without its response.
+func newInteraction(scheme *runtime.Scheme, verb string, subresource string, obj runtime.Object, key client.ObjectKey, patch client.Patch) (*Interaction, error) {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return nil, err
+	}
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	i := &Interaction{
+		Verb:        verb,
+		Subresource: subresource,
+		APIVersion:  apiVersion,
+		Kind:        kind,
+		Namespace:   key.Namespace,
+		Name:        key.Name,
+	}
+	switch {
+	case patch != nil:
+		i.PatchType = patch.Type()
+		data, err := patch.Data(obj.(client.Object))
+		if err != nil {
+			return nil, err
+		}
+		i.Body, err = compact(data)
+		if err != nil {
+			return nil, err
+		}
+	case verb == "create" || verb == "update":
+		if i.Body, err = json.Marshal(obj); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// compact is a helper function that returns the given JSON document without insignificant space.
+func compact(data []byte) (json.RawMessage, error) {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Recorder is a client.Client which records each request made through it in a cassette.
+type Recorder struct {
+	client.Client
+	mu       sync.Mutex // guards the fields below
+	cassette Cassette
+	// first error which prevented a request from being recorded
+	err error
+}
+
+// RecorderBuilder returns a recorder which makes requests using the given client.
+func RecorderBuilder(c client.Client) *Recorder {
+	return &Recorder{Client: c}
+}
+
+// Cassette returns the interactions recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: append([]Interaction{}, r.cassette.Interactions...)}
+}
+
+// Err returns an error if any request made through the recorder could not be recorded, in which case its cassette is incomplete.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// record is a helper function that makes a request using the given function, and records it along with its response.
+func (r *Recorder) record(verb string, subresource string, obj runtime.Object, key client.ObjectKey, patch client.Patch, do func() error) error {
+	// the patch is computed before the request, since the request updates obj
+	i, err := newInteraction(r.Scheme(), verb, subresource, obj, key, patch)
+	if err != nil {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = errors.New("unable to record " + verb + " request; " + err.Error())
+		}
+		r.mu.Unlock()
+		return do()
+	}
+	err = do()
+	if status, ok := err.(apierrors.APIStatus); ok {
+		s := status.Status()
+		i.Error = &s
+	} else if err == nil && verb != "delete" && verb != "deleteAllOf" {
+		i.Response, _ = json.Marshal(obj)
+	} else if err != nil {
+		i.Error = &metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, *i)
+	return err
+}
+
+// Get records a get request.
+func (r *Recorder) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return r.record("get", "", obj, key, nil, func() error {
+		return r.Client.Get(ctx, key, obj)
+	})
+}
+
+// List records a list request.
+func (r *Recorder) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	return r.record("list", "", list, client.ObjectKey{Namespace: listOpts.Namespace}, nil, func() error {
+		return r.Client.List(ctx, list, opts...)
+	})
+}
+
+// Create records a create request.
+func (r *Recorder) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return r.record("create", "", obj, client.ObjectKeyFromObject(obj), nil, func() error {
+		return r.Client.Create(ctx, obj, opts...)
+	})
+}
+
+// Update records an update request.
+func (r *Recorder) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return r.record("update", "", obj, client.ObjectKeyFromObject(obj), nil, func() error {
+		return r.Client.Update(ctx, obj, opts...)
+	})
+}
+
+// Patch records a patch request.
+func (r *Recorder) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return r.record("patch", "", obj, client.ObjectKeyFromObject(obj), patch, func() error {
+		return r.Client.Patch(ctx, obj, patch, opts...)
+	})
+}
+
+// Delete records a delete request.
+func (r *Recorder) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return r.record("delete", "", obj, client.ObjectKeyFromObject(obj), nil, func() error {
+		return r.Client.Delete(ctx, obj, opts...)
+	})
+}
+
+// DeleteAllOf records a deleteAllOf request.
+func (r *Recorder) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	deleteOpts := &client.DeleteAllOfOptions{}
+	deleteOpts.ApplyOptions(opts)
+	return r.record("deleteAllOf", "", obj, client.ObjectKey{Namespace: deleteOpts.Namespace}, nil, func() error {
+		return r.Client.DeleteAllOf(ctx, obj, opts...)
+	})
+}
+
+// Status returns a status writer which records requests to the status subresource.
+func (r *Recorder) Status() client.StatusWriter {
+	return &recordingStatusWriter{recorder: r, writer: r.Client.Status()}
+}
+
+// recordingStatusWriter records requests to the status subresource.
+type recordingStatusWriter struct {
+	recorder *Recorder
+	writer   client.StatusWriter
+}
+
+// Update records an update request to the status subresource.
+func (w *recordingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return w.recorder.record("update", "status", obj, client.ObjectKeyFromObject(obj), nil, func() error {
+		return w.writer.Update(ctx, obj, opts...)
+	})
+}
+
+// Patch records a patch request to the status subresource.
+func (w *recordingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return w.recorder.record("patch", "status", obj, client.ObjectKeyFromObject(obj), patch, func() error {
+		return w.writer.Patch(ctx, obj, patch, opts...)
+	})
+}
+
+// Replayer is a client.Client which serves the responses recorded in a cassette.
+// Each request must match the next interaction of the cassette; otherwise, it fails without a response.
+type Replayer struct {
+	client.Client // nil; methods which are not replayed panic
+	scheme        *runtime.Scheme
+	mu            sync.Mutex // guards the fields below
+	cassette      *Cassette
+	next          int     // index of the next interaction
+	mismatches    []error // requests which did not match the cassette
+}
+
+// ReplayerBuilder returns a replayer which serves the responses recorded in the given cassette.
+// The given scheme maps typed objects to their kinds.
+func ReplayerBuilder(cassette *Cassette, scheme *runtime.Scheme) *Replayer {
+	return &Replayer{
+		scheme:   scheme,
+		cassette: cassette,
+	}
+}
+
+// Scheme returns the scheme of the replayer.
+func (r *Replayer) Scheme() *runtime.Scheme {
+	return r.scheme
+}
+
+// Done returns an error if any request did not match the cassette, or if any interaction of the cassette was not replayed.
+func (r *Replayer) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.mismatches) > 0 {
+		return r.mismatches[0]
+	}
+	if r.next < len(r.cassette.Interactions) {
+		i := r.cassette.Interactions[r.next]
+		return fmt.Errorf("%d interactions not replayed; next is %s", len(r.cassette.Interactions)-r.next, describe(&i))
+	}
+	return nil
+}
+
+// describe is a helper function that returns a description of the request of the given interaction.
+func describe(i *Interaction) string {
+	s := i.Verb + " " + i.Kind + " " + i.Namespace + "/" + i.Name
+	if i.Subresource != "" {
+		s += " (" + i.Subresource + ")"
+	}
+	return s
+}
+
+// replay is a helper function that matches a request with the next interaction of the cassette, and sets its response in obj.
+func (r *Replayer) replay(verb string, subresource string, obj runtime.Object, key client.ObjectKey, patch client.Patch) error {
+	req, err := newInteraction(r.scheme, verb, subresource, obj, key, patch)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next >= len(r.cassette.Interactions) {
+		err := errors.New("unexpected request " + describe(req) + "; cassette has no more interactions")
+		r.mismatches = append(r.mismatches, err)
+		return err
+	}
+	i := r.cassette.Interactions[r.next]
+	if err := match(req, &i); err != nil {
+		r.mismatches = append(r.mismatches, err)
+		return err
+	}
+	r.next++
+	if i.Error != nil {
+		return &apierrors.StatusError{ErrStatus: *i.Error}
+	}
+	if len(i.Response) > 0 {
+		// reset obj, so that fields absent in the response are not retained
+		v := reflect.ValueOf(obj).Elem()
+		v.Set(reflect.Zero(v.Type()))
+		return json.Unmarshal(i.Response, obj)
+	}
+	return nil
+}
+
+// match is a helper function that returns an error if the given request does not match the request of the given interaction.
+func match(req *Interaction, i *Interaction) error {
+	if describe(req) != describe(i) || req.APIVersion != i.APIVersion || req.PatchType != i.PatchType {
+		return errors.New("unexpected request " + describe(req) + "; expected " + describe(i))
+	}
+	if !equalJSON(req.Body, i.Body) {
+		return errors.New("unexpected body of request " + describe(req) + ": " + string(req.Body) + "; expected " + string(i.Body))
+	}
+	return nil
+}
+
+// equalJSON is a helper function that checks if the given JSON documents are semantically equal.
+func equalJSON(a json.RawMessage, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	xBytes, _ := json.Marshal(x)
+	yBytes, _ := json.Marshal(y)
+	return bytes.Equal(xBytes, yBytes)
+}
+
+// Get replays a get request.
+func (r *Replayer) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return r.replay("get", "", obj, key, nil)
+}
+
+// List replays a list request.
+func (r *Replayer) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	return r.replay("list", "", list, client.ObjectKey{Namespace: listOpts.Namespace}, nil)
+}
+
+// Create replays a create request.
+func (r *Replayer) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return r.replay("create", "", obj, client.ObjectKeyFromObject(obj), nil)
+}
+
+// Update replays an update request.
+func (r *Replayer) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return r.replay("update", "", obj, client.ObjectKeyFromObject(obj), nil)
+}
+
+// Patch replays a patch request.
+func (r *Replayer) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return r.replay("patch", "", obj, client.ObjectKeyFromObject(obj), patch)
+}
+
+// Delete replays a delete request.
+func (r *Replayer) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return r.replay("delete", "", obj, client.ObjectKeyFromObject(obj), nil)
+}
+
+// DeleteAllOf replays a deleteAllOf request.
+func (r *Replayer) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	deleteOpts := &client.DeleteAllOfOptions{}
+	deleteOpts.ApplyOptions(opts)
+	return r.replay("deleteAllOf", "", obj, client.ObjectKey{Namespace: deleteOpts.Namespace}, nil)
+}
+
+// Status returns a status writer which replays requests to the status subresource.
+func (r *Replayer) Status() client.StatusWriter {
+	return &replayingStatusWriter{replayer: r}
+}
+
+// replayingStatusWriter replays requests to the status subresource.
+type replayingStatusWriter struct {
+	replayer *Replayer
+}
+
+// Update replays an update request to the status subresource.
+func (w *replayingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return w.replayer.replay("update", "status", obj, client.ObjectKeyFromObject(obj), nil)
+}
+
+// Patch replays a patch request to the status subresource.
+func (w *replayingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return w.replayer.replay("patch", "status", obj, client.ObjectKeyFromObject(obj), patch)
+}
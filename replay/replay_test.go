@@ -0,0 +1,127 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/iter8-tools/iter8ctl/utils"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var key = client.ObjectKey{Namespace: "default", Name: "my-model"}
+
+func getK8sClientWithTargetFromFile(t *testing.T, filePath string) client.Client {
+	data, err := ioutil.ReadFile(utils.CompletePath("../testdata", filePath))
+	if err != nil {
+		t.Fatal("Cannot read target from file", err)
+	}
+	u := &unstructured.Unstructured{
+		Object: make(map[string]interface{}),
+	}
+	if err = json.Unmarshal(data, &u.Object); err != nil {
+		t.Fatal("Cannot unmarshal target", err)
+	}
+	return fake.NewClientBuilder().WithObjects(u).Build()
+}
+
+func newInferenceService() *unstructured.Unstructured {
+	isvc := &unstructured.Unstructured{}
+	isvc.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "serving.kubeflow.org",
+		Kind:    "InferenceService",
+		Version: "v1beta1",
+	})
+	return isvc
+}
+
+// interact makes the requests whose interactions are recorded in the tests below.
+func interact(c client.Client) (*unstructured.Unstructured, error) {
+	isvc := newInferenceService()
+	if err := c.Get(context.Background(), key, isvc); err != nil {
+		return nil, err
+	}
+	err := c.Patch(context.Background(), isvc, client.RawPatch(types.MergePatchType,
+		[]byte(`{"metadata":{"annotations":{"key":"value"}}}`)))
+	if err != nil {
+		return nil, err
+	}
+	missing := newInferenceService()
+	err = c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "missing"}, missing)
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	return isvc, nil
+}
+
+func record(t *testing.T) *Cassette {
+	r := RecorderBuilder(getK8sClientWithTargetFromFile(t, "canaryv1beta1.json"))
+	_, err := interact(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Err())
+	return r.Cassette()
+}
+
+func TestRecordError(t *testing.T) {
+	r := RecorderBuilder(getK8sClientWithTargetFromFile(t, "canaryv1beta1.json"))
+	// the kind of an object without group version kind is unknown
+	assert.Error(t, r.Get(context.Background(), key, &unstructured.Unstructured{}))
+	assert.NoError(t, r.Get(context.Background(), key, newInferenceService()))
+	assert.Len(t, r.Cassette().Interactions, 1)
+	assert.Error(t, r.Err())
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	cassette := record(t)
+	assert.Len(t, cassette.Interactions, 3)
+	assert.Equal(t, "patch", cassette.Interactions[1].Verb)
+	assert.Equal(t, types.MergePatchType, cassette.Interactions[1].PatchType)
+	assert.Equal(t, "NotFound", string(cassette.Interactions[2].Error.Reason))
+
+	// cassettes survive a round trip through a file
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	assert.NoError(t, cassette.Save(path))
+	cassette, err := LoadCassette(path)
+	assert.NoError(t, err)
+
+	r := ReplayerBuilder(cassette, runtime.NewScheme())
+	isvc, err := interact(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", isvc.GetAnnotations()["key"])
+	assert.NoError(t, r.Done())
+}
+
+func TestReplayUnexpectedRequests(t *testing.T) {
+	cassette := record(t)
+	r := ReplayerBuilder(cassette, runtime.NewScheme())
+	isvc := newInferenceService()
+	assert.NoError(t, r.Get(context.Background(), key, isvc))
+	// a patch with a different body
+	err := r.Patch(context.Background(), isvc, client.RawPatch(types.MergePatchType,
+		[]byte(`{"metadata":{"annotations":{"key":"other"}}}`)))
+	assert.Error(t, err)
+	assert.Error(t, r.Done())
+
+	// an extra write
+	r = ReplayerBuilder(cassette, runtime.NewScheme())
+	_, err = interact(r)
+	assert.NoError(t, err)
+	assert.Error(t, r.Delete(context.Background(), isvc))
+	assert.Error(t, r.Done())
+}
+
+func TestReplayMissingRequests(t *testing.T) {
+	cassette := record(t)
+	r := ReplayerBuilder(cassette, runtime.NewScheme())
+	assert.NoError(t, r.Get(context.Background(), key, newInferenceService()))
+	assert.EqualError(t, r.Done(), "2 interactions not replayed; next is patch InferenceService default/my-model")
+}
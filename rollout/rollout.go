@@ -0,0 +1,502 @@
+// Package rollout provides types and methods for experiments on Argo Rollouts, which progressively deliver new revisions of Deployments.
+//
+// The target of an experiment is a Rollout with a canary strategy, referred to as rollouts/<namespace>/<name>. Its baseline is the stable ReplicaSet of the Rollout, and its candidate is the ReplicaSet of the current pod template; each version is identified by its pod template hash, which is tagged as its revision.
+//
+// The target takes over the canary steps of the Rollout for the duration of the experiment. It splits traffic by replacing these steps with a setWeight step followed by an indefinite pause step, so that the Rollout holds the candidate at the given weight. At the end of the experiment, a winning candidate is promoted by replacing these steps with a single setWeight step of 100, and a losing candidate is aborted; either way, the steps of the Rollout before the experiment are restored.
+package rollout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/tracing"
+)
+
+// Kind is the kind of Argo Rollouts, which are referred to as rollouts/<namespace>/<name>.
+var Kind = &target.ObjectKind{
+	GVK: schema.GroupVersionKind{
+		Group:   "argoproj.io",
+		Version: "v1alpha1",
+		Kind:    "Rollout",
+	},
+	Resource:   "rollouts",
+	ShortNames: []string{"ro"},
+}
+
+// Phases of Argo Rollouts, found in their status.
+const (
+	// PhaseHealthy is the phase of a Rollout which is fully promoted and available.
+	PhaseHealthy = "Healthy"
+	// PhasePaused is the phase of a Rollout which is paused at a pause step.
+	PhasePaused = "Paused"
+	// PhaseDegraded is the phase of a Rollout which is aborted or has failed.
+	PhaseDegraded = "Degraded"
+)
+
+// weightField is the path of the weight of the candidate, after the target has taken over the canary steps of the Rollout.
+const weightField = "/spec/strategy/canary/steps/0/setWeight"
+
+// Snapshot records the canary steps of the Rollout before an experiment changes them.
+type Snapshot struct {
+	// Steps are the canary steps of the Rollout, which are nil if the Rollout had no steps.
+	Steps []interface{} `json:"steps"`
+}
+
+// Target is an enhancement of Argo Rollout, which splits traffic between its stable and canary ReplicaSets.
+type Target struct {
+	target.Base
+	rollout *unstructured.Unstructured
+}
+
+// TargetBuilder returns an initial Rollout target struct pointer.
+func TargetBuilder() *Target {
+	t := &Target{}
+	t.Base = target.BaseBuilder(t, "rollout", "rollout")
+	return t
+}
+
+// Fetch fetches the Rollout object from the Kubernetes cluster and populates the target struct with it.
+// Rollout may be unavailable at the start of this call. So, Fetch periodically attempts to fetch the Rollout object for 180 sec.
+// If it does not succeed in 180 secs, the method returns after setting an error.
+func (t *Target) Fetch(targetRef string) target.Target {
+	if ro := t.FetchObject(Kind, targetRef); ro != nil {
+		t.rollout = ro
+	}
+	return t
+}
+
+// getStatus is a helper function that returns the given string field of the status of the Rollout, or an empty string if the Rollout does not have this field.
+func getStatus(ro *unstructured.Unstructured, field string) string {
+	val, _, _ := unstructured.NestedString(ro.Object, "status", field)
+	return val
+}
+
+// getRevisions is a helper function that returns the pod template hashes of the stable and the current ReplicaSets of the Rollout.
+func getRevisions(ro *unstructured.Unstructured) (string, string) {
+	return getStatus(ro, "stableRS"), getStatus(ro, "currentPodHash")
+}
+
+// hasCandidate is a helper function that checks if the current ReplicaSet of the Rollout is distinct from its stable ReplicaSet.
+func hasCandidate(ro *unstructured.Unstructured) bool {
+	stable, current := getRevisions(ro)
+	return current != "" && current != stable
+}
+
+// getPhase is a helper function that returns the phase of the Rollout.
+// The phase is empty if the Rollout controller has not observed the latest generation of the Rollout, since its status may be stale.
+func getPhase(ro *unstructured.Unstructured) string {
+	if observed, found, _ := unstructured.NestedFieldNoCopy(ro.Object, "status", "observedGeneration"); found {
+		// observedGeneration is a string in older versions of Argo Rollouts
+		if fmt.Sprint(observed) != fmt.Sprint(ro.GetGeneration()) {
+			return ""
+		}
+	}
+	return getStatus(ro, "phase")
+}
+
+// isAborted is a helper function that checks if the update of the Rollout to its current ReplicaSet is aborted.
+// Aborted Rollouts are degraded.
+func isAborted(ro *unstructured.Unstructured) bool {
+	abort, _, _ := unstructured.NestedBool(ro.Object, "status", "abort")
+	return abort && getPhase(ro) == PhaseDegraded
+}
+
+// isPromoted is a helper function that checks if the current ReplicaSet of the Rollout is its healthy stable ReplicaSet.
+func isPromoted(ro *unstructured.Unstructured) bool {
+	stable, current := getRevisions(ro)
+	return stable == current && getPhase(ro) == PhaseHealthy
+}
+
+// getSteps is a helper function that returns the canary steps of the Rollout, which are nil if the Rollout has no steps.
+func getSteps(ro *unstructured.Unstructured) ([]interface{}, error) {
+	if _, found, _ := unstructured.NestedMap(ro.Object, "spec", "strategy", "canary"); !found {
+		return nil, errors.New("target Rollout " + ro.GetName() + " needs a canary strategy")
+	}
+	steps, _, err := unstructured.NestedSlice(ro.Object, "spec", "strategy", "canary", "steps")
+	if err != nil {
+		return nil, errors.New("invalid canary steps in Rollout " + ro.GetName() + "; " + err.Error())
+	}
+	return steps, nil
+}
+
+// weightSteps is a helper function that returns the canary steps which hold the candidate at the given weight.
+func weightSteps(p int64) []interface{} {
+	return []interface{}{
+		map[string]interface{}{"setWeight": p},
+		map[string]interface{}{"pause": map[string]interface{}{}},
+	}
+}
+
+// promotionSteps is a helper function that returns the canary steps which promote the candidate.
+func promotionSteps() []interface{} {
+	return []interface{}{
+		map[string]interface{}{"setWeight": int64(100)},
+	}
+}
+
+// hasSteps is a helper function that checks if the Rollout has the given canary steps.
+// Steps are compared in their JSON form, since numbers in the Rollout may be decoded with a different type.
+func hasSteps(ro *unstructured.Unstructured, steps []interface{}) bool {
+	current, err := getSteps(ro)
+	if err != nil {
+		return false
+	}
+	currentBytes, err := json.Marshal(current)
+	if err != nil {
+		return false
+	}
+	stepsBytes, err := json.Marshal(steps)
+	return err == nil && string(currentBytes) == string(stepsBytes)
+}
+
+// isPausedAt is a helper function that checks if the Rollout holds the candidate at the given weight, by pausing at the step which follows setWeight.
+func isPausedAt(ro *unstructured.Unstructured, p int64) bool {
+	index, _, _ := unstructured.NestedInt64(ro.Object, "status", "currentStepIndex")
+	return hasSteps(ro, weightSteps(p)) && index == 1 && getPhase(ro) == PhasePaused
+}
+
+// setSteps is a helper function that sets the given canary steps of the Rollout, or removes its steps if the given steps are nil.
+func setSteps(t *Target, steps []interface{}) error {
+	if _, err := getSteps(t.rollout); err != nil {
+		return err
+	}
+	if hasSteps(t.rollout, steps) {
+		return nil
+	}
+	payload := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"strategy": map[string]interface{}{
+				"canary": map[string]interface{}{
+					"steps": steps,
+				},
+			},
+		},
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.New("unable to marshal canary steps patch")
+	}
+	return t.Patch(t.rollout, client.RawPatch(types.MergePatchType, payloadBytes))
+}
+
+// abort is a helper function that aborts the update of the Rollout to its current ReplicaSet, as the abort command of the Argo Rollouts plugin does, so that all traffic returns to the stable ReplicaSet.
+func abort(t *Target) error {
+	if abort, _, _ := unstructured.NestedBool(t.rollout.Object, "status", "abort"); abort {
+		return nil
+	}
+	return t.PatchStatus(t.rollout, client.RawPatch(types.MergePatchType, []byte(`{"status":{"abort":true}}`)))
+}
+
+// isFetched is a helper function for fetching the Rollout, and checking if it satisfies the given condition.
+func isFetched(t *Target, cond func(ro *unstructured.Unstructured) bool) bool {
+	t.Fetch(t.Exp.GetTargetRef())
+	return t.Err == nil && cond(t.rollout)
+}
+
+// ensureReadiness ensures that the Rollout reaches the phase given by the condition.
+// It periodically fetches the Rollout and checks this condition.
+// Returns true if readiness is reached in 180 sec and false otherwise.
+func ensureReadiness(t *Target, cond func(ro *unstructured.Unstructured) bool) (ready bool) {
+	defer t.StartSpan("EnsureReadiness")()
+	defer func(start time.Time) {
+		t.Observe("ensure_readiness", start, ready)
+	}(time.Now())
+	return t.Poll(t.Retries, func() bool { return isFetched(t, cond) })
+}
+
+// SetCandidateWeight replaces the canary steps of the Rollout, so that the Rollout holds the candidate at the given weight.
+// After this step, the handler waits for (<=) 180 sec to ensure the Rollout is paused at this weight.
+// If any of the above steps fail, the method returns after setting an error.
+func (t *Target) SetCandidateWeight(p int64) target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("SetCandidateWeight")()
+	defer func(start time.Time) {
+		t.Observe("set_candidate_weight", start, t.Err == nil)
+	}(time.Now())
+	if t.rollout == nil {
+		t.Err = errors.New("unable to set traffic split; uninitialized rollout object")
+		return t
+	}
+	if t.Err = setSteps(t, weightSteps(p)); t.Err != nil {
+		return t
+	}
+	if !ensureReadiness(t, func(ro *unstructured.Unstructured) bool { return isPausedAt(ro, p) }) && t.Err == nil {
+		t.Err = errors.New("post-patch: unable to ensure readiness of rollout even after 180 seconds")
+	}
+	return t
+}
+
+// InitializeTrafficSplit initializes traffic split for the target.
+// The candidate receives 1% of the traffic, or 0% in BlueGreen experiments.
+// Single-version experiments leave the Rollout untouched.
+func (t *Target) InitializeTrafficSplit() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("InitializeTrafficSplit")()
+	if t.Exp != nil && t.Exp.IsSingleVersion() {
+		return t
+	}
+	p := int64(1)
+	if t.Exp != nil && t.Exp.IsBlueGreen() {
+		p = 0
+	}
+	if t.Resume("InitializeTrafficSplit", func() bool {
+		return isFetched(t, func(ro *unstructured.Unstructured) bool { return isPausedAt(ro, p) })
+	}) {
+		return t
+	}
+	defer t.Complete("InitializeTrafficSplit")
+	return t.SetCandidateWeight(p)
+}
+
+// EnsureCandidate ensures that the Rollout has a current ReplicaSet distinct from its stable ReplicaSet.
+// The candidate may not have been created at the start of this call. So, EnsureCandidate periodically fetches the Rollout until the candidate wait (180 sec by default) elapses.
+// If the candidate does not appear within this duration, the method returns after setting a *target.NoCandidateError.
+func (t *Target) EnsureCandidate() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("EnsureCandidate")()
+	if t.Exp == nil {
+		t.Err = errors.New("method EnsureCandidate called on a target with nil experiment")
+		return t
+	}
+	if t.rollout == nil {
+		t.Err = errors.New("unable to find candidate; uninitialized rollout object")
+		return t
+	}
+	// Fetch retries on its own; so, each check gets the Rollout in a single attempt
+	var err error
+	if t.Poll(t.CandidateRetries, func() bool {
+		var ro *unstructured.Unstructured
+		if ro, err = t.Refetch(t.rollout); err != nil {
+			return false
+		}
+		t.rollout = ro
+		return hasCandidate(ro)
+	}) || t.Err != nil {
+		return t
+	}
+	if err != nil {
+		t.Err = errors.New("unable to fetch target; " + err.Error())
+		return t
+	}
+	stable, _ := getRevisions(t.rollout)
+	t.Err = &target.NoCandidateError{Revision: stable}
+	return t
+}
+
+// versionTags is a helper function that returns the tags of the version of the Rollout with the given revision.
+func versionTags(ro *unstructured.Unstructured, revision string) *map[string]string {
+	return &map[string]string{
+		"revision":  revision,
+		"rollout":   ro.GetName(),
+		"namespace": ro.GetNamespace(),
+	}
+}
+
+// GetVersionInfo constructs the VersionInfo object based on the target and returns it.
+// The WeightObjRef of the candidate refers to the setWeight field of the first canary step of the Rollout; the baseline receives the rest of the traffic.
+func (t *Target) GetVersionInfo() (_ *etc3.VersionInfo, err error) {
+	_, span := tracing.Start(t.Ctx, "rollout.GetVersionInfo")
+	defer func() {
+		tracing.End(span, err)
+	}()
+	if t.rollout == nil {
+		return nil, errors.New("unable to get version info; uninitialized rollout object")
+	}
+	stable, current := getRevisions(t.rollout)
+	if stable == "" {
+		return nil, errors.New("target Rollout " + t.rollout.GetName() + " has no stable ReplicaSet")
+	}
+	if t.Exp.IsSingleVersion() {
+		return &etc3.VersionInfo{
+			Baseline: etc3.VersionDetail{
+				Name: "default",
+				Tags: versionTags(t.rollout, stable),
+			},
+		}, nil
+	}
+	if !hasCandidate(t.rollout) {
+		return nil, &target.NoCandidateError{Revision: stable}
+	}
+	return &etc3.VersionInfo{
+		Baseline: etc3.VersionDetail{
+			Name: "default",
+			Tags: versionTags(t.rollout, stable),
+		},
+		Candidates: []etc3.VersionDetail{
+			{
+				Name: "canary",
+				Tags: versionTags(t.rollout, current),
+				WeightObjRef: &v1.ObjectReference{
+					Kind:       Kind.GVK.Kind,
+					Namespace:  t.rollout.GetNamespace(),
+					Name:       t.rollout.GetName(),
+					APIVersion: t.rollout.GetAPIVersion(),
+					FieldPath:  weightField,
+				},
+			},
+		},
+	}, nil
+}
+
+// SetVersionInfoInExperiment sets version info in the experiment associated with this target.
+func (t *Target) SetVersionInfoInExperiment() target.Target {
+	t.SetVersionInfo(t.GetVersionInfo)
+	return t
+}
+
+// SetNewBaseline sets a new baseline within the target.
+// A winning candidate is promoted; in BlueGreen experiments, the Rollout is first held with all traffic on the candidate for the verification window, and aborted if it does not stay paused at this weight.
+// Otherwise, the candidate is aborted.
+// Either way, the canary steps of the Rollout before the experiment are restored.
+func (t *Target) SetNewBaseline() target.Target {
+	t.SetBaseline(t.rollout, target.BaselineSteps{
+		IsSet:      func(recommended string) bool { return hasNewBaseline(t, recommended) },
+		IsRestored: func() bool { return isRestored(t) },
+		Restore:    func() { t.RestoreTrafficState() },
+		Shift:      func(string) { t.SetCandidateWeight(100) },
+		IsReady: func() bool {
+			return isFetched(t, func(ro *unstructured.Unstructured) bool { return isPausedAt(ro, 100) })
+		},
+		Unready: "rollout became un-ready after cutover",
+		Promote: func(string) { t.promote() },
+	})
+	return t
+}
+
+// hasNewBaseline is a helper function for fetching the target and checking if it is ready with the given recommended baseline as its new baseline.
+func hasNewBaseline(t *Target, recommendedBaseline string) bool {
+	if recommendedBaseline != "canary" {
+		return isRestored(t)
+	}
+	steps, err := snapshotSteps(t)
+	return err == nil && isFetched(t, func(ro *unstructured.Unstructured) bool {
+		return isPromoted(ro) && hasSteps(ro, steps)
+	})
+}
+
+// snapshotSteps is a helper function that returns the canary steps recorded in the snapshot annotation of the experiment.
+func snapshotSteps(t *Target) ([]interface{}, error) {
+	snapshot := Snapshot{}
+	found, err := t.GetSnapshot(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("traffic state snapshot not found in experiment")
+	}
+	return snapshot.Steps, nil
+}
+
+// isRestored is a helper function for fetching the target and checking if its candidate is aborted, and it has the canary steps recorded in the snapshot annotation of the experiment.
+// A Rollout without a candidate needs to be healthy instead.
+func isRestored(t *Target) bool {
+	steps, err := snapshotSteps(t)
+	return err == nil && isFetched(t, func(ro *unstructured.Unstructured) bool {
+		if !hasSteps(ro, steps) {
+			return false
+		}
+		if hasCandidate(ro) {
+			return isAborted(ro)
+		}
+		return getPhase(ro) == PhaseHealthy
+	})
+}
+
+// promote promotes the candidate to the stable ReplicaSet of the Rollout, by replacing its canary steps with a single setWeight step of 100.
+// After the Rollout is promoted, its canary steps before the experiment are restored.
+func (t *Target) promote() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("Promote")()
+	if t.Err = setSteps(t, promotionSteps()); t.Err != nil {
+		return t
+	}
+	if !ensureReadiness(t, isPromoted) {
+		if t.Err == nil {
+			t.Err = errors.New("post-patch: unable to ensure promotion of rollout even after 180 seconds")
+		}
+		return t
+	}
+	steps, err := snapshotSteps(t)
+	if err != nil {
+		t.LogEntry().Warn("leaving canary steps of promoted rollout unchanged; ", err)
+		return t
+	}
+	t.Err = setSteps(t, steps)
+	return t
+}
+
+// RecordAssessedVersion records the revision assessed in a single-version experiment as an annotation of the experiment.
+// The assessed revision is the revision of the baseline recorded in the versionInfo of the experiment during start.
+func (t *Target) RecordAssessedVersion() target.Target {
+	t.RecordAssessed("revision")
+	return t
+}
+
+// SnapshotTrafficState records the canary steps of the Rollout in the snapshot annotation of the experiment.
+func (t *Target) SnapshotTrafficState() target.Target {
+	t.Snapshot(t.rollout, func() (interface{}, error) {
+		steps, err := getSteps(t.rollout)
+		return Snapshot{Steps: steps}, err
+	})
+	return t
+}
+
+// RestoreTrafficState aborts the candidate of the Rollout, so that all traffic returns to the stable ReplicaSet, and restores the canary steps recorded in the snapshot annotation of the experiment.
+// The canary steps of experiments without a snapshot are left unchanged.
+// After this step, the handler waits for (<=) 180 sec to ensure the candidate is aborted.
+func (t *Target) RestoreTrafficState() target.Target {
+	t.Restore(t.rollout, func() {
+		if hasCandidate(t.rollout) {
+			if t.Err = abort(t); t.Err != nil {
+				return
+			}
+		}
+		steps, err := snapshotSteps(t)
+		if err != nil {
+			t.LogEntry().Warn("leaving canary steps of rollout unchanged; ", err)
+		} else if t.Err = setSteps(t, steps); t.Err != nil {
+			return
+		}
+		if !ensureReadiness(t, func(ro *unstructured.Unstructured) bool {
+			return !hasCandidate(ro) || isAborted(ro)
+		}) && t.Err == nil {
+			t.Err = errors.New("post-patch: unable to ensure abort of rollout even after 180 seconds")
+		}
+	})
+	return t
+}
+
+// Claim claims the Rollout for the experiment by recording the experiment in its lock annotation.
+// If the Rollout is claimed by another experiment which still exists, the method returns after setting a *target.LockedError.
+func (t *Target) Claim() target.Target {
+	t.ClaimObject(t.rollout)
+	return t
+}
+
+// Release releases the claim of the experiment on the Rollout by removing its lock annotation.
+// Locks held by other experiments are left unchanged.
+func (t *Target) Release() target.Target {
+	t.ReleaseObject(func() *unstructured.Unstructured {
+		t.Fetch(t.Exp.GetTargetRef())
+		return t.rollout
+	})
+	return t
+}
@@ -0,0 +1,264 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/target/targettest"
+)
+
+// originalSteps are the canary steps of the Rollout in rollout.json.
+const originalSteps = `[{"setWeight":20},{"pause":{"duration":"1h"}},{"setWeight":60},{"pause":{}}]`
+
+// generationClient bumps the generation of Rollouts whose spec is patched through it, as the API server does.
+// So, the status of the Rollout is stale after each change of its canary steps, until the Rollout controller observes this change.
+type generationClient struct {
+	client.Client
+}
+
+func (c *generationClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+		return err
+	}
+	if obj.GetObjectKind().GroupVersionKind() != Kind.GVK || !strings.Contains(string(data), `"spec"`) {
+		return nil
+	}
+	obj.SetGeneration(obj.GetGeneration() + 1)
+	return c.Client.Update(ctx, obj)
+}
+
+// controller simulates the Rollout controller, which reconciles the Rollout whenever the target waits for it.
+// The Rollout pauses at the step which follows the first setWeight step, and is promoted if its steps are a single setWeight step of 100. It degrades once it is aborted, or once the controller has reconciled it degradeAfter times, if degradeAfter is positive.
+type controller struct {
+	t            *testing.T
+	c            client.Client
+	reconciled   int
+	degradeAfter int
+}
+
+// newController returns a client with the Rollout in rollout.json, along with a simulated Rollout controller.
+func newController(t *testing.T) *controller {
+	return &controller{t: t, c: &generationClient{targettest.NewClient(t, "rollout.json")}}
+}
+
+// reconcile updates the status of the Rollout for its latest generation.
+func (ctrl *controller) reconcile() {
+	ctrl.reconciled++
+	ro := getRollout(ctrl.t, ctrl.c)
+	status := map[string]interface{}{"observedGeneration": fmt.Sprint(ro.GetGeneration())}
+	abort, _, _ := unstructured.NestedBool(ro.Object, "status", "abort")
+	stable, current := getRevisions(ro)
+	switch {
+	case abort || (ctrl.degradeAfter > 0 && ctrl.reconciled >= ctrl.degradeAfter):
+		status["phase"] = PhaseDegraded
+	case hasSteps(ro, promotionSteps()) || stable == current:
+		status["phase"] = PhaseHealthy
+		status["stableRS"] = current
+	default:
+		status["phase"] = PhasePaused
+		status["currentStepIndex"] = int64(1)
+	}
+	statusBytes, _ := json.Marshal(map[string]interface{}{"status": status})
+	assert.NoError(ctrl.t, ctrl.c.Patch(context.Background(), ro, client.RawPatch(types.MergePatchType, statusBytes)))
+}
+
+// getTarget returns a resumable target which is fetched for an experiment with the given strategy, created in the client of the given controller.
+// The controller reconciles the Rollout whenever the target waits.
+func getTarget(ctrl *controller, strategy etc3.StrategyType) *Target {
+	exp := targettest.NewExperiment(ctrl.t, ctrl.c, "rollouts/default/reviews", strategy, nil)
+	return fetchTarget(ctrl, exp)
+}
+
+// fetchTarget returns a resumable target which is fetched for the given experiment in the client of the given controller.
+func fetchTarget(ctrl *controller, exp *experiment.Experiment) *Target {
+	clock := targettest.NewSteppingClock()
+	clock.OnTick = ctrl.reconcile
+	targ := TargetBuilder()
+	targ.SetResumable(true)
+	targ.SetClock(clock)
+	targettest.Fetch(ctrl.t, targ, ctrl.c, exp)
+	return targ
+}
+
+// getRollout returns the Rollout in the given client.
+func getRollout(t *testing.T, c client.Client) *unstructured.Unstructured {
+	ro := &unstructured.Unstructured{}
+	ro.SetGroupVersionKind(Kind.GVK)
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "reviews"}, ro); err != nil {
+		t.Fatal("Cannot get rollout", err)
+	}
+	return ro
+}
+
+// getStepsJSON returns the canary steps of the Rollout in the given client as JSON.
+func getStepsJSON(t *testing.T, c client.Client) string {
+	steps, err := getSteps(getRollout(t, c))
+	assert.NoError(t, err)
+	stepsBytes, _ := json.Marshal(steps)
+	return string(stepsBytes)
+}
+
+// setRolloutStatus simulates the Rollout controller by patching the status of the Rollout in the given client.
+func setRolloutStatus(t *testing.T, c client.Client, status string) {
+	ro := getRollout(t, c)
+	assert.NoError(t, c.Patch(context.Background(), ro, client.RawPatch(types.MergePatchType, []byte(`{"status":`+status+`}`))))
+}
+
+func TestStartAndPromote(t *testing.T) {
+	ctrl := newController(t)
+	c := ctrl.c
+	targ := getTarget(ctrl, etc3.StrategyTypeCanary)
+	targ.Claim().EnsureCandidate().SnapshotTrafficState()
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, `[{"setWeight":1},{"pause":{}}]`, getStepsJSON(t, c))
+	// the target waits for the controller to pause the Rollout at the new steps
+	assert.Equal(t, 1, ctrl.reconciled)
+	assert.True(t, isPausedAt(getRollout(t, c), 1))
+	assert.Equal(t, `{"steps":`+originalSteps+`}`, targ.Exp.GetAnnotations()[experiment.SnapshotAnnotation])
+	assert.Contains(t, getRollout(t, c).GetAnnotations(), target.LockAnnotation)
+
+	exp := &etc3.Experiment{}
+	c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "myexp"}, exp)
+	vi := exp.Spec.VersionInfo
+	assert.Equal(t, map[string]string{
+		"revision":  "6d5f8c7b9",
+		"rollout":   "reviews",
+		"namespace": "default",
+	}, *vi.Baseline.Tags)
+	assert.Equal(t, "7f9d4c6a5", (*vi.Candidates[0].Tags)["revision"])
+	assert.Nil(t, vi.Baseline.WeightObjRef)
+	assert.Equal(t, "/spec/strategy/canary/steps/0/setWeight", vi.Candidates[0].WeightObjRef.FieldPath)
+	assert.Equal(t, "argoproj.io/v1alpha1", vi.Candidates[0].WeightObjRef.APIVersion)
+
+	// the candidate wins, and is promoted once the controller observes the promotion steps
+	assert.NoError(t, c.Patch(context.Background(), exp, client.RawPatch(types.MergePatchType, []byte(`{"status":{"recommendedBaseline":"canary"}}`))))
+	next := fetchTarget(ctrl, experiment.Builder(exp))
+	next.SetNewBaseline().Release()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, 2, ctrl.reconciled)
+	stable, _ := getRevisions(getRollout(t, c))
+	assert.Equal(t, "7f9d4c6a5", stable)
+	assert.Equal(t, originalSteps, getStepsJSON(t, c))
+	assert.NotContains(t, getRollout(t, c).GetAnnotations(), target.LockAnnotation)
+}
+
+func TestSetCandidateWeightWaitsForController(t *testing.T) {
+	ctrl := newController(t)
+	targ := getTarget(ctrl, etc3.StrategyTypeCanary)
+	// the status of the Rollout is stale, since the controller does not act
+	targ.SetClock(targettest.NewSteppingClock())
+	targ.Retries = 2
+	targ.SetCandidateWeight(40)
+	assert.EqualError(t, targ.Err, "post-patch: unable to ensure readiness of rollout even after 180 seconds")
+	assert.Equal(t, "", getPhase(getRollout(t, ctrl.c)))
+
+	// the controller pauses the Rollout at the new weight
+	ctrl.reconcile()
+	targ.Err = nil
+	targ.SetCandidateWeight(40)
+	assert.NoError(t, targ.Err)
+}
+
+func TestFinishBaselineAborts(t *testing.T) {
+	ctrl := newController(t)
+	c := ctrl.c
+	targ := getTarget(ctrl, etc3.StrategyTypeCanary)
+	targ.SnapshotTrafficState().InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	recommended := "default"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+
+	// the controller has not yet acted on the abort
+	targ.SetClock(targettest.NewSteppingClock())
+	targ.Retries = 0
+	targ.SetNewBaseline()
+	assert.EqualError(t, targ.Err, "post-patch: unable to ensure abort of rollout even after 180 seconds")
+	abort, _, _ := unstructured.NestedBool(getRollout(t, c).Object, "status", "abort")
+	assert.True(t, abort)
+	assert.Equal(t, originalSteps, getStepsJSON(t, c))
+
+	// a rerun completes once the controller aborts the Rollout, and a further rerun is skipped
+	ctrl.reconcile()
+	assert.Equal(t, PhaseDegraded, getPhase(getRollout(t, c)))
+	targ.Err = nil
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, `["InitializeTrafficSplit","SetNewBaseline"]`, targ.Exp.GetAnnotations()[experiment.ProgressAnnotation])
+}
+
+func TestEnsureCandidateWithoutCandidate(t *testing.T) {
+	ctrl := newController(t)
+	setRolloutStatus(t, ctrl.c, `{"phase":"Healthy","currentPodHash":"6d5f8c7b9"}`)
+	targ := getTarget(ctrl, etc3.StrategyTypeCanary)
+	targ.CandidateRetries = 0
+	targ.EnsureCandidate()
+	var nce *target.NoCandidateError
+	assert.True(t, errors.As(targ.Err, &nce))
+	assert.Equal(t, "6d5f8c7b9", nce.Revision)
+}
+
+func TestBlueGreenCutoverReverted(t *testing.T) {
+	ctrl := newController(t)
+	c := ctrl.c
+	targ := getTarget(ctrl, etc3.StrategyTypeBlueGreen)
+	targ.EnsureCandidate().SnapshotTrafficState().InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, `[{"setWeight":0},{"pause":{}}]`, getStepsJSON(t, c))
+
+	// the Rollout is paused at the cutover, and degrades during the verification window
+	ctrl.degradeAfter = ctrl.reconciled + 2
+	recommended := "canary"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+	targ.SetNewBaseline()
+	assert.Error(t, targ.Err)
+	assert.Contains(t, targ.Err.Error(), "reverted cutover to canary")
+	assert.Equal(t, originalSteps, getStepsJSON(t, c))
+	assert.True(t, isAborted(getRollout(t, c)))
+}
+
+func TestSingleVersion(t *testing.T) {
+	ctrl := newController(t)
+	targ := getTarget(ctrl, etc3.StrategyTypePerformance)
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, originalSteps, getStepsJSON(t, ctrl.c))
+	assert.Equal(t, 0, ctrl.reconciled)
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Empty(t, vi.Candidates)
+
+	targ.Exp.Spec.VersionInfo = vi
+	targ.RecordAssessedVersion()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, "6d5f8c7b9", targ.Exp.GetAnnotations()[experiment.AssessedRevisionAnnotation])
+}
+
+func TestGetPhase(t *testing.T) {
+	ro := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"generation": int64(4)},
+		"status":   map[string]interface{}{"phase": "Paused", "observedGeneration": "3"},
+	}}
+	// the status is stale
+	assert.Equal(t, "", getPhase(ro))
+	unstructured.SetNestedField(ro.Object, int64(4), "status", "observedGeneration")
+	assert.Equal(t, PhasePaused, getPhase(ro))
+}
@@ -0,0 +1,261 @@
+// Package server implements the HTTP API of the handler service, which runs handler phases of experiments on request.
+//
+// The /start and /finish endpoints accept POST requests whose JSON body names an experiment, and run the respective phase of the handler for this experiment asynchronously.
+// Phases of the same experiment run one at a time, in the order in which they were requested.
+// The /status endpoint accepts GET requests whose namespace, name and phase query parameters name a phase of an experiment, and reports the state of the last requested run of this phase, including the error which failed it.
+// The /healthz and /readyz endpoints report the liveness and readiness of the service.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RunFunc runs the given phase (start or finish) of the handler for the experiment with the given namespace and name.
+// It returns the error which failed the phase, if any.
+type RunFunc func(phase string, namespace string, name string) error
+
+// Request is the body of requests to the /start and /finish endpoints.
+type Request struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// States of phases reported by the /status endpoint.
+const (
+	// StatePending is the state of a phase which waits for previously requested phases of its experiment to complete.
+	StatePending = "pending"
+	// StateRunning is the state of a phase which is running.
+	StateRunning = "running"
+	// StateSucceeded is the state of a phase which completed without error.
+	StateSucceeded = "succeeded"
+	// StateFailed is the state of a phase which failed.
+	StateFailed = "failed"
+)
+
+// Status is the body of responses of the /status endpoint.
+type Status struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Phase     string `json:"phase"`
+	State     string `json:"state"`
+	// Error is the error which failed the phase, if its state is failed.
+	Error string `json:"error,omitempty"`
+}
+
+// phaseKey identifies a phase of an experiment.
+type phaseKey struct {
+	types.NamespacedName
+	phase string
+}
+
+// Server runs handler phases of experiments on request.
+type Server struct {
+	run        RunFunc
+	httpServer *http.Server
+	runs       sync.WaitGroup // phases which are running or waiting to run
+	mu         sync.Mutex     // guards the fields below
+	// done channel of the last requested phase of each experiment
+	last map[types.NamespacedName]chan struct{}
+	// status of the last requested run of each phase of each experiment
+	status       map[phaseKey]*Status
+	shuttingDown bool
+}
+
+// Builder returns a server which runs handler phases using the given function.
+func Builder(run RunFunc) *Server {
+	return &Server{
+		run:    run,
+		last:   make(map[types.NamespacedName]chan struct{}),
+		status: make(map[phaseKey]*Status),
+	}
+}
+
+// Handler returns the HTTP handler of the server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", s.handlePhase("start"))
+	mux.HandleFunc("/finish", s.handlePhase("finish"))
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if s.isShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// ListenAndServe serves the HTTP API of the server at the given address.
+// It returns http.ErrServerClosed after the server is shut down.
+func (s *Server) ListenAndServe(addr string) error {
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	s.mu.Lock()
+	s.httpServer = httpServer
+	s.mu.Unlock()
+	return httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting requests, and waits for phases which are running or waiting to run to complete, or for the context to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	httpServer := s.httpServer
+	s.mu.Unlock()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("phases still running at shutdown; " + ctx.Err().Error())
+	}
+}
+
+// Wait waits for phases which are running or waiting to run to complete.
+func (s *Server) Wait() {
+	s.runs.Wait()
+}
+
+// isShuttingDown returns true if the server is shutting down.
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// handlePhase returns the HTTP handler function of the endpoint of the given phase.
+func (s *Server) handlePhase(phase string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := Request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body; "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" || req.Namespace == "" {
+			http.Error(w, "name and namespace of experiment need to be specified", http.StatusBadRequest)
+			return
+		}
+		if !s.enqueue(phase, types.NamespacedName{Namespace: req.Namespace, Name: req.Name}) {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// handleStatus is the HTTP handler function of the /status endpoint.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	key := phaseKey{
+		NamespacedName: types.NamespacedName{Namespace: query.Get("namespace"), Name: query.Get("name")},
+		phase:          query.Get("phase"),
+	}
+	if key.Name == "" || key.Namespace == "" || key.phase == "" {
+		http.Error(w, "name and namespace of experiment and phase need to be specified", http.StatusBadRequest)
+		return
+	}
+	status, ok := s.getStatus(key)
+	if !ok {
+		http.Error(w, "phase "+key.phase+" of experiment "+key.String()+" has not been requested", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// getStatus returns the status of the last requested run of the given phase, and false if this phase has not been requested.
+func (s *Server) getStatus(key phaseKey) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.status[key]
+	if !ok {
+		return Status{}, false
+	}
+	return *status, true
+}
+
+// setState sets the state of the given run of a phase, unless a later run of this phase has been requested; err is the error which failed the phase, if any.
+func (s *Server) setState(key phaseKey, status *Status, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status[key] != status {
+		return
+	}
+	status.State = state
+	if err != nil {
+		status.Error = err.Error()
+	}
+}
+
+// enqueue runs the given phase of the experiment asynchronously, after previously requested phases of this experiment complete.
+// It returns false if the server is shutting down, in which case the phase is not run.
+func (s *Server) enqueue(phase string, nn types.NamespacedName) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	prev := s.last[nn]
+	done := make(chan struct{})
+	s.last[nn] = done
+	key := phaseKey{NamespacedName: nn, phase: phase}
+	status := &Status{Name: nn.Name, Namespace: nn.Namespace, Phase: phase, State: StatePending}
+	s.status[key] = status
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		if prev != nil {
+			<-prev
+		}
+		log.WithFields(log.Fields{
+			"phase":      phase,
+			"experiment": nn.Name,
+			"namespace":  nn.Namespace,
+		}).Info("running phase")
+		s.setState(key, status, StateRunning, nil)
+		if err := s.run(phase, nn.Namespace, nn.Name); err != nil {
+			s.setState(key, status, StateFailed, err)
+		} else {
+			s.setState(key, status, StateSucceeded, nil)
+		}
+		s.mu.Lock()
+		if s.last[nn] == done {
+			delete(s.last, nn)
+		}
+		s.mu.Unlock()
+		close(done)
+	}()
+	return true
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder records the phases run by a server.
+type recorder struct {
+	mu   sync.Mutex
+	runs []string
+}
+
+func (r *recorder) run(phase string, namespace string, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs = append(r.runs, phase+" "+namespace+"/"+name)
+	return nil
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.runs...)
+}
+
+func post(t *testing.T, url string, body string) *http.Response {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Cannot post request", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestStartAndFinish(t *testing.T) {
+	r := &recorder{}
+	s := Builder(r.run)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	resp := post(t, ts.URL+"/start", `{"name": "myexp", "namespace": "default"}`)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	s.Wait()
+	resp = post(t, ts.URL+"/finish", `{"name": "myexp", "namespace": "default"}`)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	s.Wait()
+	assert.Equal(t, []string{"start default/myexp", "finish default/myexp"}, r.get())
+}
+
+func TestInvalidRequests(t *testing.T) {
+	r := &recorder{}
+	s := Builder(r.run)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/start")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp = post(t, ts.URL+"/start", `not json`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post(t, ts.URL+"/finish", `{"name": "myexp"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	s.Wait()
+	assert.Empty(t, r.get())
+}
+
+func TestPhasesOfExperimentRunInOrder(t *testing.T) {
+	release := make(chan struct{})
+	mu := sync.Mutex{}
+	runs := []string{}
+	s := Builder(func(phase string, namespace string, name string) error {
+		if phase == "start" && name == "myexp" {
+			// block the start phase of myexp until released
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		runs = append(runs, phase+" "+name)
+		return nil
+	})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	post(t, ts.URL+"/start", `{"name": "myexp", "namespace": "default"}`)
+	post(t, ts.URL+"/finish", `{"name": "myexp", "namespace": "default"}`)
+	post(t, ts.URL+"/start", `{"name": "otherexp", "namespace": "default"}`)
+	// phases of other experiments are not blocked
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(runs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	s.Wait()
+	assert.Equal(t, []string{"start otherexp", "start myexp", "finish myexp"}, runs)
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	r := &recorder{}
+	s := Builder(r.run)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(ts.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	resp, err = http.Get(ts.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	resp = post(t, ts.URL+"/start", `{"name": "myexp", "namespace": "default"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Empty(t, r.get())
+}
+
+func TestShutdownWaitsForPhases(t *testing.T) {
+	release := make(chan struct{})
+	s := Builder(func(phase string, namespace string, name string) error {
+		<-release
+		return nil
+	})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	post(t, ts.URL+"/start", `{"name": "myexp", "namespace": "default"}`)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, s.Shutdown(ctx))
+	close(release)
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+// getStatus gets the status of the given phase of default/myexp from the server at the given URL.
+func getStatus(t *testing.T, url string, phase string) (int, Status) {
+	resp, err := http.Get(url + "/status?namespace=default&name=myexp&phase=" + phase)
+	if err != nil {
+		t.Fatal("Cannot get status", err)
+	}
+	defer resp.Body.Close()
+	status := Status{}
+	if resp.StatusCode == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	}
+	return resp.StatusCode, status
+}
+
+func TestStatus(t *testing.T) {
+	release := make(chan struct{})
+	s := Builder(func(phase string, namespace string, name string) error {
+		if phase == "start" {
+			<-release
+			return errors.New("unable to fetch target")
+		}
+		return nil
+	})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	code, _ := getStatus(t, ts.URL, "start")
+	assert.Equal(t, http.StatusNotFound, code)
+	resp, err := http.Get(ts.URL + "/status?namespace=default&name=myexp")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	post(t, ts.URL+"/start", `{"name": "myexp", "namespace": "default"}`)
+	post(t, ts.URL+"/finish", `{"name": "myexp", "namespace": "default"}`)
+	assert.Eventually(t, func() bool {
+		_, status := getStatus(t, ts.URL, "start")
+		return status.State == StateRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	code, status := getStatus(t, ts.URL, "finish")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, Status{Name: "myexp", Namespace: "default", Phase: "finish", State: StatePending}, status)
+
+	close(release)
+	s.Wait()
+	_, status = getStatus(t, ts.URL, "start")
+	assert.Equal(t, Status{Name: "myexp", Namespace: "default", Phase: "start", State: StateFailed, Error: "unable to fetch target"}, status)
+	_, status = getStatus(t, ts.URL, "finish")
+	assert.Equal(t, StateSucceeded, status.State)
+	assert.Empty(t, status.Error)
+}
@@ -0,0 +1,464 @@
+package target
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/metrics"
+	"github.com/iter8-tools/iter8-kfserving-handler/tracing"
+)
+
+// LockAnnotation is the target annotation recording the experiment which has claimed the target.
+const LockAnnotation = "kfserving.iter8.tools/lock"
+
+// Lock identifies the experiment which has claimed a target.
+type Lock struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid"`
+}
+
+// Base holds the state shared by targets of each kind, along with helpers which instrument their operations and record their progress.
+// Targets embed Base, which provides their Error method; a target is expected to return early from its methods once Err is set.
+type Base struct {
+	// Err is the error accumulated by the target until this point, or nil if there is none.
+	Err error
+	// Exp is the experiment of the target.
+	Exp *experiment.Experiment
+	// K8sClient is the client of the cluster of the target.
+	K8sClient client.Client
+	// Retries is the number of retry attempts of fetch and readiness checks.
+	Retries uint
+	// Interval is the interval between retry attempts, in seconds.
+	Interval time.Duration
+	// CandidateRetries is the number of retry attempts while waiting for a candidate.
+	CandidateRetries uint
+	// VerifyRetries is the number of readiness checks after a BlueGreen cutover.
+	VerifyRetries uint
+	// Recorder records metrics of target operations; target operations are not instrumented if it is nil.
+	Recorder *metrics.Recorder
+	// Ctx carries the current span of the target.
+	Ctx context.Context
+	// Logger is the logger of the target.
+	Logger *log.Entry
+	// Resumable targets record progress markers of steps, and skip completed steps which are verified against the target.
+	Resumable bool
+	// Clock is the clock of retry loops.
+	Clock clock.Clock
+	// Kind prefixes the names of the spans of target operations, such as trainedmodel.
+	Kind string
+	// Noun names the object of the target in error messages, such as trained model.
+	Noun string
+	// self is the target which embeds Base; setters which are part of the Target interface return it.
+	self Target
+}
+
+// BaseBuilder returns the initial state of the given target, whose spans are prefixed by the given kind, and whose object is named by the given noun in error messages.
+// Fetch and readiness checks are retried for 180 sec, the target waits for 180 sec for a candidate, and BlueGreen cutovers are verified for 60 sec by default.
+func BaseBuilder(self Target, kind string, noun string) Base {
+	return Base{
+		self:             self,
+		Retries:          18,
+		Interval:         10,
+		CandidateRetries: 18,
+		VerifyRetries:    6,
+		Ctx:              context.Background(),
+		Logger:           log.NewEntry(log.StandardLogger()),
+		Clock:            clock.RealClock{},
+		Kind:             kind,
+		Noun:             noun,
+	}
+}
+
+// Error returns the error accumulated by target until this point or nil if there is none.
+func (b *Base) Error() error {
+	return b.Err
+}
+
+// SetK8sClient sets a k8s client within the target.
+func (b *Base) SetK8sClient(c client.Client) Target {
+	if b.Err == nil {
+		b.K8sClient = c
+	}
+	return b.self
+}
+
+// SetExperiment sets a pointer to an experiment object within the target.
+func (b *Base) SetExperiment(exp *experiment.Experiment) Target {
+	if b.Err == nil {
+		b.Exp = exp
+	}
+	return b.self
+}
+
+// SetRecorder sets a metrics recorder within the target; target operations are not instrumented if the recorder is nil.
+func (b *Base) SetRecorder(r *metrics.Recorder) *Base {
+	b.Recorder = r
+	return b
+}
+
+// SetContext sets the context within the target; spans of target operations are children of the span in this context.
+func (b *Base) SetContext(ctx context.Context) *Base {
+	b.Ctx = ctx
+	return b
+}
+
+// SetLogger sets the logger within the target; log entries of the target also carry the fields of its experiment.
+func (b *Base) SetLogger(l *log.Entry) *Base {
+	b.Logger = l
+	return b
+}
+
+// SetResumable sets whether the target records the completion of handler steps in the progress annotation of the experiment.
+func (b *Base) SetResumable(resumable bool) *Base {
+	b.Resumable = resumable
+	return b
+}
+
+// SetClock sets the clock used by the target while waiting between retries.
+func (b *Base) SetClock(c clock.Clock) *Base {
+	b.Clock = c
+	return b
+}
+
+// SetCandidateWait sets the maximum duration for which the target waits for a candidate.
+func (b *Base) SetCandidateWait(wait time.Duration) *Base {
+	b.CandidateRetries = b.retriesWithin(wait)
+	return b
+}
+
+// SetVerificationWindow sets the duration for which the readiness of the target is verified after a BlueGreen cutover.
+func (b *Base) SetVerificationWindow(window time.Duration) *Base {
+	b.VerifyRetries = b.retriesWithin(window)
+	return b
+}
+
+// retriesWithin is a helper function that returns the number of retry attempts of the target within the given duration.
+func (b *Base) retriesWithin(d time.Duration) uint {
+	return uint(d / b.retryInterval())
+}
+
+// retryInterval is a helper function that returns the interval between retry attempts of the target, which is at least 1 sec.
+func (b *Base) retryInterval() time.Duration {
+	if b.Interval < 1 {
+		return time.Second
+	}
+	return b.Interval * time.Second
+}
+
+// LogEntry returns the logger of the target, along with the fields of its experiment, if any.
+func (b *Base) LogEntry() *log.Entry {
+	if b.Exp == nil {
+		return b.Logger
+	}
+	return b.Logger.WithFields(b.Exp.LogFields())
+}
+
+// StartSpan starts a span for the named target operation, as a child of the current span of the target.
+// The returned function ends this span after recording the error of the target, if any.
+func (b *Base) StartSpan(name string) func() {
+	parent := b.Ctx
+	var span trace.Span
+	b.Ctx, span = tracing.Start(parent, b.Kind+"."+name)
+	return func() {
+		tracing.End(span, b.Err)
+		b.Ctx = parent
+	}
+}
+
+// Observe records the duration of the named target operation which started at the given time, along with its outcome.
+func (b *Base) Observe(op string, start time.Time, success bool) {
+	b.Recorder.Observe(op, start, success)
+}
+
+// Get gets an object from the Kubernetes cluster within a span.
+func (b *Base) Get(key client.ObjectKey, obj client.Object) error {
+	ctx, span := tracing.Start(b.Ctx, "k8s.Get", trace.WithAttributes(
+		label.String("k8s.kind", obj.GetObjectKind().GroupVersionKind().Kind),
+		label.String("k8s.namespace", key.Namespace),
+		label.String("k8s.name", key.Name),
+	))
+	err := b.K8sClient.Get(ctx, key, obj)
+	tracing.End(span, err)
+	return err
+}
+
+// Refetch gets the given object from the Kubernetes cluster again, in a single attempt, and returns the object which is fetched.
+func (b *Base) Refetch(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	fetched := &unstructured.Unstructured{}
+	fetched.SetGroupVersionKind(obj.GroupVersionKind())
+	err := b.Get(client.ObjectKeyFromObject(obj), fetched)
+	return fetched, err
+}
+
+// Patch patches an object in the Kubernetes cluster within a span.
+func (b *Base) Patch(obj client.Object, patch client.Patch) error {
+	ctx, span := tracing.Start(b.Ctx, "k8s.Patch", trace.WithAttributes(
+		label.String("k8s.kind", obj.GetObjectKind().GroupVersionKind().Kind),
+		label.String("k8s.namespace", obj.GetNamespace()),
+		label.String("k8s.name", obj.GetName()),
+		label.String("k8s.patch_type", string(patch.Type())),
+	))
+	if data, err := patch.Data(obj); err == nil {
+		b.LogEntry().WithField("patch", string(data)).Debug("patching ", obj.GetNamespace(), "/", obj.GetName())
+	}
+	err := b.K8sClient.Patch(ctx, obj, patch)
+	tracing.End(span, err)
+	return err
+}
+
+// PatchStatus patches the status of an object in the Kubernetes cluster within a span.
+func (b *Base) PatchStatus(obj client.Object, patch client.Patch) error {
+	ctx, span := tracing.Start(b.Ctx, "k8s.PatchStatus", trace.WithAttributes(
+		label.String("k8s.kind", obj.GetObjectKind().GroupVersionKind().Kind),
+		label.String("k8s.namespace", obj.GetNamespace()),
+		label.String("k8s.name", obj.GetName()),
+		label.String("k8s.patch_type", string(patch.Type())),
+	))
+	if data, err := patch.Data(obj); err == nil {
+		b.LogEntry().WithField("patch", string(data)).Debug("patching status of ", obj.GetNamespace(), "/", obj.GetName())
+	}
+	err := b.K8sClient.Status().Patch(ctx, obj, patch)
+	tracing.End(span, err)
+	return err
+}
+
+// SetAnnotation sets an annotation of the experiment within a span.
+func (b *Base) SetAnnotation(key string, value string) error {
+	ctx, span := tracing.Start(b.Ctx, "k8s.Patch", trace.WithAttributes(
+		label.String("k8s.kind", "Experiment"),
+		label.String("k8s.namespace", b.Exp.GetNamespace()),
+		label.String("k8s.name", b.Exp.GetName()),
+		label.String("k8s.annotation", key),
+	))
+	b.LogEntry().WithField("annotation", key).Debug("setting experiment annotation")
+	err := b.Exp.SetAnnotation(ctx, b.K8sClient, key, value)
+	tracing.End(span, err)
+	return err
+}
+
+// Poll returns true if the given condition holds now, or at one of the given number of checks which follow at the retry interval of the target.
+// Polling stops early if the target has an error.
+func (b *Base) Poll(retries uint, cond func() bool) bool {
+	if cond() {
+		return true
+	}
+	ticker := b.Clock.NewTicker(b.retryInterval())
+	defer ticker.Stop()
+	for i := 0; i < int(retries) && b.Err == nil; i++ {
+		select {
+		case <-ticker.C():
+			if cond() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CompletedSteps returns the steps recorded in the progress annotation of the experiment.
+func (b *Base) CompletedSteps() []string {
+	steps := []string{}
+	if progress, ok := b.Exp.GetAnnotations()[experiment.ProgressAnnotation]; ok {
+		if err := json.Unmarshal([]byte(progress), &steps); err != nil {
+			b.LogEntry().Warn("ignoring invalid progress annotation: ", err)
+			return []string{}
+		}
+	}
+	return steps
+}
+
+// IsCompleted returns true if the given step is recorded in the progress annotation of the experiment.
+func (b *Base) IsCompleted(step string) bool {
+	for _, s := range b.CompletedSteps() {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Resume returns true if the target is resumable, and the given step completed in an earlier run of the handler and its effect is verified by the given function; in this case, the step need not be run again.
+func (b *Base) Resume(step string, verify func() bool) bool {
+	if !b.Resumable || b.Exp == nil || !b.IsCompleted(step) {
+		return false
+	}
+	if verify() {
+		b.LogEntry().Info("skipping completed step ", step)
+		return true
+	}
+	b.LogEntry().Warn("live state of target does not match completed step ", step, "; running it again")
+	return false
+}
+
+// Complete records the completion of the given step in the progress annotation of the experiment, if the target is resumable and has no error.
+func (b *Base) Complete(step string) {
+	if !b.Resumable || b.Err != nil || b.Exp == nil || b.IsCompleted(step) {
+		return
+	}
+	progressBytes, err := json.Marshal(append(b.CompletedSteps(), step))
+	if err != nil {
+		b.Err = errors.New("unable to marshal progress of handler")
+		return
+	}
+	if err := b.SetAnnotation(experiment.ProgressAnnotation, string(progressBytes)); err != nil {
+		b.Err = errors.New("unable to record completion of step " + step + "; " + err.Error())
+	}
+}
+
+// GetLock returns the lock of the given object, or nil if the object is not claimed by any experiment.
+func GetLock(obj *unstructured.Unstructured) (*Lock, error) {
+	lockStr, ok := obj.GetAnnotations()[LockAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	lock := &Lock{}
+	if err := json.Unmarshal([]byte(lockStr), lock); err != nil {
+		return nil, errors.New("invalid lock annotation; " + err.Error())
+	}
+	return lock, nil
+}
+
+// isStale is a helper function that returns true if the experiment which holds the given lock has been deleted.
+func (b *Base) isStale(lock *Lock) (bool, error) {
+	exp := &etc3.Experiment{}
+	err := b.Get(client.ObjectKey{
+		Namespace: lock.Namespace,
+		Name:      lock.Name,
+	}, exp)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// an experiment with the same name may have been created after the deletion of the lock holder
+	return exp.GetUID() != lock.UID, nil
+}
+
+// setLock is a helper function that sets the lock annotation of the given object, or removes it if the given lock is nil.
+// The patch fails with a conflict if the object changed after it was fetched, so that concurrent claims do not overwrite each other.
+func (b *Base) setLock(obj *unstructured.Unstructured, lock *Lock) error {
+	var value interface{}
+	if lock != nil {
+		lockBytes, err := json.Marshal(lock)
+		if err != nil {
+			return errors.New("unable to marshal lock")
+		}
+		value = string(lockBytes)
+	}
+	payload := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": obj.GetResourceVersion(),
+			"annotations": map[string]interface{}{
+				LockAnnotation: value,
+			},
+		},
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.New("unable to marshal lock patch")
+	}
+	return b.Patch(obj, client.RawPatch(types.MergePatchType, payloadBytes))
+}
+
+// ClaimObject claims the given object of the target for the experiment by recording the experiment in the lock annotation of the object.
+// If the object is claimed by another experiment which still exists, the method sets a *LockedError.
+// Locks of deleted experiments are stale; they are taken over by the experiment.
+func (b *Base) ClaimObject(obj *unstructured.Unstructured) {
+	if b.Err != nil {
+		return
+	}
+	defer b.StartSpan("Claim")()
+	if b.Exp == nil {
+		b.Err = errors.New("method Claim called on a target with nil experiment")
+		return
+	}
+	if obj == nil {
+		b.Err = errors.New("unable to claim target; uninitialized " + b.Noun + " object")
+		return
+	}
+	owner := Lock{
+		Namespace: b.Exp.GetNamespace(),
+		Name:      b.Exp.GetName(),
+		UID:       b.Exp.GetUID(),
+	}
+	lock, err := GetLock(obj)
+	if err != nil {
+		b.Err = errors.New("unable to claim target; " + err.Error())
+		return
+	}
+	if lock != nil {
+		if *lock == owner {
+			// claimed in an earlier run of the handler
+			return
+		}
+		stale, err := b.isStale(lock)
+		if err != nil {
+			b.Err = errors.New("unable to check lock of target; " + err.Error())
+			return
+		}
+		if !stale {
+			b.Err = &LockedError{Namespace: lock.Namespace, Name: lock.Name}
+			return
+		}
+		b.LogEntry().Warn("taking over stale lock of deleted experiment ", lock.Namespace, "/", lock.Name)
+	}
+	if err := b.setLock(obj, &owner); err != nil {
+		b.Err = errors.New("unable to claim target; " + err.Error())
+	}
+}
+
+// ReleaseObject releases the claim of the experiment on the object of the target returned by the given function, by removing the lock annotation of the object.
+// The function fetches the target again, since it may have changed since it was fetched. Locks held by other experiments are left unchanged.
+// The claim is released even if the target has an error, in which case this error remains the error of the target.
+func (b *Base) ReleaseObject(fetch func() *unstructured.Unstructured) {
+	prior := b.Err
+	b.Err = nil
+	defer func() {
+		if prior == nil {
+			return
+		}
+		if b.Err != nil {
+			b.LogEntry().Warn(b.Err)
+		}
+		b.Err = prior
+	}()
+	defer b.StartSpan("Release")()
+	if b.Exp == nil {
+		b.Err = errors.New("method Release called on a target with nil experiment")
+		return
+	}
+	obj := fetch()
+	if b.Err != nil {
+		return
+	}
+	lock, err := GetLock(obj)
+	if err != nil {
+		b.Err = errors.New("unable to release target; " + err.Error())
+		return
+	}
+	if lock == nil {
+		return
+	}
+	if lock.Namespace != b.Exp.GetNamespace() || lock.Name != b.Exp.GetName() || lock.UID != b.Exp.GetUID() {
+		b.LogEntry().Warn("not releasing target claimed by experiment ", lock.Namespace, "/", lock.Name)
+		return
+	}
+	if err := b.setLock(obj, nil); err != nil {
+		b.Err = errors.New("unable to release target; " + err.Error())
+	}
+}
@@ -0,0 +1,23 @@
+package target
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetCandidateWait(t *testing.T) {
+	b := BaseBuilder(nil, "test", "test")
+	b.SetCandidateWait(60 * time.Second).SetVerificationWindow(30 * time.Second)
+	assert.Equal(t, uint(6), b.CandidateRetries)
+	assert.Equal(t, uint(3), b.VerifyRetries)
+}
+
+func TestSetCandidateWaitZeroInterval(t *testing.T) {
+	b := BaseBuilder(nil, "test", "test")
+	b.Interval = 0
+	b.SetCandidateWait(5 * time.Second).SetVerificationWindow(0)
+	assert.Equal(t, uint(5), b.CandidateRetries)
+	assert.Equal(t, uint(0), b.VerifyRetries)
+}
@@ -0,0 +1,250 @@
+package target
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+)
+
+// BaselineSteps are the kind-specific steps of setting the new baseline of a target, which are run by SetBaseline.
+type BaselineSteps struct {
+	// IsSet checks if the target is ready with the given recommended baseline as its new baseline.
+	IsSet func(recommended string) bool
+	// IsRestored checks if the target is ready with the traffic state recorded in the snapshot annotation of the experiment.
+	IsRestored func() bool
+	// Prepare runs before the new baseline is set, if it is not nil.
+	Prepare func()
+	// Restore restores the traffic state recorded in the snapshot annotation of the experiment.
+	Restore func()
+	// Shift shifts all traffic to the given recommended candidate in a single step.
+	// Experiments other than BlueGreen experiments only shift traffic if Promote is nil.
+	Shift func(recommended string)
+	// IsReady checks the readiness of the target during the verification window after a BlueGreen cutover.
+	IsReady func() bool
+	// Unready is the cause of a failed BlueGreen cutover, after which the target became un-ready.
+	Unready string
+	// Promote promotes the given recommended candidate after traffic is shifted to it, if it is not nil.
+	Promote func(recommended string)
+}
+
+// SetVersionInfo sets the version info returned by the given function in the experiment of the target.
+func (b *Base) SetVersionInfo(getVersionInfo func() (*etc3.VersionInfo, error)) {
+	if b.Err != nil {
+		return
+	}
+	defer b.StartSpan("SetVersionInfoInExperiment")()
+	defer func(start time.Time) {
+		b.Observe("set_version_info", start, b.Err == nil)
+	}(time.Now())
+	var vi *etc3.VersionInfo
+	vi, b.Err = getVersionInfo()
+	if b.Err != nil {
+		return
+	}
+	if b.Resume("SetVersionInfoInExperiment", func() bool { return reflect.DeepEqual(vi, b.Exp.Spec.VersionInfo) }) {
+		return
+	}
+	defer b.Complete("SetVersionInfoInExperiment")
+	if vi == nil {
+		b.Err = errors.New("Could not get versionInfo for experiment")
+		return
+	}
+	if !b.Exp.IsSingleVersion() && len(vi.Candidates) == 0 {
+		b.Err = errors.New("expected baseline and candidate; did not find candidate during GetVersionInfo")
+		return
+	}
+	payloadBytes, err := VersionInfoPatch(vi)
+	if err != nil {
+		b.Err = err
+		return
+	}
+	b.Err = b.Patch(b.Exp.Experiment, client.RawPatch(types.JSONPatchType, payloadBytes))
+}
+
+// SetBaseline sets the baseline recommended by the experiment as the new baseline of the given object of the target, by running the given steps.
+// The traffic state before the experiment is restored if the baseline is recommended, and all traffic is shifted to a recommended candidate otherwise; in BlueGreen experiments, this cutover is reverted if the target becomes un-ready during the verification window which follows it.
+func (b *Base) SetBaseline(obj *unstructured.Unstructured, steps BaselineSteps) {
+	if b.Err != nil {
+		return
+	}
+	defer b.StartSpan("SetNewBaseline")()
+	if b.Exp == nil {
+		b.Err = errors.New("method SetNewBaseline called on a target with nil experiment")
+		return
+	}
+	if b.Exp.IsSingleVersion() {
+		b.Err = errors.New("method SetNewBaseline called on a target with a single-version experiment")
+		return
+	}
+	if obj == nil {
+		b.Err = errors.New("unable to set new baseline; uninitialized " + b.Noun + " object")
+		return
+	}
+	recommendedBaseline, err := b.Exp.GetRecommendedBaseline()
+	if err != nil {
+		b.Err = errors.New("error in getting recommended baseline from experiment")
+		return
+	}
+	if b.Resume("SetNewBaseline", func() bool { return steps.IsSet(recommendedBaseline) }) {
+		return
+	}
+	if b.Exp.IsBlueGreen() && b.Resume("RevertCutover", steps.IsRestored) {
+		// do not attempt a cutover which was reverted in an earlier run again
+		b.Err = errors.New("reverted cutover to canary in an earlier run")
+		return
+	}
+	defer b.Complete("SetNewBaseline")
+	if steps.Prepare != nil {
+		if steps.Prepare(); b.Err != nil {
+			return
+		}
+	}
+	switch {
+	case recommendedBaseline == "default":
+		steps.Restore()
+		return
+	case b.Exp.IsBlueGreen():
+		b.cutover(recommendedBaseline, steps)
+	case steps.Promote == nil:
+		steps.Shift(recommendedBaseline)
+	}
+	if steps.Promote != nil {
+		steps.Promote(recommendedBaseline)
+	}
+}
+
+// verify is a helper function that checks the given condition at each of the given number of checks which follow at the retry interval of the target.
+// Returns true if the condition holds at each check and false otherwise.
+func (b *Base) verify(retries uint, cond func() bool) bool {
+	ticker := b.Clock.NewTicker(b.retryInterval())
+	defer ticker.Stop()
+	for i := 0; i < int(retries); i++ {
+		select {
+		case <-ticker.C():
+			if !cond() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cutover is a helper function that shifts all traffic of the target from baseline to the given recommended candidate in a single step.
+// The readiness of the target is verified for the verification window (60 sec by default) after this step.
+// If the target becomes un-ready, cutover restores the traffic state of the target before the experiment and returns after setting an error.
+func (b *Base) cutover(recommendedBaseline string, steps BaselineSteps) {
+	defer b.StartSpan("Cutover")()
+	steps.Shift(recommendedBaseline)
+	if b.Err == nil && b.verify(b.VerifyRetries, steps.IsReady) {
+		return
+	}
+	cause := steps.Unready
+	if b.Err != nil {
+		cause = b.Err.Error()
+	}
+	// revert to baseline
+	b.Err = nil
+	steps.Restore()
+	if b.Err != nil {
+		b.Err = errors.New("unable to revert cutover; " + b.Err.Error() + "; cutover failed: " + cause)
+		return
+	}
+	b.Complete("RevertCutover")
+	if b.Err != nil {
+		return
+	}
+	b.Err = errors.New("reverted cutover to canary; " + cause)
+}
+
+// RecordAssessed records the baseline tag with the given name, which identifies the version assessed in a single-version experiment, in the assessed revision annotation of the experiment.
+// It returns the recorded value, or an empty string if the target has an error.
+func (b *Base) RecordAssessed(tag string) string {
+	if b.Err != nil {
+		return ""
+	}
+	defer b.StartSpan("RecordAssessedVersion")()
+	if b.Exp == nil {
+		b.Err = errors.New("method RecordAssessedVersion called on a target with nil experiment")
+		return ""
+	}
+	if !b.Exp.IsSingleVersion() {
+		b.Err = errors.New("method RecordAssessedVersion called on a target with a multi-version experiment")
+		return ""
+	}
+	value, err := b.Exp.GetBaselineTag(tag)
+	if err != nil {
+		b.Err = errors.New("unable to get assessed " + tag + "; " + err.Error())
+		return ""
+	}
+	b.Err = b.SetAnnotation(experiment.AssessedRevisionAnnotation, value)
+	return value
+}
+
+// Snapshot records the snapshot returned by the given function for the given object of the target in the snapshot annotation of the experiment.
+// If the experiment already has a snapshot, it is left unchanged, since the traffic state of the target may have changed after the snapshot was recorded.
+func (b *Base) Snapshot(obj *unstructured.Unstructured, snapshot func() (interface{}, error)) {
+	if b.Err != nil {
+		return
+	}
+	defer b.StartSpan("SnapshotTrafficState")()
+	if b.Exp == nil {
+		b.Err = errors.New("method SnapshotTrafficState called on a target with nil experiment")
+		return
+	}
+	if obj == nil {
+		b.Err = errors.New("unable to snapshot traffic state; uninitialized " + b.Noun + " object")
+		return
+	}
+	if _, ok := b.Exp.GetAnnotations()[experiment.SnapshotAnnotation]; ok {
+		return
+	}
+	s, err := snapshot()
+	if err != nil {
+		b.Err = errors.New("unable to snapshot traffic state; " + err.Error())
+		return
+	}
+	snapshotBytes, err := json.Marshal(s)
+	if err != nil {
+		b.Err = errors.New("unable to marshal traffic state snapshot")
+		return
+	}
+	b.Err = b.SetAnnotation(experiment.SnapshotAnnotation, string(snapshotBytes))
+}
+
+// GetSnapshot unmarshals the snapshot annotation of the experiment into the given snapshot.
+// It returns false if the experiment has no snapshot.
+func (b *Base) GetSnapshot(snapshot interface{}) (bool, error) {
+	snapshotStr, ok := b.Exp.GetAnnotations()[experiment.SnapshotAnnotation]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal([]byte(snapshotStr), snapshot); err != nil {
+		return true, errors.New("unable to unmarshal traffic state snapshot; " + err.Error())
+	}
+	return true, nil
+}
+
+// Restore restores the traffic state of the given object of the target recorded in the snapshot annotation of the experiment, by running the given function.
+func (b *Base) Restore(obj *unstructured.Unstructured, restore func()) {
+	if b.Err != nil {
+		return
+	}
+	defer b.StartSpan("RestoreTrafficState")()
+	if b.Exp == nil {
+		b.Err = errors.New("method RestoreTrafficState called on a target with nil experiment")
+		return
+	}
+	if obj == nil {
+		b.Err = errors.New("unable to restore traffic state; uninitialized " + b.Noun + " object")
+		return
+	}
+	restore()
+}
@@ -0,0 +1,79 @@
+package target
+
+import (
+	"errors"
+	"testing"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+)
+
+// baselineTarget returns a target of an experiment with the given strategy, whose recommended baseline is the given version.
+func baselineTarget(strategy etc3.StrategyType, recommended string) *Base {
+	b := BaseBuilder(nil, "test", "test")
+	exp := &etc3.Experiment{}
+	exp.Spec.Strategy.Type = strategy
+	exp.Status.RecommendedBaseline = &recommended
+	b.Exp = experiment.Builder(exp)
+	b.SetVerificationWindow(0)
+	return &b
+}
+
+// recordingSteps returns steps of setting a new baseline which record the names of the steps which run; Shift fails with the given error.
+func recordingSteps(ran *[]string, shiftErr error, b *Base) BaselineSteps {
+	return BaselineSteps{
+		IsSet:      func(string) bool { return false },
+		IsRestored: func() bool { return false },
+		Restore:    func() { *ran = append(*ran, "Restore") },
+		Shift: func(recommended string) {
+			*ran = append(*ran, "Shift "+recommended)
+			b.Err = shiftErr
+		},
+		IsReady: func() bool { return true },
+		Unready: "un-ready",
+	}
+}
+
+func TestSetBaseline(t *testing.T) {
+	for _, tc := range []struct {
+		strategy    etc3.StrategyType
+		recommended string
+		promote     bool
+		ran         []string
+	}{
+		{etc3.StrategyTypeCanary, "default", false, []string{"Restore"}},
+		{etc3.StrategyTypeCanary, "canary", false, []string{"Shift canary"}},
+		{etc3.StrategyTypeCanary, "canary", true, []string{"Promote canary"}},
+		{etc3.StrategyTypeBlueGreen, "canary", false, []string{"Shift canary"}},
+		{etc3.StrategyTypeBlueGreen, "canary", true, []string{"Shift canary", "Promote canary"}},
+	} {
+		b := baselineTarget(tc.strategy, tc.recommended)
+		ran := []string{}
+		steps := recordingSteps(&ran, nil, b)
+		if tc.promote {
+			steps.Promote = func(recommended string) { ran = append(ran, "Promote "+recommended) }
+		}
+		b.SetBaseline(&unstructured.Unstructured{}, steps)
+		assert.NoError(t, b.Err)
+		assert.Equal(t, tc.ran, ran)
+	}
+}
+
+func TestSetBaselineRevertsCutover(t *testing.T) {
+	b := baselineTarget(etc3.StrategyTypeBlueGreen, "canary")
+	ran := []string{}
+	b.SetBaseline(&unstructured.Unstructured{}, recordingSteps(&ran, errors.New("shift failed"), b))
+	assert.EqualError(t, b.Err, "reverted cutover to canary; shift failed")
+	assert.Equal(t, []string{"Shift canary", "Restore"}, ran)
+}
+
+func TestSetBaselineUninitialized(t *testing.T) {
+	b := baselineTarget(etc3.StrategyTypeCanary, "canary")
+	ran := []string{}
+	b.SetBaseline(nil, recordingSteps(&ran, nil, b))
+	assert.EqualError(t, b.Err, "unable to set new baseline; uninitialized test object")
+	assert.Empty(t, ran)
+}
@@ -0,0 +1,99 @@
+package target
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ObjectKind is the kind of the objects which are the targets of experiments on a kind of target, such as TrainedModels.
+// Target references name this kind by its kind, its resource or one of its short names, optionally qualified by its API group, such as trainedmodels.serving.kubeflow.org/<namespace>/<name>.
+type ObjectKind struct {
+	// GVK is the group version kind of the objects.
+	GVK schema.GroupVersionKind
+	// Resource is the plural resource name of the objects, such as trainedmodels.
+	Resource string
+	// ShortNames are the short names of the objects, such as tm.
+	ShortNames []string
+}
+
+// Matches returns true if the given reference has this kind.
+func (k *ObjectKind) Matches(ref *Ref) bool {
+	resource, group := ref.Resource()
+	if group != "" && group != k.GVK.Group {
+		return false
+	}
+	resource = strings.ToLower(resource)
+	if resource == strings.ToLower(k.GVK.Kind) || resource == k.Resource {
+		return true
+	}
+	for _, name := range k.ShortNames {
+		if resource == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRef returns true if the given target reference is valid and has this kind.
+func (k *ObjectKind) IsRef(targetRef string) bool {
+	ref, err := ParseRef(targetRef)
+	return err == nil && k.Matches(ref)
+}
+
+// ParseRef parses the given target reference, and returns an error if it is invalid or does not have this kind.
+func (k *ObjectKind) ParseRef(targetRef string) (*Ref, error) {
+	ref, err := ParseRef(targetRef)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Kind == "" {
+		return nil, errors.New("target reference has no kind")
+	}
+	if !k.Matches(ref) {
+		return nil, errors.New("target kind " + ref.Kind + " is not " + k.GVK.Kind)
+	}
+	return ref, nil
+}
+
+// GetObject gets the object of the given kind with the given namespace and name from the Kubernetes cluster, in a single attempt.
+func (b *Base) GetObject(gvk schema.GroupVersionKind, namespace string, name string) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	err := b.Get(client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}, obj)
+	return obj, err
+}
+
+// FetchObject fetches the object of the given kind named by the given target reference from the Kubernetes cluster, and returns it.
+// The object may be unavailable at the start of this call. So, FetchObject periodically attempts to fetch it for 180 sec.
+// If it does not succeed in 180 secs, the method returns nil after setting an error.
+func (b *Base) FetchObject(k *ObjectKind, targetRef string) (obj *unstructured.Unstructured) {
+	if b.Err != nil {
+		return nil
+	}
+	defer b.StartSpan("Fetch")()
+	defer func(start time.Time) {
+		b.Observe("fetch", start, b.Err == nil)
+	}(time.Now())
+	ref, err := k.ParseRef(targetRef)
+	if err != nil {
+		b.Err = errors.New("invalid target specification; " + k.GVK.Kind + " target needs to be of the form: '" + k.Resource + "/namespace/name'; " + err.Error())
+		return nil
+	}
+	fetched := b.Poll(b.Retries, func() bool {
+		obj, err = b.GetObject(k.GVK, ref.Namespace, ref.Name)
+		return err == nil
+	})
+	if !fetched {
+		b.Err = errors.New("unable to fetch target; " + err.Error())
+		return nil
+	}
+	return obj
+}
@@ -0,0 +1,66 @@
+package target
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// widgetKind is the kind of the objects of the tests of ObjectKind.
+var widgetKind = &ObjectKind{
+	GVK: schema.GroupVersionKind{
+		Group:   "example.com",
+		Version: "v1",
+		Kind:    "Widget",
+	},
+	Resource:   "widgets",
+	ShortNames: []string{"wd"},
+}
+
+func TestObjectKindIsRef(t *testing.T) {
+	for ref, expected := range map[string]bool{
+		"widgets/default/w":             true,
+		"Widget/default/w":              true,
+		"wd/default/w":                  true,
+		"widgets.example.com/default/w": true,
+		"widgets.example.org/default/w": false,
+		"default/w":                     false,
+		"gadgets/default/w":             false,
+		"widgets/default":               false,
+	} {
+		assert.Equal(t, expected, widgetKind.IsRef(ref), ref)
+	}
+}
+
+func TestObjectKindParseRef(t *testing.T) {
+	ref, err := widgetKind.ParseRef("wd/default/w")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{Kind: "wd", Namespace: "default", Name: "w"}, ref)
+	_, err = widgetKind.ParseRef("gadgets/default/w")
+	assert.EqualError(t, err, "target kind gadgets is not Widget")
+}
+
+func TestFetchObject(t *testing.T) {
+	w := &unstructured.Unstructured{}
+	w.SetGroupVersionKind(widgetKind.GVK)
+	w.SetNamespace("default")
+	w.SetName("w")
+	c := fake.NewClientBuilder().WithScheme(runtime.NewScheme()).WithObjects(w).Build()
+	b := BaseBuilder(nil, "test", "test")
+	b.K8sClient = c
+	obj := b.FetchObject(widgetKind, "widgets/default/w")
+	assert.NoError(t, b.Err)
+	assert.Equal(t, "w", obj.GetName())
+
+	b.Retries = 0
+	assert.Nil(t, b.FetchObject(widgetKind, "widgets/default/missing"))
+	assert.Contains(t, b.Err.Error(), "unable to fetch target; ")
+
+	b.Err = nil
+	assert.Nil(t, b.FetchObject(widgetKind, "default/w"))
+	assert.EqualError(t, b.Err, "invalid target specification; Widget target needs to be of the form: 'widgets/namespace/name'; target reference has no kind")
+}
@@ -0,0 +1,78 @@
+package target
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// kindRegexp matches kinds and resources of Kubernetes objects without their API group, which are alphanumeric and start with a letter.
+var kindRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// Ref is a reference to the target of an experiment.
+// Its string form is [<kind>/]<namespace>/<name>, where kind is optional.
+type Ref struct {
+	// Kind is the kind or resource of the target, optionally qualified by its API group, such as InferenceService or inferenceservices.serving.kubeflow.org; it is empty if the reference has no kind prefix.
+	Kind string
+	// Namespace is the namespace of the target; it must be a DNS-1123 label.
+	Namespace string
+	// Name is the name of the target; it must be a DNS-1123 subdomain.
+	Name string
+}
+
+// ParseRef parses and validates a reference of the form [<kind>/]<namespace>/<name> to the target of an experiment.
+func ParseRef(ref string) (*Ref, error) {
+	parts := strings.Split(ref, "/")
+	r := &Ref{}
+	switch len(parts) {
+	case 2:
+		r.Namespace, r.Name = parts[0], parts[1]
+	case 3:
+		r.Kind, r.Namespace, r.Name = parts[0], parts[1], parts[2]
+		if err := validateKind(r.Kind); err != nil {
+			return nil, errors.New("invalid target reference " + ref + "; " + err.Error())
+		}
+	default:
+		return nil, errors.New("invalid target reference " + ref + "; expected [<kind>/]<namespace>/<name>")
+	}
+	if errs := validation.IsDNS1123Label(r.Namespace); len(errs) > 0 {
+		return nil, errors.New("invalid namespace in target reference " + ref + "; " + strings.Join(errs, "; "))
+	}
+	if errs := validation.IsDNS1123Subdomain(r.Name); len(errs) > 0 {
+		return nil, errors.New("invalid name in target reference " + ref + "; " + strings.Join(errs, "; "))
+	}
+	return r, nil
+}
+
+// validateKind is a helper function that returns an error if the given kind is not alphanumeric, optionally qualified by a valid API group.
+func validateKind(kind string) error {
+	resource, group := kind, ""
+	if i := strings.Index(kind, "."); i >= 0 {
+		resource, group = kind[:i], kind[i+1:]
+		if errs := validation.IsDNS1123Subdomain(group); len(errs) > 0 {
+			return errors.New("invalid group of kind " + kind + "; " + strings.Join(errs, "; "))
+		}
+	}
+	if !kindRegexp.MatchString(resource) {
+		return errors.New("invalid kind " + kind + "; kinds must be alphanumeric and start with a letter")
+	}
+	return nil
+}
+
+// Resource returns the kind of the reference without its API group, along with the API group, which is empty if the kind is not qualified.
+func (r *Ref) Resource() (string, string) {
+	if i := strings.Index(r.Kind, "."); i >= 0 {
+		return r.Kind[:i], r.Kind[i+1:]
+	}
+	return r.Kind, ""
+}
+
+// String returns the reference in the form [<kind>/]<namespace>/<name>.
+func (r *Ref) String() string {
+	if r.Kind == "" {
+		return r.Namespace + "/" + r.Name
+	}
+	return r.Kind + "/" + r.Namespace + "/" + r.Name
+}
@@ -0,0 +1,113 @@
+package target
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestParseRef(t *testing.T) {
+	r, err := ParseRef("myns/myname")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{Namespace: "myns", Name: "myname"}, r)
+
+	r, err = ParseRef("inferenceservices.serving.kubeflow.org/myns/my.name")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{Kind: "inferenceservices.serving.kubeflow.org", Namespace: "myns", Name: "my.name"}, r)
+	resource, group := r.Resource()
+	assert.Equal(t, "inferenceservices", resource)
+	assert.Equal(t, "serving.kubeflow.org", group)
+
+	for _, ref := range []string{
+		"",
+		"myname",
+		"/myname",
+		"myns/",
+		"a/b/c/myname",
+		"MyNs/myname",
+		"myns/my_name",
+		"my.ns/myname",
+		"myns/" + strings.Repeat("a", 254),
+		"1kind/myns/myname",
+		"kind-x/myns/myname",
+		"kind.Group/myns/myname",
+	} {
+		_, err := ParseRef(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+// validRef is a random valid target reference.
+type validRef Ref
+
+// dnsLabel returns a random DNS-1123 label.
+func dnsLabel(rand *rand.Rand) string {
+	const alnum = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 1+rand.Intn(20))
+	for i := range b {
+		if i > 0 && i < len(b)-1 && rand.Intn(5) == 0 {
+			b[i] = '-'
+		} else {
+			b[i] = alnum[rand.Intn(len(alnum))]
+		}
+	}
+	return string(b)
+}
+
+// Generate returns a random valid target reference, with or without a kind.
+func (validRef) Generate(rand *rand.Rand, size int) reflect.Value {
+	r := validRef{Namespace: dnsLabel(rand), Name: dnsLabel(rand) + "." + dnsLabel(rand)}
+	switch rand.Intn(3) {
+	case 1:
+		r.Kind = "InferenceService"
+	case 2:
+		r.Kind = "inferenceservices." + dnsLabel(rand) + ".io"
+	}
+	return reflect.ValueOf(r)
+}
+
+func TestParseRefRoundTrips(t *testing.T) {
+	// valid references are parsed into themselves
+	err := quick.Check(func(v validRef) bool {
+		r := Ref(v)
+		parsed, err := ParseRef(r.String())
+		return err == nil && *parsed == r
+	}, nil)
+	assert.NoError(t, err)
+
+	// arbitrary strings are rejected, or parsed into a valid reference with the same string form
+	err = quick.Check(func(s string) bool {
+		r, err := ParseRef(s)
+		return err != nil || (r.String() == s && len(validation.IsDNS1123Label(r.Namespace)) == 0)
+	}, nil)
+	assert.NoError(t, err)
+}
+
+func TestParseRefInvariants(t *testing.T) {
+	for _, ref := range []string{
+		"myns/myname",
+		"InferenceService/myns/myname",
+		"inferenceservices.serving.kubeflow.org/myns/my.name",
+		"a/b/c/myname",
+		"",
+		"/",
+		"MyNs/myname",
+	} {
+		r, err := ParseRef(ref)
+		if err != nil {
+			continue
+		}
+		// accepted references are valid, and parsed into themselves
+		assert.Equal(t, ref, r.String())
+		assert.Empty(t, validation.IsDNS1123Label(r.Namespace), ref)
+		assert.Empty(t, validation.IsDNS1123Subdomain(r.Name), ref)
+		if r.Kind != "" {
+			assert.NoError(t, validateKind(r.Kind), ref)
+		}
+	}
+}
@@ -1,11 +1,21 @@
 // Package target provides types and methods for targets of iter8 experiments.
+//
+// The start phase claims the target for the experiment by recording the experiment in the target annotation kfserving.iter8.tools/lock, and fails if the target is claimed by another experiment which still exists. The finish phase releases this claim, as does a start phase which fails after claiming the target.
+//
+// The start phase records the traffic state of the target in the experiment annotation kfserving.iter8.tools/snapshot, which the finish phase restores when the baseline wins. In BlueGreen experiments, the finish phase shifts all traffic to a winning candidate in a single step, and reverts this cutover if the target becomes un-ready during the verification window which follows it.
+//
+// Each phase records the steps it completes in the experiment annotation kfserving.iter8.tools/progress. If a phase is run again for an experiment, completed steps whose effect is verified against the target are skipped.
 package target
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 
 	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
 	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -15,10 +25,40 @@ type Target interface {
 	InitializeTrafficSplit() Target
 	GetVersionInfo() (*etc3.VersionInfo, error)
 	SetNewBaseline() Target
+	RecordAssessedVersion() Target
 	SetExperiment(exp *experiment.Experiment) Target
 	SetK8sClient(c client.Client) Target
 	Fetch(targetRef string) Target
+	EnsureCandidate() Target
+	SnapshotTrafficState() Target
+	RestoreTrafficState() Target
 	SetVersionInfoInExperiment() Target
+	Claim() Target
+	Release() Target
+}
+
+// NoCandidateError is the error set by a target which does not have a candidate version distinct from its baseline version.
+type NoCandidateError struct {
+	// Revision is the revision found to be both the baseline and the latest revision of the target.
+	Revision string
+}
+
+// Error returns the error message for NoCandidateError.
+func (e *NoCandidateError) Error() string {
+	return "no candidate revision found; latest created revision " + e.Revision + " is the baseline revision"
+}
+
+// LockedError is the error set by a target which is claimed by another live experiment.
+type LockedError struct {
+	// Namespace is the namespace of the experiment which holds the target.
+	Namespace string
+	// Name is the name of the experiment which holds the target.
+	Name string
+}
+
+// Error returns the error message for LockedError.
+func (e *LockedError) Error() string {
+	return "target is claimed by experiment " + e.Namespace + "/" + e.Name + "; only one experiment can run on a target at a time"
 }
 
 // PatchInt64Value specifies the patch data needed to patch a int64 field.
@@ -46,3 +86,57 @@ func GetCondition(cond []Condition, ctype string) (string, error) {
 	}
 	return "", errors.New("Non existing condition")
 }
+
+// VersionInfoPatch returns the JSON patch of an experiment which replaces its versionInfo with the given versionInfo.
+func VersionInfoPatch(vi *etc3.VersionInfo) ([]byte, error) {
+	payload := []struct {
+		Op    string            `json:"op"`
+		Path  string            `json:"path"`
+		Value *etc3.VersionInfo `json:"value"`
+	}{{"replace", "/spec/versionInfo", vi}}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.New("unable to marshal experiment versionInfo patch")
+	}
+	return payloadBytes, nil
+}
+
+// WeightsPatch returns the JSON patch of the given object which sets the given weights of the entries of one element of a list of the object, or nil if no change is needed.
+// The list is found at the given path, such as spec.http, its element has the given index, and the entries are found at the given field of this element, such as route. There needs to be one weight for each entry; weights which are nil remove the weight of the entry, if present.
+func WeightsPatch(obj map[string]interface{}, path []string, index int, field string, weights []*int64) ([]byte, error) {
+	type op struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value *int64 `json:"value,omitempty"`
+	}
+	prefix := "/" + strings.Join(path, "/")
+	elems, _, _ := unstructured.NestedSlice(obj, path...)
+	if index >= len(elems) {
+		return nil, errors.New("no element with index " + fmt.Sprint(index) + " in " + prefix)
+	}
+	elem, _ := elems[index].(map[string]interface{})
+	entries, _, _ := unstructured.NestedSlice(elem, field)
+	if len(weights) != len(entries) {
+		return nil, errors.New(prefix + "/" + fmt.Sprint(index) + "/" + field + " has " + fmt.Sprint(len(entries)) + " entries; unable to set " + fmt.Sprint(len(weights)) + " weights")
+	}
+	payload := []op{}
+	for j, w := range weights {
+		entryPath := fmt.Sprintf("%s/%d/%s/%d/weight", prefix, index, field, j)
+		entry, _ := entries[j].(map[string]interface{})
+		current, found, _ := unstructured.NestedInt64(entry, "weight")
+		if w != nil && (!found || current != *w) {
+			payload = append(payload, op{"add", entryPath, w})
+		}
+		if w == nil && found {
+			payload = append(payload, op{Op: "remove", Path: entryPath})
+		}
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.New("unable to marshal weights patch")
+	}
+	return payloadBytes, nil
+}
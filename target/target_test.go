@@ -17,3 +17,42 @@ func TestGetCondition(t *testing.T) {
 	assert.NoError(t, e2)
 	assert.Error(t, e3)
 }
+
+func TestNoCandidateError(t *testing.T) {
+	var err error = &NoCandidateError{Revision: "my-model-predictor-default-wl2cv"}
+	assert.Contains(t, err.Error(), "my-model-predictor-default-wl2cv")
+}
+
+func TestLockedError(t *testing.T) {
+	var err error = &LockedError{Namespace: "default", Name: "myexp"}
+	assert.Contains(t, err.Error(), "default/myexp")
+}
+
+func TestWeightsPatch(t *testing.T) {
+	obj := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"http": []interface{}{map[string]interface{}{
+				"route": []interface{}{
+					map[string]interface{}{"weight": int64(100)},
+					map[string]interface{}{},
+				},
+			}},
+		},
+	}
+	path := []string{"spec", "http"}
+	p := int64(5)
+	patch, err := WeightsPatch(obj, path, 0, "route", []*int64{nil, &p})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"op":"remove","path":"/spec/http/0/route/0/weight"},{"op":"add","path":"/spec/http/0/route/1/weight","value":5}]`, string(patch))
+
+	// no change is needed to keep the weights
+	full := int64(100)
+	patch, err = WeightsPatch(obj, path, 0, "route", []*int64{&full, nil})
+	assert.NoError(t, err)
+	assert.Nil(t, patch)
+
+	_, err = WeightsPatch(obj, path, 1, "route", []*int64{&p, &p})
+	assert.EqualError(t, err, "no element with index 1 in /spec/http")
+	_, err = WeightsPatch(obj, path, 0, "route", []*int64{&p})
+	assert.EqualError(t, err, "/spec/http/0/route has 2 entries; unable to set 1 weights")
+}
@@ -0,0 +1,109 @@
+// Package targettest provides utilities for tests of targets, which run against a fake Kubernetes cluster populated from the files in the testdata directory.
+package targettest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/iter8-tools/iter8ctl/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+)
+
+// NewClient returns a fake Kubernetes client with the objects in the given files of the testdata directory.
+func NewClient(t *testing.T, filePaths ...string) client.Client {
+	objs := []client.Object{}
+	for _, filePath := range filePaths {
+		data, err := ioutil.ReadFile(utils.CompletePath("../../testdata", filePath))
+		if err != nil {
+			t.Fatal("Cannot read object from file", err)
+		}
+		u := &unstructured.Unstructured{
+			Object: make(map[string]interface{}),
+		}
+		if err = json.Unmarshal(data, &u.Object); err != nil {
+			t.Fatal("Cannot unmarshal object", err)
+		}
+		objs = append(objs, u)
+	}
+	scheme := runtime.NewScheme()
+	etc3.AddToScheme(scheme)
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+// NewExperiment creates the experiment default/myexp on the given target with the given strategy and annotations in the given client, and returns it.
+// The annotations are copied, since the experiment changes its annotations in place.
+func NewExperiment(t *testing.T, c client.Client, targetRef string, strategy etc3.StrategyType, annotations map[string]string) *experiment.Experiment {
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget(targetRef).
+		WithStrategy(strategy).
+		Build()
+	copied := map[string]string{}
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	exp.SetAnnotations(copied)
+	if err := c.Create(context.Background(), exp); err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	return experiment.Builder(exp)
+}
+
+// Fetch fetches the given target for the given experiment in the given client, and fails the test if the target cannot be fetched.
+func Fetch(t *testing.T, targ target.Target, c client.Client, exp *experiment.Experiment) {
+	targ.SetK8sClient(c).SetExperiment(exp).Fetch(exp.GetTargetRef())
+	if err := targ.Error(); err != nil {
+		t.Fatal("Cannot fetch target", err)
+	}
+}
+
+// SteppingClock is a fake clock whose tickers tick as soon as they are waited on, after advancing the clock by their period.
+// So, retry loops run without waiting, and the virtual time which elapses during a loop is exactly the number of retries times their interval.
+type SteppingClock struct {
+	*clock.FakeClock
+	// OnTick is called before each tick, if it is not nil; tests use it to change the cluster while a target waits.
+	OnTick func()
+}
+
+// NewSteppingClock returns a stepping clock.
+func NewSteppingClock() *SteppingClock {
+	return &SteppingClock{FakeClock: clock.NewFakeClock(time.Date(2021, 1, 12, 0, 0, 0, 0, time.UTC))}
+}
+
+// NewTicker returns a ticker of the clock with the given period.
+func (c *SteppingClock) NewTicker(d time.Duration) clock.Ticker {
+	return &steppingTicker{clock: c, period: d, c: make(chan time.Time, 1)}
+}
+
+// steppingTicker is a ticker of a SteppingClock.
+type steppingTicker struct {
+	clock  *SteppingClock
+	period time.Duration
+	c      chan time.Time
+}
+
+// C advances the clock by the period of the ticker and returns a channel with a pending tick.
+func (t *steppingTicker) C() <-chan time.Time {
+	if t.clock.OnTick != nil {
+		t.clock.OnTick()
+	}
+	t.clock.Step(t.period)
+	select {
+	case t.c <- t.clock.Now():
+	default:
+	}
+	return t.c
+}
+
+// Stop does nothing, since the ticker ticks only when it is waited on.
+func (t *steppingTicker) Stop() {}
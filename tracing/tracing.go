@@ -0,0 +1,79 @@
+// Package tracing enables tracing of handler runs with OpenTelemetry.
+//
+// Spans are exported over OTLP (gRPC). The trace context of a handler run is propagated from the annotations of its experiment, so that spans of the handler line up with those of the controller which created the experiment.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the name of the service in spans exported by the handler.
+const ServiceName = "iter8-kfserving-handler"
+
+// AnnotationPrefix is the prefix of experiment annotations carrying the W3C trace context, i.e., iter8.tools/traceparent and iter8.tools/tracestate.
+const AnnotationPrefix = "iter8.tools/"
+
+// Init sets up a tracer provider which exports spans over OTLP to the collector at the given endpoint.
+// The returned function flushes pending spans and shuts down the tracer provider.
+func Init(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(
+		otlpgrpc.WithEndpoint(endpoint),
+		otlpgrpc.WithInsecure(),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the tracer used by the handler.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/iter8-tools/iter8-kfserving-handler")
+}
+
+// Start starts a span with the given name, as a child of the span in the given context.
+func Start(ctx context.Context, name string, opts ...trace.SpanOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End ends the given span, after recording the given error if it is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// annotationCarrier enables propagation of trace context through annotations.
+type annotationCarrier map[string]string
+
+// Get returns the value of the annotation for the given trace context key.
+func (a annotationCarrier) Get(key string) string {
+	return a[AnnotationPrefix+key]
+}
+
+// Set sets the annotation for the given trace context key.
+func (a annotationCarrier) Set(key string, value string) {
+	a[AnnotationPrefix+key] = value
+}
+
+// ContextFromAnnotations returns a copy of the given context carrying the trace context propagated in the given annotations, if any.
+func ContextFromAnnotations(ctx context.Context, annotations map[string]string) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, annotationCarrier(annotations))
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/oteltest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartEnd(t *testing.T) {
+	sr := new(oteltest.StandardSpanRecorder)
+	otel.SetTracerProvider(oteltest.NewTracerProvider(oteltest.WithSpanRecorder(sr)))
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("child failed"))
+	End(parent, nil)
+
+	spans := sr.Completed()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].StatusCode())
+	assert.Len(t, spans[0].Events(), 1)
+	assert.Equal(t, parent.SpanContext().SpanID, spans[0].ParentSpanID())
+	assert.Equal(t, "parent", spans[1].Name())
+	assert.Equal(t, codes.Unset, spans[1].StatusCode())
+}
+
+func TestContextFromAnnotations(t *testing.T) {
+	annotations := map[string]string{
+		"iter8.tools/traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	ctx := ContextFromAnnotations(context.Background(), annotations)
+	sc := trace.RemoteSpanContextFromContext(ctx)
+	assert.True(t, sc.IsValid())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+}
+
+func TestContextFromAnnotationsNone(t *testing.T) {
+	ctx := ContextFromAnnotations(context.Background(), nil)
+	assert.False(t, trace.RemoteSpanContextFromContext(ctx).IsValid())
+}
+
+func TestInit(t *testing.T) {
+	// the exporter connects to the collector in the background
+	shutdown, err := Init(context.Background(), "localhost:4317")
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
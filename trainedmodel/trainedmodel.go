@@ -0,0 +1,508 @@
+// Package trainedmodel provides types and methods for experiments on KFServing TrainedModel objects, which serve models on shared InferenceServices in multi-model serving.
+//
+// Versions of a model are distinct TrainedModels. The target of an experiment is the baseline TrainedModel, referred to as trainedmodels/<namespace>/<name>, and the experiment annotation kfserving.iter8.tools/candidate names the candidate TrainedModel in the same namespace.
+//
+// TrainedModels do not split traffic. Instead, requests are routed to the versions by a router, which is an Istio VirtualService in the namespace of the target named by the experiment annotation kfserving.iter8.tools/router. The http route of the router named after the baseline TrainedModel routes requests to the baseline through its first destination, and to the candidate through its second destination; the target splits traffic by setting the weights of these destinations.
+package trainedmodel
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/tracing"
+)
+
+// Kind is the kind of TrainedModels, which are referred to as trainedmodels/<namespace>/<name>.
+var Kind = &target.ObjectKind{
+	GVK: schema.GroupVersionKind{
+		Group:   "serving.kubeflow.org",
+		Version: "v1alpha1",
+		Kind:    "TrainedModel",
+	},
+	Resource:   "trainedmodels",
+	ShortNames: []string{"tm"},
+}
+
+// virtualServiceGVK is the group version kind of Istio VirtualServices.
+var virtualServiceGVK = schema.GroupVersionKind{
+	Group:   "networking.istio.io",
+	Version: "v1alpha3",
+	Kind:    "VirtualService",
+}
+
+// Snapshot records the weights of the destinations of the router before an experiment changes them.
+type Snapshot struct {
+	// Weights are the weights of the baseline and candidate destinations, each of which is nil if the destination had no weight.
+	Weights []*int64 `json:"weights"`
+}
+
+// Target is an enhancement of KFServing TrainedModel, which splits traffic between the baseline and candidate TrainedModels through a router.
+type Target struct {
+	target.Base
+	baseline  *unstructured.Unstructured
+	candidate *unstructured.Unstructured
+	router    *unstructured.Unstructured
+}
+
+// TargetBuilder returns an initial TrainedModel target struct pointer.
+func TargetBuilder() *Target {
+	t := &Target{}
+	t.Base = target.BaseBuilder(t, "trainedmodel", "trained model")
+	return t
+}
+
+// Fetch fetches the baseline TrainedModel object from the Kubernetes cluster and populates the target struct with it.
+// TrainedModel may be unavailable at the start of this call. So, Fetch periodically attempts to fetch the TrainedModel object for 180 sec.
+// If it does not succeed in 180 secs, the method returns after setting an error.
+func (t *Target) Fetch(targetRef string) target.Target {
+	if tm := t.FetchObject(Kind, targetRef); tm != nil {
+		t.baseline = tm
+	}
+	return t
+}
+
+// getAnnotation is a helper function that returns the value of the given annotation of the experiment, or an error if the experiment does not have this annotation.
+func getAnnotation(t *Target, key string) (string, error) {
+	value, ok := t.Exp.GetAnnotations()[key]
+	if !ok || value == "" {
+		return "", errors.New("experiment on TrainedModel needs annotation " + key)
+	}
+	return value, nil
+}
+
+// fetchCandidate is a helper function to fetch the candidate TrainedModel named by the experiment.
+func fetchCandidate(t *Target) error {
+	name, err := getAnnotation(t, experiment.CandidateAnnotation)
+	if err != nil {
+		return err
+	}
+	if name == t.baseline.GetName() {
+		return &target.NoCandidateError{Revision: name}
+	}
+	tm, err := t.GetObject(Kind.GVK, t.baseline.GetNamespace(), name)
+	if err != nil {
+		return errors.New("unable to fetch candidate TrainedModel " + name + "; " + err.Error())
+	}
+	t.candidate = tm
+	return nil
+}
+
+// fetchRouter is a helper function to fetch the router named by the experiment.
+func fetchRouter(t *Target) error {
+	name, err := getAnnotation(t, experiment.RouterAnnotation)
+	if err != nil {
+		return err
+	}
+	vs, err := t.GetObject(virtualServiceGVK, t.baseline.GetNamespace(), name)
+	if err != nil {
+		return errors.New("unable to fetch router " + name + "; " + err.Error())
+	}
+	t.router = vs
+	return nil
+}
+
+// isReady is a helper function that checks if the condition "Ready" of the given TrainedModel has "Status" true.
+func isReady(tm *unstructured.Unstructured) bool {
+	type resource struct {
+		Status struct {
+			Conditions []target.Condition `json:"conditions"`
+		} `json:"status"`
+	}
+	var ro = resource{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(tm.Object, &ro); err != nil {
+		return false
+	}
+	readyStr, _ := target.GetCondition(ro.Status.Conditions, "Ready")
+	return readyStr == "True"
+}
+
+// receivesTraffic is a helper function that returns true if the baseline, or the candidate if candidate is true, receives traffic with the given weight.
+// The baseline is the default destination; so, it receives traffic unless its weight is 0. The candidate receives traffic if its weight is positive.
+func receivesTraffic(w *int64, candidate bool) bool {
+	if w == nil {
+		return !candidate
+	}
+	return *w > 0
+}
+
+// isServing is a helper function for fetching the baseline and candidate TrainedModels, and checking if those which receive traffic with the given weights are ready.
+// Only the baseline is checked in single-version experiments.
+func isServing(t *Target, weights []*int64) bool {
+	t.Fetch(t.Exp.GetTargetRef())
+	if t.Err != nil {
+		return false
+	}
+	if receivesTraffic(weights[0], false) && !isReady(t.baseline) {
+		return false
+	}
+	if t.Exp.IsSingleVersion() || !receivesTraffic(weights[1], true) {
+		return true
+	}
+	return fetchCandidate(t) == nil && isReady(t.candidate)
+}
+
+// ensureReadiness ensures that the condition "Ready" has "Status" true in the TrainedModels which receive traffic with the given weights.
+// It periodically fetches the TrainedModels and checks this condition.
+// Returns true if readiness is reached in 180 sec and false otherwise.
+func ensureReadiness(t *Target, weights []*int64) (ready bool) {
+	defer t.StartSpan("EnsureReadiness")()
+	defer func(start time.Time) {
+		t.Observe("ensure_readiness", start, ready)
+	}(time.Now())
+	return t.Poll(t.Retries, func() bool { return isServing(t, weights) })
+}
+
+// getRoute is a helper function that returns the index of the http route of the router which is named after the baseline, along with the destinations of this route.
+// The route needs two destinations, the first of which is the baseline, and the second of which is the candidate.
+func getRoute(t *Target) (int, []interface{}, error) {
+	routes, _, err := unstructured.NestedSlice(t.router.Object, "spec", "http")
+	if err != nil {
+		return 0, nil, errors.New("invalid http routes in router " + t.router.GetName() + "; " + err.Error())
+	}
+	for i, r := range routes {
+		route, ok := r.(map[string]interface{})
+		if !ok || route["name"] != t.baseline.GetName() {
+			continue
+		}
+		destinations, _, err := unstructured.NestedSlice(route, "route")
+		if err != nil || len(destinations) != 2 {
+			return 0, nil, errors.New("http route " + t.baseline.GetName() + " of router " + t.router.GetName() + " needs two destinations, for the baseline and the candidate")
+		}
+		return i, destinations, nil
+	}
+	return 0, nil, errors.New("router " + t.router.GetName() + " has no http route named " + t.baseline.GetName())
+}
+
+// getWeights is a helper function that returns the weights of the baseline and candidate destinations of the router, each of which is nil if the destination has no weight.
+func getWeights(t *Target) ([]*int64, error) {
+	_, destinations, err := getRoute(t)
+	if err != nil {
+		return nil, err
+	}
+	weights := []*int64{}
+	for _, d := range destinations {
+		destination, _ := d.(map[string]interface{})
+		w, found, err := unstructured.NestedInt64(destination, "weight")
+		if err != nil {
+			return nil, errors.New("invalid weight in router " + t.router.GetName() + "; " + err.Error())
+		}
+		if !found {
+			weights = append(weights, nil)
+			continue
+		}
+		weights = append(weights, &w)
+	}
+	return weights, nil
+}
+
+// setWeights is a helper function that sets the given weights of the baseline and candidate destinations of the router.
+func setWeights(t *Target, weights []*int64) error {
+	if err := fetchRouter(t); err != nil {
+		return err
+	}
+	index, _, err := getRoute(t)
+	if err != nil {
+		return err
+	}
+	payloadBytes, err := target.WeightsPatch(t.router.Object, []string{"spec", "http"}, index, "route", weights)
+	if err != nil || payloadBytes == nil {
+		return err
+	}
+	return t.Patch(t.router, client.RawPatch(types.JSONPatchType, payloadBytes))
+}
+
+// candidateWeights is a helper function that returns the weights of the baseline and candidate destinations which send the given percentage of traffic to the candidate.
+func candidateWeights(p int64) []*int64 {
+	b := 100 - p
+	return []*int64{&b, &p}
+}
+
+// hasWeights is a helper function for fetching the router and the TrainedModels, and checking if the router has the given weights and the TrainedModels which receive traffic are ready.
+func hasWeights(t *Target, weights []*int64) bool {
+	if !isServing(t, weights) || fetchRouter(t) != nil {
+		return false
+	}
+	current, err := getWeights(t)
+	return err == nil && reflect.DeepEqual(current, weights)
+}
+
+// SetCandidateWeight sets the weights of the destinations of the router, so that the candidate receives the given percentage of traffic, and the baseline receives the rest.
+// After this step, the handler waits for (<=) 180 sec to ensure the TrainedModels which receive traffic are ready.
+// If any of the above steps fail, the method returns after setting an error.
+func (t *Target) SetCandidateWeight(p int64) target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("SetCandidateWeight")()
+	defer func(start time.Time) {
+		t.Observe("set_candidate_weight", start, t.Err == nil)
+	}(time.Now())
+	if t.baseline == nil {
+		t.Err = errors.New("unable to set traffic split; uninitialized trained model object")
+		return t
+	}
+	weights := candidateWeights(p)
+	if t.Err = setWeights(t, weights); t.Err != nil {
+		return t
+	}
+	if !ensureReadiness(t, weights) && t.Err == nil {
+		t.Err = errors.New("post-patch: unable to ensure readiness of trained models even after 180 seconds")
+	}
+	return t
+}
+
+// InitializeTrafficSplit initializes traffic split for the target.
+// The candidate receives 1% of the traffic, or 0% in BlueGreen experiments.
+// Single-version experiments leave the router untouched, and do not need one.
+func (t *Target) InitializeTrafficSplit() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("InitializeTrafficSplit")()
+	if t.Exp != nil && t.Exp.IsSingleVersion() {
+		return t
+	}
+	p := int64(1)
+	if t.Exp != nil && t.Exp.IsBlueGreen() {
+		p = 0
+	}
+	if t.Resume("InitializeTrafficSplit", func() bool { return hasWeights(t, candidateWeights(p)) }) {
+		return t
+	}
+	defer t.Complete("InitializeTrafficSplit")
+	return t.SetCandidateWeight(p)
+}
+
+// EnsureCandidate ensures that the candidate TrainedModel named by the experiment exists.
+// The candidate may not have been created at the start of this call. So, EnsureCandidate periodically attempts to fetch the candidate until the candidate wait (180 sec by default) elapses.
+// If the candidate does not appear within this duration, the method returns after setting an error; this error is a *target.NoCandidateError if the candidate is the baseline.
+func (t *Target) EnsureCandidate() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("EnsureCandidate")()
+	if t.Exp == nil {
+		t.Err = errors.New("method EnsureCandidate called on a target with nil experiment")
+		return t
+	}
+	if t.baseline == nil {
+		t.Err = errors.New("unable to find candidate; uninitialized trained model object")
+		return t
+	}
+	name, err := getAnnotation(t, experiment.CandidateAnnotation)
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	if name == t.baseline.GetName() {
+		t.Err = &target.NoCandidateError{Revision: name}
+		return t
+	}
+	if t.Poll(t.CandidateRetries, func() bool {
+		err = fetchCandidate(t)
+		return err == nil
+	}) {
+		return t
+	}
+	t.Err = err
+	return t
+}
+
+// versionTags is a helper function that returns the tags of the version served by the given TrainedModel.
+// Tags which are absent from the TrainedModel are omitted.
+func versionTags(tm *unstructured.Unstructured) *map[string]string {
+	tags := map[string]string{
+		"trainedModel": tm.GetName(),
+		"namespace":    tm.GetNamespace(),
+	}
+	fields := map[string][]string{
+		"inferenceService": {"spec", "inferenceService"},
+		"storageUri":       {"spec", "model", "storageUri"},
+		"framework":        {"spec", "model", "framework"},
+		"memory":           {"spec", "model", "memory"},
+	}
+	for tag, fields := range fields {
+		if val, found, err := unstructured.NestedFieldNoCopy(tm.Object, fields...); err == nil && found {
+			tags[tag] = fmt.Sprint(val)
+		}
+	}
+	return &tags
+}
+
+// weightObjRef is a helper function that returns the reference to the weight of the destination of the router with the given index.
+func weightObjRef(t *Target, index int, destination int) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       virtualServiceGVK.Kind,
+		Namespace:  t.router.GetNamespace(),
+		Name:       t.router.GetName(),
+		APIVersion: t.router.GetAPIVersion(),
+		FieldPath:  fmt.Sprintf("/spec/http/%d/route/%d/weight", index, destination),
+	}
+}
+
+// GetVersionInfo constructs the VersionInfo object based on the target and returns it.
+// The WeightObjRefs of the baseline and candidate refer to the weights of their destinations in the router.
+func (t *Target) GetVersionInfo() (_ *etc3.VersionInfo, err error) {
+	_, span := tracing.Start(t.Ctx, "trainedmodel.GetVersionInfo")
+	defer func() {
+		tracing.End(span, err)
+	}()
+	if t.baseline == nil {
+		return nil, errors.New("unable to get version info; uninitialized trained model object")
+	}
+	if t.Exp.IsSingleVersion() {
+		return &etc3.VersionInfo{
+			Baseline: etc3.VersionDetail{
+				Name: "default",
+				Tags: versionTags(t.baseline),
+			},
+		}, nil
+	}
+	if err := fetchCandidate(t); err != nil {
+		return nil, err
+	}
+	if err := fetchRouter(t); err != nil {
+		return nil, err
+	}
+	index, _, err := getRoute(t)
+	if err != nil {
+		return nil, err
+	}
+	return &etc3.VersionInfo{
+		Baseline: etc3.VersionDetail{
+			Name:         "default",
+			Tags:         versionTags(t.baseline),
+			WeightObjRef: weightObjRef(t, index, 0),
+		},
+		Candidates: []etc3.VersionDetail{
+			{
+				Name:         "canary",
+				Tags:         versionTags(t.candidate),
+				WeightObjRef: weightObjRef(t, index, 1),
+			},
+		},
+	}, nil
+}
+
+// SetVersionInfoInExperiment sets version info in the experiment associated with this target.
+func (t *Target) SetVersionInfoInExperiment() target.Target {
+	t.SetVersionInfo(t.GetVersionInfo)
+	return t
+}
+
+// SetNewBaseline sets a new baseline within the target.
+// A winning candidate receives all traffic; in BlueGreen experiments, the readiness of the TrainedModels is verified for the verification window after this cutover, and the cutover is reverted if they become un-ready.
+// Otherwise, the weights of the router before the experiment are restored.
+func (t *Target) SetNewBaseline() target.Target {
+	t.SetBaseline(t.baseline, target.BaselineSteps{
+		IsSet:      func(recommended string) bool { return hasNewBaseline(t, recommended) },
+		IsRestored: func() bool { return isRestored(t) },
+		Restore:    func() { t.RestoreTrafficState() },
+		Shift:      func(string) { t.SetCandidateWeight(100) },
+		IsReady:    func() bool { return isServing(t, candidateWeights(100)) },
+		Unready:    "trained models became un-ready after cutover",
+	})
+	return t
+}
+
+// hasNewBaseline is a helper function for fetching the target and checking if it is ready with the given recommended baseline as its new baseline.
+func hasNewBaseline(t *Target, recommendedBaseline string) bool {
+	if recommendedBaseline != "canary" {
+		return isRestored(t)
+	}
+	return hasWeights(t, candidateWeights(100))
+}
+
+// snapshotWeights is a helper function that returns the weights recorded in the snapshot annotation of the experiment, or the weights which send all traffic to the baseline if the experiment has no snapshot.
+func snapshotWeights(t *Target) ([]*int64, error) {
+	snapshot := Snapshot{}
+	found, err := t.GetSnapshot(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return candidateWeights(0), nil
+	}
+	if len(snapshot.Weights) != 2 {
+		return nil, errors.New("traffic state snapshot needs the weights of the baseline and the candidate")
+	}
+	return snapshot.Weights, nil
+}
+
+// isRestored is a helper function for fetching the target and checking if it is ready with the weights recorded in the snapshot annotation of the experiment.
+func isRestored(t *Target) bool {
+	weights, err := snapshotWeights(t)
+	return err == nil && hasWeights(t, weights)
+}
+
+// RecordAssessedVersion records the TrainedModel assessed in a single-version experiment as an annotation of the experiment.
+// The assessed TrainedModel is the baseline recorded in the versionInfo of the experiment during start.
+func (t *Target) RecordAssessedVersion() target.Target {
+	t.RecordAssessed("trainedModel")
+	return t
+}
+
+// SnapshotTrafficState records the weights of the baseline and candidate destinations of the router in the snapshot annotation of the experiment.
+func (t *Target) SnapshotTrafficState() target.Target {
+	t.Snapshot(t.baseline, func() (interface{}, error) {
+		if err := fetchRouter(t); err != nil {
+			return nil, err
+		}
+		weights, err := getWeights(t)
+		return Snapshot{Weights: weights}, err
+	})
+	return t
+}
+
+// RestoreTrafficState restores the weights of the router recorded in the snapshot annotation of the experiment.
+// Weights which were absent when the snapshot was recorded are removed from the router.
+// Experiments without a snapshot are restored by sending all traffic to the baseline.
+// After this step, the handler waits for (<=) 180 sec to ensure the TrainedModels which receive traffic are ready.
+func (t *Target) RestoreTrafficState() target.Target {
+	t.Restore(t.baseline, func() {
+		if _, ok := t.Exp.GetAnnotations()[experiment.SnapshotAnnotation]; !ok {
+			t.LogEntry().Warn("traffic state snapshot not found in experiment; shifting all traffic to baseline")
+		}
+		weights, err := snapshotWeights(t)
+		if err != nil {
+			t.Err = err
+			return
+		}
+		if t.Err = setWeights(t, weights); t.Err != nil {
+			return
+		}
+		if !ensureReadiness(t, weights) && t.Err == nil {
+			t.Err = errors.New("post-patch: unable to ensure readiness of trained models even after 180 seconds")
+		}
+	})
+	return t
+}
+
+// Claim claims the baseline TrainedModel for the experiment by recording the experiment in its lock annotation.
+// If the TrainedModel is claimed by another experiment which still exists, the method returns after setting a *target.LockedError.
+func (t *Target) Claim() target.Target {
+	t.ClaimObject(t.baseline)
+	return t
+}
+
+// Release releases the claim of the experiment on the baseline TrainedModel by removing its lock annotation.
+// Locks held by other experiments are left unchanged.
+func (t *Target) Release() target.Target {
+	t.ReleaseObject(func() *unstructured.Unstructured {
+		t.Fetch(t.Exp.GetTargetRef())
+		return t.baseline
+	})
+	return t
+}
@@ -0,0 +1,177 @@
+package trainedmodel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/target/targettest"
+)
+
+var files = []string{"trainedmodel-baseline.json", "trainedmodel-candidate.json", "router-trainedmodel.json"}
+
+// getTarget returns a resumable target which is fetched for an experiment with the given strategy and annotations, created in the given client.
+func getTarget(t *testing.T, c client.Client, strategy etc3.StrategyType, annotations map[string]string) *Target {
+	exp := targettest.NewExperiment(t, c, "trainedmodels/default/iris-v1", strategy, annotations)
+	targ := TargetBuilder()
+	targ.SetResumable(true)
+	targettest.Fetch(t, targ, c, exp)
+	return targ
+}
+
+var routed = map[string]string{
+	experiment.CandidateAnnotation: "iris-v2",
+	experiment.RouterAnnotation:    "iris-router",
+}
+
+// getRouterWeights returns the weights of the baseline and candidate destinations of the router in the given client.
+func getRouterWeights(t *testing.T, c client.Client) []interface{} {
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(virtualServiceGVK)
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "iris-router"}, vs); err != nil {
+		t.Fatal("Cannot get router", err)
+	}
+	routes, _, _ := unstructured.NestedSlice(vs.Object, "spec", "http")
+	destinations := routes[0].(map[string]interface{})["route"].([]interface{})
+	return []interface{}{destinations[0].(map[string]interface{})["weight"], destinations[1].(map[string]interface{})["weight"]}
+}
+
+func TestStartAndFinish(t *testing.T) {
+	c := targettest.NewClient(t, files...)
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, routed)
+	targ.Claim().EnsureCandidate().SnapshotTrafficState()
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(99), int64(1)}, getRouterWeights(t, c))
+	assert.Equal(t, `{"weights":[100,null]}`, targ.Exp.GetAnnotations()[experiment.SnapshotAnnotation])
+	assert.Contains(t, targ.baseline.GetAnnotations(), target.LockAnnotation)
+
+	exp := &etc3.Experiment{}
+	c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "myexp"}, exp)
+	vi := exp.Spec.VersionInfo
+	assert.Equal(t, map[string]string{
+		"trainedModel":     "iris-v1",
+		"namespace":        "default",
+		"inferenceService": "sklearn-mms",
+		"storageUri":       "gs://kfserving-samples/models/sklearn/iris",
+		"framework":        "sklearn",
+		"memory":           "256Mi",
+	}, *vi.Baseline.Tags)
+	assert.Equal(t, "iris-v2", (*vi.Candidates[0].Tags)["trainedModel"])
+	assert.Equal(t, "/spec/http/0/route/0/weight", vi.Baseline.WeightObjRef.FieldPath)
+	assert.Equal(t, "/spec/http/0/route/1/weight", vi.Candidates[0].WeightObjRef.FieldPath)
+	assert.Equal(t, "VirtualService", vi.Candidates[0].WeightObjRef.Kind)
+	assert.Equal(t, "networking.istio.io/v1alpha3", vi.Candidates[0].WeightObjRef.APIVersion)
+
+	// the candidate wins
+	err := c.Patch(context.Background(), exp, client.RawPatch(types.MergePatchType, []byte(`{"status":{"recommendedBaseline":"canary"}}`)))
+	assert.NoError(t, err)
+	next := TargetBuilder()
+	next.SetK8sClient(c).SetExperiment(experiment.Builder(exp)).Fetch(exp.Spec.Target)
+	next.SetNewBaseline().Release()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, []interface{}{int64(0), int64(100)}, getRouterWeights(t, c))
+	assert.NotContains(t, next.baseline.GetAnnotations(), target.LockAnnotation)
+}
+
+func TestFinishBaselineRestoresSnapshot(t *testing.T) {
+	c := targettest.NewClient(t, files...)
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, map[string]string{
+		experiment.CandidateAnnotation: "iris-v2",
+		experiment.RouterAnnotation:    "iris-router",
+		experiment.SnapshotAnnotation:  `{"weights":[100,null]}`,
+	})
+	targ.SetCandidateWeight(40)
+	assert.Equal(t, []interface{}{int64(60), int64(40)}, getRouterWeights(t, c))
+	recommended := "default"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	// the candidate had no weight before the experiment
+	assert.Equal(t, []interface{}{int64(100), nil}, getRouterWeights(t, c))
+
+	// a rerun is skipped, since the weights are verified
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, `["SetNewBaseline"]`, targ.Exp.GetAnnotations()[experiment.ProgressAnnotation])
+}
+
+func TestEnsureCandidateErrors(t *testing.T) {
+	c := targettest.NewClient(t, "trainedmodel-baseline.json", "router-trainedmodel.json")
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, map[string]string{})
+	targ.EnsureCandidate()
+	assert.EqualError(t, targ.Err, "experiment on TrainedModel needs annotation "+experiment.CandidateAnnotation)
+
+	targ.Err = nil
+	targ.Exp.SetAnnotations(map[string]string{experiment.CandidateAnnotation: "iris-v1"})
+	targ.EnsureCandidate()
+	var nce *target.NoCandidateError
+	assert.True(t, errors.As(targ.Err, &nce))
+
+	// the candidate does not appear
+	targ.Err = nil
+	targ.CandidateRetries = 0
+	targ.Exp.SetAnnotations(routed)
+	targ.EnsureCandidate()
+	assert.Error(t, targ.Err)
+}
+
+func TestRouterErrors(t *testing.T) {
+	c := targettest.NewClient(t, files...)
+	targ := getTarget(t, c, etc3.StrategyTypeCanary, map[string]string{experiment.CandidateAnnotation: "iris-v2"})
+	targ.InitializeTrafficSplit()
+	assert.EqualError(t, targ.Err, "experiment on TrainedModel needs annotation "+experiment.RouterAnnotation)
+
+	// the route is named after the baseline
+	targ.Err = nil
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(virtualServiceGVK)
+	c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "iris-router"}, vs)
+	assert.NoError(t, c.Patch(context.Background(), vs, client.RawPatch(types.JSONPatchType, []byte(`[{"op":"replace","path":"/spec/http/0/name","value":"other"}]`))))
+	targ.Exp.SetAnnotations(routed)
+	targ.InitializeTrafficSplit()
+	assert.EqualError(t, targ.Err, "router iris-router has no http route named iris-v1")
+}
+
+func TestBlueGreenCutoverReverted(t *testing.T) {
+	c := targettest.NewClient(t, files...)
+	targ := getTarget(t, c, etc3.StrategyTypeBlueGreen, routed)
+	targ.EnsureCandidate().SnapshotTrafficState().InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []interface{}{int64(100), int64(0)}, getRouterWeights(t, c))
+
+	// the candidate becomes un-ready
+	assert.NoError(t, c.Patch(context.Background(), targ.candidate, client.RawPatch(types.MergePatchType,
+		[]byte(`{"status":{"conditions":[{"type":"Ready","status":"False"}]}}`))))
+	targ.Retries = 0
+	recommended := "canary"
+	targ.Exp.Status.RecommendedBaseline = &recommended
+	targ.SetNewBaseline()
+	assert.Error(t, targ.Err)
+	assert.Contains(t, targ.Err.Error(), "reverted cutover to canary")
+	assert.Equal(t, []interface{}{int64(100), nil}, getRouterWeights(t, c))
+}
+
+func TestSingleVersion(t *testing.T) {
+	c := targettest.NewClient(t, "trainedmodel-baseline.json")
+	targ := getTarget(t, c, etc3.StrategyTypePerformance, map[string]string{})
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Empty(t, vi.Candidates)
+	assert.Nil(t, vi.Baseline.WeightObjRef)
+
+	targ.Exp.Spec.VersionInfo = vi
+	targ.RecordAssessedVersion()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, "iris-v1", targ.Exp.GetAnnotations()[experiment.AssessedRevisionAnnotation])
+}
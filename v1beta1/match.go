@@ -0,0 +1,287 @@
+package v1beta1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+)
+
+// TagRoutingAnnotation is the annotation of InferenceServices which enables the tagged routes of the revisions of their components, which match mode needs.
+const TagRoutingAnnotation = "serving.kubeflow.org/enable-tag-routing"
+
+// IngressService is the service of the Istio ingress gateway of KFServing, through which the router sends matching requests to the tagged route of the candidate.
+// The tagged route is selected by its host, which the router sets as the authority of these requests.
+const IngressService = "istio-ingressgateway.istio-system.svc.cluster.local"
+
+// virtualServiceGVK is the group version kind of Istio VirtualServices.
+var virtualServiceGVK = schema.GroupVersionKind{
+	Group:   "networking.istio.io",
+	Version: "v1alpha3",
+	Kind:    "VirtualService",
+}
+
+// Match declares the requests routed to the candidate in match mode, which carry a header or a cookie with a given value.
+type Match struct {
+	// Header is the name of the header of matching requests; it is empty if requests are matched by a cookie.
+	Header string `json:"header,omitempty"`
+	// Cookie is the name of the cookie of matching requests; it is empty if requests are matched by a header.
+	Cookie string `json:"cookie,omitempty"`
+	// Value is the value of the header or cookie of matching requests.
+	Value string `json:"value"`
+}
+
+// getMatch is a helper function that returns the match declared in the match annotation of the experiment, or nil if the experiment is not in match mode.
+// Experiments in match mode also need the router annotation.
+func getMatch(t *Target) (*Match, error) {
+	if t.Exp == nil {
+		return nil, nil
+	}
+	matchStr, ok := t.Exp.GetAnnotations()[experiment.MatchAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	match := &Match{}
+	if err := json.Unmarshal([]byte(matchStr), match); err != nil {
+		return nil, errors.New("invalid match annotation; " + err.Error())
+	}
+	if (match.Header == "") == (match.Cookie == "") || match.Value == "" {
+		return nil, errors.New("invalid match annotation; match needs a value, and either a header or a cookie")
+	}
+	if t.Exp.IsSingleVersion() {
+		return nil, errors.New("match annotation is not supported in single-version experiments")
+	}
+	if _, ok := t.Exp.GetAnnotations()[experiment.RouterAnnotation]; !ok {
+		return nil, errors.New("experiment in match mode needs annotation " + experiment.RouterAnnotation)
+	}
+	return match, nil
+}
+
+// headers is a helper function that returns the Istio header match of requests which match the given match.
+// Cookies are matched by a regular expression over the cookie header.
+func (m *Match) headers() map[string]interface{} {
+	if m.Header != "" {
+		return map[string]interface{}{
+			strings.ToLower(m.Header): map[string]interface{}{"exact": m.Value},
+		}
+	}
+	return map[string]interface{}{
+		"cookie": map[string]interface{}{
+			"regex": "^(.*?;\\s*)?(" + regexp.QuoteMeta(m.Cookie+"="+m.Value) + ")(;.*)?$",
+		},
+	}
+}
+
+// matchTags is a helper function that returns the tags of the candidate which describe the match of the experiment, if the experiment is in match mode.
+// The candidate serves the requests which match, and the baseline serves the others.
+func matchTags(t *Target) map[string]string {
+	tags := map[string]string{}
+	match, err := getMatch(t)
+	if err != nil || match == nil {
+		return tags
+	}
+	tags["matchValue"] = match.Value
+	if match.Header != "" {
+		tags["matchType"] = "header"
+		tags["matchName"] = match.Header
+	} else {
+		tags["matchType"] = "cookie"
+		tags["matchName"] = match.Cookie
+	}
+	return tags
+}
+
+// matchRouteName is a helper function that returns the name of the http route of the router which routes matching requests to the candidate.
+func matchRouteName(t *Target) string {
+	return "iter8-canary-" + t.infService.GetName()
+}
+
+// ingressComponent is a helper function that returns the component of the target which receives the ingress traffic of the InferenceService: its transformer, if it has one, and its predictor otherwise.
+func ingressComponent(t *Target) string {
+	if _, found, _ := unstructured.NestedMap(t.infService.Object, "spec", "transformer"); found {
+		return "transformer"
+	}
+	return "predictor"
+}
+
+// canaryHost is a helper function that returns the host of the tagged url of the candidate revision of the ingress component of the target.
+// KFServing tags the route of the candidate revision while the component has a canary traffic split, if tag routing is enabled on the InferenceService.
+func canaryHost(t *Target) (string, error) {
+	if t.infService.GetAnnotations()[TagRoutingAnnotation] != "true" {
+		return "", errors.New("tag routing is not enabled on inference service " + t.infService.GetName() + "; match mode needs annotation " + TagRoutingAnnotation + ": \"true\"")
+	}
+	component := ingressComponent(t)
+	_, cRev, err := getComponentRevisions(t, component)
+	if err != nil {
+		return "", err
+	}
+	traffic, _, _ := unstructured.NestedSlice(t.infService.Object, "status", "components", component, "traffic")
+	for _, tr := range traffic {
+		target, _ := tr.(map[string]interface{})
+		tag, ok := target["tag"].(string)
+		if !ok || tag == "" || target["revisionName"] != cRev {
+			continue
+		}
+		rawURL, _ := target["url"].(string)
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			return "", errors.New("invalid url of tagged route " + tag + " of canary revision " + cRev + " of " + component)
+		}
+		return u.Host, nil
+	}
+	return "", errors.New("no tagged route found for canary revision " + cRev + " of " + component)
+}
+
+// matchRoute is a helper function that returns the http route of the router which routes requests matching the given match to the candidate.
+func matchRoute(t *Target, match *Match) (map[string]interface{}, error) {
+	host, err := canaryHost(t)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"name": matchRouteName(t),
+		"match": []interface{}{
+			map[string]interface{}{"headers": match.headers()},
+		},
+		"rewrite": map[string]interface{}{"authority": host},
+		"route": []interface{}{
+			map[string]interface{}{
+				"destination": map[string]interface{}{"host": IngressService},
+			},
+		},
+	}, nil
+}
+
+// getRouter is a helper function that fetches the router named by the experiment.
+func getRouter(t *Target) (*unstructured.Unstructured, error) {
+	name := t.Exp.GetAnnotations()[experiment.RouterAnnotation]
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(virtualServiceGVK)
+	if err := t.Get(client.ObjectKey{
+		Namespace: t.infService.GetNamespace(),
+		Name:      name,
+	}, vs); err != nil {
+		return nil, errors.New("unable to fetch router " + name + "; " + err.Error())
+	}
+	return vs, nil
+}
+
+// findRoute is a helper function that returns the index of the http route of the router with the given name, along with this route, or -1 if the router has no such route.
+func findRoute(router *unstructured.Unstructured, name string) (int, map[string]interface{}) {
+	routes, _, _ := unstructured.NestedSlice(router.Object, "spec", "http")
+	for i, r := range routes {
+		if route, ok := r.(map[string]interface{}); ok && route["name"] == name {
+			return i, route
+		}
+	}
+	return -1, nil
+}
+
+// matchRoutePatch is a helper function that returns the JSON patch of the given router which sets the given http route ahead of its other routes, or removes the route with the given name if the given route is nil.
+// The patch returned is nil if no change is needed. Patches of an existing route test its name first, so that they fail if the routes of the router changed after it was fetched.
+func matchRoutePatch(router *unstructured.Unstructured, name string, route map[string]interface{}) ([]byte, error) {
+	type op struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value,omitempty"`
+	}
+	if _, found, _ := unstructured.NestedSlice(router.Object, "spec", "http"); !found {
+		return nil, errors.New("router " + router.GetName() + " has no http routes")
+	}
+	payload := []op{}
+	i, current := findRoute(router, name)
+	switch {
+	case route == nil && i < 0:
+		return nil, nil
+	case route == nil:
+		payload = append(payload, op{"test", fmt.Sprintf("/spec/http/%d/name", i), name}, op{Op: "remove", Path: fmt.Sprintf("/spec/http/%d", i)})
+	case i < 0:
+		payload = append(payload, op{"add", "/spec/http/0", route})
+	case jsonEqual(current, route):
+		return nil, nil
+	default:
+		payload = append(payload, op{"test", fmt.Sprintf("/spec/http/%d/name", i), name}, op{"replace", fmt.Sprintf("/spec/http/%d", i), route})
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.New("unable to marshal router patch")
+	}
+	return payloadBytes, nil
+}
+
+// jsonEqual is a helper function that checks if the given objects have the same JSON form, since numbers in fetched objects may be decoded with a different type.
+func jsonEqual(a interface{}, b interface{}) bool {
+	aBytes, err1 := json.Marshal(a)
+	bBytes, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && reflect.DeepEqual(aBytes, bBytes)
+}
+
+// setMatchRoute is a helper function that sets the http route of the router which routes requests matching the given match to the candidate, or removes this route if the given match is nil.
+func setMatchRoute(t *Target, match *Match) error {
+	router, err := getRouter(t)
+	if err != nil {
+		return err
+	}
+	var route map[string]interface{}
+	if match != nil {
+		if route, err = matchRoute(t, match); err != nil {
+			return err
+		}
+	}
+	payloadBytes, err := matchRoutePatch(router, matchRouteName(t), route)
+	if err != nil || payloadBytes == nil {
+		return err
+	}
+	return t.Patch(router, client.RawPatch(types.JSONPatchType, payloadBytes))
+}
+
+// hasMatchRoute is a helper function for fetching the router and checking if it has the http route which routes requests matching the given match to the candidate, or does not have this route if the given match is nil.
+func hasMatchRoute(t *Target, match *Match) bool {
+	router, err := getRouter(t)
+	if err != nil {
+		return false
+	}
+	i, current := findRoute(router, matchRouteName(t))
+	if match == nil {
+		return i < 0
+	}
+	route, err := matchRoute(t, match)
+	return err == nil && i >= 0 && jsonEqual(current, route)
+}
+
+// routeMatching sets the http route of the router which routes requests matching the given match to the candidate.
+func (t *Target) routeMatching(match *Match) {
+	if t.Err != nil {
+		return
+	}
+	defer t.StartSpan("RouteMatching")()
+	if t.Err = setMatchRoute(t, match); t.Err != nil {
+		t.Err = errors.New("unable to route matching requests to canary; " + t.Err.Error())
+	}
+}
+
+// removeMatchRoute removes the http route of the router which routes matching requests to the candidate, if the experiment is in match mode.
+func (t *Target) removeMatchRoute() {
+	if t.Err != nil {
+		return
+	}
+	match, err := getMatch(t)
+	if err != nil || match == nil {
+		t.Err = err
+		return
+	}
+	defer t.StartSpan("RemoveMatchRoute")()
+	if t.Err = setMatchRoute(t, nil); t.Err != nil {
+		t.Err = errors.New("unable to remove route of matching requests to canary; " + t.Err.Error())
+	}
+}
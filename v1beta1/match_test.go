@@ -0,0 +1,184 @@
+package v1beta1
+
+import (
+	"context"
+	"testing"
+
+	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/target/targettest"
+)
+
+// canaryHostName is the host of the tagged route of the candidate in matchv1beta1.json.
+const canaryHostName = "latest-my-model-predictor-default.default.example.com"
+
+// getMatchTarget returns a resumable target which is fetched for a canary experiment with the given match annotation, the InferenceService in matchv1beta1.json and the router in router-v1beta1.json.
+func getMatchTarget(t *testing.T, match string) (client.Client, *Target) {
+	return getMatchTargetFromFile(t, "matchv1beta1.json", match)
+}
+
+// getMatchTargetFromFile returns a resumable target which is fetched for a canary experiment with the given match annotation, the InferenceService in the given file and the router in router-v1beta1.json.
+func getMatchTargetFromFile(t *testing.T, fixture string, match string) (client.Client, *Target) {
+	c := targettest.NewClient(t, fixture, "router-v1beta1.json")
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	exp.SetAnnotations(map[string]string{
+		experiment.MatchAnnotation:  match,
+		experiment.RouterAnnotation: "my-model-router",
+	})
+	if err := c.Create(context.Background(), exp); err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ := TargetBuilder()
+	targ.SetResumable(true)
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	return c, targ
+}
+
+// getRoutes returns the http routes of the router in the given client.
+func getRoutes(t *testing.T, c client.Client) []interface{} {
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(virtualServiceGVK)
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "my-model-router"}, vs); err != nil {
+		t.Fatal("Cannot get router", err)
+	}
+	routes, _, _ := unstructured.NestedSlice(vs.Object, "spec", "http")
+	return routes
+}
+
+func TestStartWithHeaderMatch(t *testing.T) {
+	c, targ := getMatchTarget(t, `{"header": "x-iter8-canary", "value": "true"}`)
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+
+	p, found, _ := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, found)
+	assert.Equal(t, int64(0), p)
+
+	routes := getRoutes(t, c)
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, map[string]interface{}{
+		"name": "iter8-canary-my-model",
+		"match": []interface{}{
+			map[string]interface{}{
+				"headers": map[string]interface{}{
+					"x-iter8-canary": map[string]interface{}{"exact": "true"},
+				},
+			},
+		},
+		"rewrite": map[string]interface{}{"authority": canaryHostName},
+		"route": []interface{}{
+			map[string]interface{}{
+				"destination": map[string]interface{}{"host": IngressService},
+			},
+		},
+	}, routes[0])
+	assert.Equal(t, "my-model", routes[1].(map[string]interface{})["name"])
+
+	vi := targ.Exp.Spec.VersionInfo
+	assert.Nil(t, vi.Candidates[0].WeightObjRef)
+	tags := *vi.Candidates[0].Tags
+	assert.Equal(t, "header", tags["matchType"])
+	assert.Equal(t, "x-iter8-canary", tags["matchName"])
+	assert.Equal(t, "true", tags["matchValue"])
+	// the baseline serves requests which do not match
+	assert.NotContains(t, *vi.Baseline.Tags, "matchType")
+
+	// a rerun finds the route in place and skips the step
+	next := rerun(t, c, targ)
+	next.InitializeTrafficSplit()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, 2, len(getRoutes(t, c)))
+}
+
+func TestStartWithCookieMatch(t *testing.T) {
+	c, targ := getMatchTarget(t, `{"cookie": "iter8.canary", "value": "yes"}`)
+	targ.InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	route := getRoutes(t, c)[0].(map[string]interface{})
+	regex, _, _ := unstructured.NestedString(route["match"].([]interface{})[0].(map[string]interface{}), "headers", "cookie", "regex")
+	assert.Equal(t, `^(.*?;\s*)?(iter8\.canary=yes)(;.*)?$`, regex)
+	assert.Equal(t, map[string]string{
+		"matchType":  "cookie",
+		"matchName":  "iter8.canary",
+		"matchValue": "yes",
+	}, matchTags(targ))
+}
+
+func TestStartWithMatchRoutesToTransformer(t *testing.T) {
+	c, targ := getMatchTargetFromFile(t, "matchtransformerv1beta1.json", `{"header": "x-iter8-canary", "value": "true"}`)
+	targ.InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	// the transformer receives ingress traffic ahead of the predictor
+	host := "latest-my-model-transformer-default.default.example.com"
+	route := getRoutes(t, c)[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"authority": host}, route["rewrite"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"destination": map[string]interface{}{"host": IngressService},
+		},
+	}, route["route"])
+}
+
+func TestStartWithMatchWithoutTagRouting(t *testing.T) {
+	c, targ := getMatchTarget(t, `{"header": "x-iter8-canary", "value": "true"}`)
+	targ.infService.SetAnnotations(nil)
+	if err := c.Update(context.Background(), targ.infService); err != nil {
+		t.Fatal("Cannot disable tag routing", err)
+	}
+	targ.InitializeTrafficSplit()
+	assert.EqualError(t, targ.Err, `unable to route matching requests to canary; tag routing is not enabled on inference service my-model; match mode needs annotation serving.kubeflow.org/enable-tag-routing: "true"`)
+	assert.Equal(t, 1, len(getRoutes(t, c)))
+}
+
+func TestFinishWithMatch(t *testing.T) {
+	for _, recommended := range []string{"default", "canary"} {
+		c, targ := getMatchTarget(t, `{"header": "x-iter8-canary", "value": "true"}`)
+		targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+		assert.NoError(t, targ.Err)
+		assert.Equal(t, 2, len(getRoutes(t, c)))
+
+		next := rerun(t, c, targ)
+		next.Exp.Status.RecommendedBaseline = &recommended
+		next.SetNewBaseline()
+		assert.NoError(t, next.Err, recommended)
+		routes := getRoutes(t, c)
+		assert.Equal(t, 1, len(routes), recommended)
+		assert.Equal(t, "my-model", routes[0].(map[string]interface{})["name"])
+
+		p, _, _ := unstructured.NestedInt64(next.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+		if recommended == "canary" {
+			assert.Equal(t, int64(100), p)
+		} else {
+			assert.Equal(t, int64(0), p)
+		}
+		// a further rerun is skipped
+		next.SetNewBaseline()
+		assert.NoError(t, next.Err)
+	}
+}
+
+func TestInvalidMatch(t *testing.T) {
+	for match, expected := range map[string]string{
+		`{"header": "x-iter8-canary"`:                     "invalid match annotation; unexpected end of JSON input",
+		`{"value": "true"}`:                               "invalid match annotation; match needs a value, and either a header or a cookie",
+		`{"header": "x", "cookie": "y", "value": "true"}`: "invalid match annotation; match needs a value, and either a header or a cookie",
+		`{"header": "x-iter8-canary"}`:                    "invalid match annotation; match needs a value, and either a header or a cookie",
+	} {
+		_, targ := getMatchTarget(t, match)
+		targ.InitializeTrafficSplit()
+		assert.EqualError(t, targ.Err, expected, match)
+	}
+
+	_, targ := getMatchTarget(t, `{"header": "x-iter8-canary", "value": "true"}`)
+	delete(targ.Exp.GetAnnotations(), experiment.RouterAnnotation)
+	targ.InitializeTrafficSplit()
+	assert.EqualError(t, targ.Err, "experiment in match mode needs annotation "+experiment.RouterAnnotation)
+}
@@ -1,7 +1,14 @@
 // Package v1beta1 provides types and methods for manipulating v1beta1 KFServing InferenceService objects.
+//
+// Traffic is split on each component of the InferenceService (predictor, transformer or explainer) which has a canary revision when the experiment starts. The WeightObjRef of the candidate refers to the first of these components, and the other components are aligned with it. By default, a winning candidate gets all traffic through a canaryTrafficPercent of 100; in the promote finish mode, it is promoted to the default revision instead.
+//
+// Each version is tagged with its revision, metadata of its Knative Revision, and the variables namespace, inferenceService, component, and the configuration and service labelled on its Revision, so that metric queries can select it. Experiments may declare more variables in the annotation kfserving.iter8.tools/variables, as JSONPath expressions evaluated against the InferenceService.
+//
+// Canary experiments with the annotation kfserving.iter8.tools/match route only requests with a given header or cookie to the candidate, through an HTTP route added to the Istio VirtualService named by the annotation kfserving.iter8.tools/router. This route sends matching requests through the ingress gateway to the host of the tagged url of the candidate revision of the component which receives ingress traffic (the transformer, if any, and the predictor otherwise), so the InferenceService needs tag routing to be enabled by its annotation serving.kubeflow.org/enable-tag-routing.
 package v1beta1
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,66 +19,146 @@ import (
 
 	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
 	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/tracing"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/jsonpath"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// FinishMode specifies how SetNewBaseline handles a winning canary.
+type FinishMode string
+
+const (
+	// FinishModeTraffic shifts all traffic to a winning canary by setting spec.predictor.canaryTrafficPercent to 100.
+	FinishModeTraffic FinishMode = "traffic"
+	// FinishModePromote promotes a winning canary to the default revision by removing spec.predictor.canaryTrafficPercent.
+	FinishModePromote FinishMode = "promote"
+)
+
+// LockAnnotation is the InferenceService annotation recording the experiment which has claimed the InferenceService.
+const LockAnnotation = target.LockAnnotation
+
+// Lock identifies the experiment which has claimed an InferenceService.
+type Lock = target.Lock
+
+// DefaultTagPaths maps the tags of each version which are extracted from the Knative Revision of the version by default to their JSONPath expressions.
+var DefaultTagPaths = map[string]string{
+	"image":             "{.spec.containers[0].image}",
+	"cpuRequest":        "{.spec.containers[0].resources.requests.cpu}",
+	"memoryRequest":     "{.spec.containers[0].resources.requests.memory}",
+	"storageUri":        `{.metadata.annotations.internal\.serving\.kubeflow\.org/storage-initializer-sourceuri}`,
+	"creationTimestamp": "{.metadata.creationTimestamp}",
+}
+
+// frameworks are the model serving frameworks whose predictor specs are supported by KFServing.
+var frameworks = []string{"tensorflow", "pytorch", "sklearn", "xgboost", "onnx", "triton", "pmml", "lightgbm"}
+
+// components are the components of an InferenceService, each of which has its own revisions and traffic split.
+// The predictor is listed first; it is the only component required in an InferenceService.
+var components = []string{"predictor", "transformer", "explainer"}
+
+// componentConditions map components of an InferenceService to their readiness conditions.
+var componentConditions = map[string]string{
+	"predictor":   "PredictorReady",
+	"transformer": "TransformerReady",
+	"explainer":   "ExplainerReady",
+}
+
+// Snapshot records the traffic state of an InferenceService before an experiment changes it.
+type Snapshot struct {
+	// Components maps names of InferenceService components to their traffic state.
+	Components map[string]ComponentSnapshot `json:"components"`
+}
+
+// ComponentSnapshot records the traffic state of an InferenceService component.
+type ComponentSnapshot struct {
+	// CanaryTrafficPercent is the value of spec.<component>.canaryTrafficPercent, or nil if this field was absent.
+	CanaryTrafficPercent *int64 `json:"canaryTrafficPercent,omitempty"`
+	// LatestCreatedRevision is the value of status.components.<component>.latestCreatedRevision.
+	LatestCreatedRevision string `json:"latestCreatedRevision,omitempty"`
+	// LatestRolledoutRevision is the value of status.components.<component>.latestRolledoutRevision.
+	LatestRolledoutRevision string `json:"latestRolledoutRevision,omitempty"`
+}
+
 // Target is an enhancement of KFServing v1beta1 InferenceService.
 type Target struct {
-	err        error
+	target.Base
 	infService *unstructured.Unstructured
-	exp        *experiment.Experiment
-	k8sclient  client.Client
-	retries    uint          // number of retry attempts for fetch / readiness checks
-	interval   time.Duration // interval between the above attempts
+	finishMode FinishMode
+	// JSONPath expressions of the tags extracted from the Knative Revision of each version
+	tagPaths map[string]string
 }
 
 // TargetBuilder returns an initial v1beta1 target struct pointer.
 func TargetBuilder() *Target {
-	return &Target{
-		err:        nil,
-		infService: nil,
-		exp:        nil,
-		k8sclient:  nil,
-		retries:    18,
-		interval:   10,
+	t := &Target{
+		finishMode: FinishModeTraffic,
+		tagPaths:   DefaultTagPaths,
 	}
+	t.Base = target.BaseBuilder(t, "v1beta1", "inference service")
+	return t
 }
 
-// Error returns the error accumulated by target until this point or nil if there is none.
-func (t *Target) Error() error {
-	return t.err
-}
-
-// SetK8sClient sets a k8s client within the target struct.
-func (t *Target) SetK8sClient(c client.Client) target.Target {
-	if t.err != nil {
-		return t
+// SetTagPaths sets the JSONPath expressions of the tags of each version which are extracted from the Knative Revision of the version, replacing DefaultTagPaths.
+// The method sets an error if an expression is invalid.
+func (t *Target) SetTagPaths(paths map[string]string) *Target {
+	for name, path := range paths {
+		if err := jsonpath.New(name).Parse(path); err != nil {
+			t.Err = errors.New("invalid JSONPath expression of tag " + name + "; " + err.Error())
+			return t
+		}
 	}
-	t.k8sclient = c
+	t.tagPaths = paths
 	return t
 }
 
-// SetExperiment sets a pointer to an experiment object within the target.
-func (t *Target) SetExperiment(exp *experiment.Experiment) target.Target {
-	if t.err != nil {
+// SetFinishMode sets the mode in which SetNewBaseline handles a winning canary.
+func (t *Target) SetFinishMode(mode FinishMode) *Target {
+	if t.Err != nil {
+		return t
+	}
+	if mode != FinishModeTraffic && mode != FinishModePromote {
+		t.Err = errors.New("invalid finish mode: " + string(mode))
 		return t
 	}
-	t.exp = exp
+	t.finishMode = mode
 	return t
 }
 
 // getNN validates components of a v1beta1 targetRef and returns namespace and name, or error
+// The targetRef may be prefixed by the kind of InferenceServices, such as inferenceservices.serving.kubeflow.org/<namespace>/<name>. Names of InferenceServices must be DNS-1035 labels.
 func getNN(targetRef string) (string, string, error) {
-	tc := strings.Split(targetRef, "/")
-	if len(tc) == 2 {
-		return tc[0], tc[1], nil
+	ref, err := target.ParseRef(targetRef)
+	if err != nil {
+		return "", "", err
+	}
+	if !isInferenceServiceKind(ref) {
+		return "", "", errors.New("target kind " + ref.Kind + " is not a v1beta1 InferenceService")
+	}
+	if errs := validation.IsDNS1035Label(ref.Name); len(errs) > 0 {
+		return "", "", errors.New("invalid InferenceService name " + ref.Name + "; " + strings.Join(errs, "; "))
+	}
+	return ref.Namespace, ref.Name, nil
+}
+
+// isInferenceServiceKind is a helper function that checks if the given reference has no kind, or the kind of InferenceServices.
+func isInferenceServiceKind(ref *target.Ref) bool {
+	resource, group := ref.Resource()
+	if group != "" && group != "serving.kubeflow.org" {
+		return false
 	}
-	return "", "", errors.New("Invalid targetRef")
+	switch strings.ToLower(resource) {
+	case "", "inferenceservice", "inferenceservices", "isvc":
+		return true
+	}
+	return false
 }
 
 // fetch is a helper function to fetch the v1beta1 InferenceService object from the Kubernetes cluster.
@@ -82,51 +169,73 @@ func (t *Target) fetch(namespace string, name string) (*unstructured.Unstructure
 		Kind:    "InferenceService",
 		Version: "v1beta1",
 	})
-	err := t.k8sclient.Get(context.Background(), client.ObjectKey{
+	err := t.Get(client.ObjectKey{
 		Namespace: namespace,
 		Name:      name,
 	}, isvc)
 	return isvc, err
 }
 
+// IsInferenceService returns a boolean indicating if the given target reference names a v1beta1 InferenceService in the Kubernetes cluster.
+func IsInferenceService(c client.Client, targetRef string) (bool, error) {
+	namespace, name, err := getNN(targetRef)
+	if err != nil {
+		return false, nil
+	}
+	isvc := &unstructured.Unstructured{}
+	isvc.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "serving.kubeflow.org",
+		Kind:    "InferenceService",
+		Version: "v1beta1",
+	})
+	err = c.Get(context.Background(), client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}, isvc)
+	if err == nil {
+		return true, nil
+	}
+	if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
 // Fetch fetches the v1beta1 InferenceService object from the Kubernetes cluster and populates the target struct with it.
 // InferenceService may be unavailable at the start of this call. So, Fetch periodically attempts to fetch the InferenceService object for 180 sec.
 // Upon success, it returns the fetched object; if it does not succeed in 180 secs, it returns an error.
 func (t *Target) Fetch(targetRef string) target.Target {
-	if t.err != nil {
+	if t.Err != nil {
 		return t
 	}
+	defer t.StartSpan("Fetch")()
+	defer func(start time.Time) {
+		t.Observe("fetch", start, t.Err == nil)
+	}(time.Now())
 	// figure out name and namespace of the target
 	namespace, name, err := getNN(targetRef)
 	if err != nil {
-		t.err = errors.New("invalid target specification; v1beta1 target needs to be of the form: 'inference-service-namespace/inference-service-name'")
+		t.Err = errors.New("invalid target specification; v1beta1 target needs to be of the form: 'inference-service-namespace/inference-service-name'; " + err.Error())
 		return t
 	}
 	// go get inferenceService or set an error
-	// lines from here until return need to end up in a for loop.
-	isvc, err := t.fetch(namespace, name)
-	if err == nil {
-		t.infService = isvc
-		return t
-	}
-	ticker := time.NewTicker(t.interval * time.Second)
-	for i := 0; i < int(t.retries); i++ {
-		select {
-		case <-ticker.C:
-			isvc, err := t.fetch(namespace, name)
-			if err == nil {
-				t.infService = isvc
-				return t
-			}
+	fetched := t.Poll(t.Retries, func() bool {
+		var isvc *unstructured.Unstructured
+		if isvc, err = t.fetch(namespace, name); err != nil {
+			return false
 		}
+		t.infService = isvc
+		return true
+	})
+	if !fetched {
+		t.Err = errors.New("unable to fetch target; " + err.Error())
 	}
-	t.err = errors.New("unable to fetch target; " + err.Error())
 	return t
 }
 
 // GetConditions unmarshals conditions from status and returns a slice of conditions.
 func GetConditions(t *Target) ([]target.Condition, error) {
-	if t.err != nil {
+	if t.Err != nil {
 		return nil, errors.New("GetConditions called on erroneous target")
 	}
 	type resource struct {
@@ -141,92 +250,333 @@ func GetConditions(t *Target) ([]target.Condition, error) {
 }
 
 // getCond is a helper function for fetching the target and getting its readiness.
+// The target is ready if it is ready as a whole, and each of its components is ready.
 func getCond(t *Target) bool {
-	t.Fetch(t.exp.GetTargetRef())
+	t.Fetch(t.Exp.GetTargetRef())
 	cond, err := GetConditions(t)
-	if err == nil {
-		readyStr, _ := target.GetCondition(cond, "Ready")
-		return (readyStr == "True")
+	if err != nil {
+		return false
 	}
-	return false
+	if readyStr, _ := target.GetCondition(cond, "Ready"); readyStr != "True" {
+		return false
+	}
+	for _, component := range specComponents(t) {
+		if readyStr, _ := target.GetCondition(cond, componentConditions[component]); readyStr != "True" {
+			return false
+		}
+	}
+	return true
 }
 
 // EnsureReadiness ensures that the condition "Ready" has "Status" true in t.infService.
 // It periodically fetches t.infService and checks this condition.
 // Returns true if readiness is reached in 180 sec and false otherwise.
-func EnsureReadiness(t *Target) bool {
-	ready := getCond(t)
-	if ready {
-		return true
-	}
-	ticker := time.NewTicker(t.interval * time.Second)
-	for i := 0; i < int(t.retries); i++ {
-		select {
-		case <-ticker.C:
-			ready = getCond(t)
-			if ready {
-				return true
-			}
-		}
-	}
-	return false
+func EnsureReadiness(t *Target) (ready bool) {
+	defer t.StartSpan("EnsureReadiness")()
+	defer func(start time.Time) {
+		t.Observe("ensure_readiness", start, ready)
+	}(time.Now())
+	return t.Poll(t.Retries, func() bool { return getCond(t) })
 }
 
-// SetCanaryTrafficPercent sets spec.predictor.canaryTrafficPercent field to the given value.
+// SetCanaryTrafficPercent sets the field spec.<component>.canaryTrafficPercent of each traffic component of the target to the given value, so that traffic is split consistently across components.
 // After this step, the handler waits for (<=) 180 sec to ensure InferenceService object is ready.
 // If any of the above steps fail, the method returns after setting an error.
 func (t *Target) SetCanaryTrafficPercent(p int64) target.Target {
-	if t.err != nil {
+	if t.Err != nil {
 		return t
 	}
+	defer t.StartSpan("SetCanaryTrafficPercent")()
+	defer func(start time.Time) {
+		t.Observe("set_canary_traffic_percent", start, t.Err == nil)
+	}(time.Now())
 	// Make sure t.infService has already been fetched.
 	if t.infService == nil {
-		t.err = errors.New("unable to set canary traffic split; uninitialized inference service object")
+		t.Err = errors.New("unable to set canary traffic split; uninitialized inference service object")
 		return t
 	}
-	// Set spec.predictor.canaryTrafficPercent to p
-	payload := []struct {
-		Op    string `json:"op"`
-		Path  string `json:"path"`
-		Value int64  `json:"value"`
-	}{{"replace", "/spec/predictor/canaryTrafficPercent", p}}
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		t.err = errors.New("unable to marshal initial traffic split patch")
-		return t
+	// Set spec.<component>.canaryTrafficPercent to p
+	state := map[string]*int64{}
+	for _, component := range trafficComponents(t) {
+		state[component] = &p
 	}
 	// we have made sure InferenceService object exists in the cluster, above.
-	t.err = t.k8sclient.Patch(context.Background(), t.infService, client.RawPatch(types.JSONPatchType, payloadBytes))
-	if t.err != nil {
+	t.Err = setCanaryTrafficPercents(t, state)
+	if t.Err != nil {
 		return t
 	}
 	r := EnsureReadiness(t)
 	if !r {
-		t.err = errors.New("post-patch: unable to ensure readiness of inference service even after 180 seconds")
+		t.Err = errors.New("post-patch: unable to ensure readiness of inference service even after 180 seconds")
 	}
 	return t
 }
 
 // InitializeTrafficSplit initializes traffic split for the target.
-// The value of the field spec.predictor.canaryTrafficPercent is set to 1 (i.e., 1%).
+// The value of the field spec.<component>.canaryTrafficPercent of each traffic component is set to 1 (i.e., 1%), or to 0 for BlueGreen experiments.
 // After this step, the handler waits for (<=) 180 sec to ensure InferenceService object is ready.
 // If any of the above steps fail, the method returns after setting an error.
+// Single-version experiments leave the traffic split untouched; in this case, the method only ensures that the target does not have a canary revision.
+// In match mode, the field is set to 0 instead, and the router of the experiment routes only requests which match to the candidate.
 func (t *Target) InitializeTrafficSplit() target.Target {
-	return t.SetCanaryTrafficPercent(1)
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("InitializeTrafficSplit")()
+	if t.Exp != nil && t.Exp.IsSingleVersion() {
+		return t.ensureNoCanary()
+	}
+	match, err := getMatch(t)
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	p := int64(1)
+	if (t.Exp != nil && t.Exp.IsBlueGreen()) || match != nil {
+		p = 0
+	}
+	if t.Resume("InitializeTrafficSplit", func() bool {
+		return hasCanaryTrafficPercent(t, &p) && (match == nil || hasMatchRoute(t, match))
+	}) {
+		return t
+	}
+	defer t.Complete("InitializeTrafficSplit")
+	t.SetCanaryTrafficPercent(p)
+	if match != nil {
+		t.routeMatching(match)
+	}
+	return t
 }
 
-// GetVersionInfo constructs the VersionInfo object based on the target and returns it.
-func (t *Target) GetVersionInfo() (*etc3.VersionInfo, error) {
+// hasCanaryTrafficPercent is a helper function for fetching the target and checking if it is ready with the given value of spec.<component>.canaryTrafficPercent in each traffic component, or without this field if the given value is nil.
+func hasCanaryTrafficPercent(t *Target, p *int64) bool {
+	state := map[string]*int64{}
+	for _, component := range trafficComponents(t) {
+		state[component] = p
+	}
+	return hasTrafficState(t, state)
+}
+
+// hasTrafficState is a helper function for fetching the target and checking if it is ready with the given values of spec.<component>.canaryTrafficPercent, which map components to values, or to nil if the field is absent.
+func hasTrafficState(t *Target, state map[string]*int64) bool {
+	if !getCond(t) {
+		return false
+	}
+	for component, p := range state {
+		val, found, err := unstructured.NestedInt64(t.infService.Object, "spec", component, "canaryTrafficPercent")
+		if err != nil || found != (p != nil) {
+			return false
+		}
+		if p != nil && val != *p {
+			return false
+		}
+	}
+	return true
+}
+
+// setCanaryTrafficPercents is a helper function that sets the given values of spec.<component>.canaryTrafficPercent in the target, which map components to values, or to nil if the field is to be removed.
+func setCanaryTrafficPercents(t *Target, state map[string]*int64) error {
+	payloadBytes, err := canaryTrafficPatch(t.infService.Object, state)
+	if err != nil || payloadBytes == nil {
+		return err
+	}
+	return t.Patch(t.infService, client.RawPatch(types.JSONPatchType, payloadBytes))
+}
+
+// canaryTrafficPatch is a helper function that returns the JSON patch of the given InferenceService object which sets the given values of spec.<component>.canaryTrafficPercent, or nil if no change is needed.
+// Only components of InferenceServices are patched; values which are nil remove the field, if present.
+func canaryTrafficPatch(obj map[string]interface{}, state map[string]*int64) ([]byte, error) {
+	type op struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value *int64 `json:"value,omitempty"`
+	}
+	payload := []op{}
+	for _, component := range components {
+		p, ok := state[component]
+		if !ok {
+			continue
+		}
+		if _, found, _ := unstructured.NestedMap(obj, "spec", component); !found {
+			// a component cannot be added by setting its traffic
+			continue
+		}
+		path := "/spec/" + component + "/canaryTrafficPercent"
+		if p != nil {
+			payload = append(payload, op{"add", path, p})
+			continue
+		}
+		if _, found, _ := unstructured.NestedFieldNoCopy(obj, "spec", component, "canaryTrafficPercent"); found {
+			payload = append(payload, op{Op: "remove", Path: path})
+		}
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.New("unable to marshal canary traffic patch")
+	}
+	return payloadBytes, nil
+}
+
+// ensureNoCanary sets an error if the latest created revision of any component of the target differs from its latest rolled out revision.
+func (t *Target) ensureNoCanary() target.Target {
+	if t.infService == nil {
+		t.Err = errors.New("unable to verify traffic split; uninitialized inference service object")
+		return t
+	}
+	if _, _, err := getRevisions(t); err != nil {
+		t.Err = err
+		return t
+	}
+	for _, component := range canaryComponents(t) {
+		_, cRev, _ := getComponentRevisions(t, component)
+		t.Err = errors.New("single-version experiment needs a target without canary; found canary revision " + cRev)
+		return t
+	}
+	return t
+}
+
+// getRevisions is a helper function that returns the baseline and candidate revisions of the predictor of the target.
+// The baseline revision is the latest rolled out revision and the candidate revision is the latest created revision.
+func getRevisions(t *Target) (string, string, error) {
+	return getComponentRevisions(t, "predictor")
+}
+
+// getComponentRevisions is a helper function that returns the baseline and candidate revisions of the given component of the target.
+func getComponentRevisions(t *Target, component string) (string, string, error) {
 	// candidate
-	cRev, b1, err1 := unstructured.NestedString(t.infService.Object, "status", "components", "predictor", "latestCreatedRevision")
+	cRev, b1, err1 := unstructured.NestedString(t.infService.Object, "status", "components", component, "latestCreatedRevision")
 	// baseline
-	bRev, b2, err2 := unstructured.NestedString(t.infService.Object, "status", "components", "predictor", "latestRolledoutRevision")
+	bRev, b2, err2 := unstructured.NestedString(t.infService.Object, "status", "components", component, "latestRolledoutRevision")
 
 	if b1 == false || b2 == false || err1 != nil || err2 != nil {
-		return nil, errors.New("unable to extract default and canary revisions from target")
+		return "", "", errors.New("unable to extract default and canary revisions of " + component + " from target")
+	}
+	return bRev, cRev, nil
+}
+
+// specComponents is a helper function that returns the components present in the spec of the target.
+func specComponents(t *Target) []string {
+	present := []string{}
+	for _, component := range components {
+		if _, found, _ := unstructured.NestedMap(t.infService.Object, "spec", component); found {
+			present = append(present, component)
+		}
+	}
+	return present
+}
+
+// canaryComponents is a helper function that returns the components of the target whose latest created revision differs from their latest rolled out revision.
+func canaryComponents(t *Target) []string {
+	canaries := []string{}
+	for _, component := range specComponents(t) {
+		if bRev, cRev, err := getComponentRevisions(t, component); err == nil && bRev != cRev {
+			canaries = append(canaries, component)
+		}
+	}
+	return canaries
+}
+
+// trafficComponents is a helper function that returns the components of the target whose traffic is split during the experiment.
+// These are the components recorded in the traffic state snapshot of the experiment, if any. Otherwise, these are the components with a canary revision, or the predictor if no component has one.
+func trafficComponents(t *Target) []string {
+	if t.Exp != nil {
+		if snapshotStr, ok := t.Exp.GetAnnotations()[experiment.SnapshotAnnotation]; ok {
+			snapshot := Snapshot{}
+			if err := json.Unmarshal([]byte(snapshotStr), &snapshot); err == nil && len(snapshot.Components) > 0 {
+				recorded := []string{}
+				for _, component := range components {
+					if _, ok := snapshot.Components[component]; ok {
+						recorded = append(recorded, component)
+					}
+				}
+				return recorded
+			}
+		}
+	}
+	if t.infService != nil {
+		if canaries := canaryComponents(t); len(canaries) > 0 {
+			return canaries
+		}
+	}
+	return []string{"predictor"}
+}
+
+// hasCandidate is a helper function that checks if any of the components of the target has a candidate revision distinct from its baseline revision.
+func hasCandidate(t *Target) bool {
+	_, _, err := getRevisions(t)
+	return err == nil && len(canaryComponents(t)) > 0
+}
+
+// EnsureCandidate ensures that the latest created revision of some component of t.infService differs from its latest rolled out revision.
+// The candidate revision may not have been created at the start of this call. So, EnsureCandidate periodically fetches t.infService and checks its revisions until the candidate wait (180 sec by default) elapses.
+// If a candidate revision does not appear within this duration, the method returns after setting an error; this error is a *target.NoCandidateError if the baseline is also the latest created revision.
+func (t *Target) EnsureCandidate() target.Target {
+	if t.Err != nil {
+		return t
+	}
+	defer t.StartSpan("EnsureCandidate")()
+	if t.Exp == nil {
+		t.Err = errors.New("method EnsureCandidate called on a target with nil experiment")
+		return t
+	}
+	if t.infService == nil {
+		t.Err = errors.New("unable to find candidate; uninitialized inference service object")
+		return t
+	}
+	// Fetch retries on its own; so, each check gets the target in a single attempt
+	var err error
+	if t.Poll(t.CandidateRetries, func() bool {
+		var isvc *unstructured.Unstructured
+		if isvc, err = t.Refetch(t.infService); err != nil {
+			return false
+		}
+		t.infService = isvc
+		return hasCandidate(t)
+	}) || t.Err != nil {
+		return t
 	}
+	if err != nil {
+		t.Err = errors.New("unable to fetch target; " + err.Error())
+		return t
+	}
+	_, cRev, err := getRevisions(t)
+	if err != nil {
+		t.Err = err
+	} else if len(canaryComponents(t)) == 0 {
+		t.Err = &target.NoCandidateError{Revision: cRev}
+	}
+	return t
+}
 
-	ns, name, err3 := getNN(t.exp.GetTargetRef())
+// GetVersionInfo constructs the VersionInfo object based on the target and returns it.
+// The WeightObjRef of the candidate refers to the canaryTrafficPercent field of the first traffic component of the target, which is the predictor unless only other components have canary revisions.
+// etc3 supports a single WeightObjRef for each version; so, the traffic split of other traffic components is not changed by etc3 during the experiment. The handler splits traffic consistently across all traffic components at the start and finish of the experiment.
+func (t *Target) GetVersionInfo() (_ *etc3.VersionInfo, err error) {
+	_, span := tracing.Start(t.Ctx, "v1beta1.GetVersionInfo")
+	defer func() {
+		tracing.End(span, err)
+	}()
+	bRev, cRev, err := getRevisions(t)
+	if err != nil {
+		return nil, err
+	}
+	if t.Exp.IsSingleVersion() {
+		// the current revision is the only version
+		return &etc3.VersionInfo{
+			Baseline: etc3.VersionDetail{
+				Name: "default",
+				Tags: versionTags(t, "predictor", bRev, bRev == cRev),
+			},
+		}, nil
+	}
+	if len(canaryComponents(t)) == 0 {
+		return nil, &target.NoCandidateError{Revision: cRev}
+	}
+
+	ns, name, err3 := getNN(t.Exp.GetTargetRef())
 	if err3 != nil {
 		return nil, errors.New("unable to extract name and namespace of target")
 	}
@@ -234,80 +584,424 @@ func (t *Target) GetVersionInfo() (*etc3.VersionInfo, error) {
 	vi := etc3.VersionInfo{
 		Baseline: etc3.VersionDetail{
 			Name: "default",
-			Tags: &map[string]string{"revision": bRev},
+			Tags: versionTags(t, "predictor", bRev, false),
 		},
 		Candidates: []etc3.VersionDetail{
 			{
 				Name: "canary",
-				Tags: &map[string]string{"revision": cRev},
-				WeightObjRef: &v1.ObjectReference{
-					Kind:       "InferenceService",
-					Namespace:  ns,
-					Name:       name,
-					APIVersion: "serving.kubeflow.org/v1beta1",
-					FieldPath:  "/spec/predictor/canaryTrafficPercent",
-				},
+				Tags: versionTags(t, "predictor", cRev, true),
 			},
 		},
 	}
+	match, err := getMatch(t)
+	if err != nil {
+		return nil, err
+	}
+	if match == nil {
+		// in match mode, the router and not the traffic split decides which requests the candidate serves
+		vi.Candidates[0].WeightObjRef = &v1.ObjectReference{
+			Kind:       "InferenceService",
+			Namespace:  ns,
+			Name:       name,
+			APIVersion: "serving.kubeflow.org/v1beta1",
+			FieldPath:  "/spec/" + trafficComponents(t)[0] + "/canaryTrafficPercent",
+		}
+	}
 	return &vi, nil
 }
 
-// SetVersionInfoInExperiment sets version info in the experiment associated with this target.
-func (t *Target) SetVersionInfoInExperiment() target.Target {
-	if t.err != nil {
-		return t
+// versionTags is a helper function that returns the tags of the version with the given revision of the given component.
+// Tags are extracted from the Knative Revision of the version using the tag paths of the target. The spec of the InferenceService describes its latest created revision; so, tags of the latest revision are also extracted from this spec.
+// Variables declared in the variables annotation of the experiment are added to these tags, followed by the match of the experiment for the candidate in match mode, and the standard variables of the version.
+// Tags which cannot be extracted are omitted.
+func versionTags(t *Target, component string, rev string, latest bool) *map[string]string {
+	tags := map[string]string{}
+	if latest {
+		for name, value := range specTags(t) {
+			tags[name] = value
+		}
 	}
-	// get versionInfo
-	var vi *etc3.VersionInfo
-	vi, t.err = t.GetVersionInfo()
-	if t.err != nil {
-		return t
+	revision, err := getRevision(t, rev)
+	if err != nil {
+		t.LogEntry().Warn("unable to get tags of revision ", rev, "; ", err)
 	}
-	if vi == nil {
-		t.err = errors.New("Could not get versionInfo for experiment")
-		return t
+	for name, value := range revisionTags(t, revision) {
+		tags[name] = value
 	}
-	if !t.exp.IsSingleVersion() && len(vi.Candidates) == 0 {
-		t.err = errors.New("expected baseline and candidate; did not find candidate during GetVersionInfo")
-		return t
+	for name, value := range componentTags(t, latest) {
+		tags[name] = value
+	}
+	for name, value := range variableTags(t, rev) {
+		tags[name] = value
+	}
+	if latest {
+		for name, value := range matchTags(t) {
+			tags[name] = value
+		}
+	}
+	for name, value := range standardTags(t, component, rev, revision) {
+		tags[name] = value
+	}
+	return &tags
+}
+
+// componentTags is a helper function that returns the revisions of the components of the target other than the predictor, tagged as <component>Revision.
+// These are the latest created revisions for the latest version, and the latest rolled out revisions otherwise.
+func componentTags(t *Target, latest bool) map[string]string {
+	tags := map[string]string{}
+	for _, component := range specComponents(t) {
+		if component == "predictor" {
+			continue
+		}
+		if bRev, cRev, err := getComponentRevisions(t, component); err == nil {
+			if latest {
+				tags[component+"Revision"] = cRev
+			} else {
+				tags[component+"Revision"] = bRev
+			}
+		}
 	}
-	// patch experiment with versionInfo
-	payload := []struct {
-		Op    string            `json:"op"`
-		Path  string            `json:"path"`
-		Value *etc3.VersionInfo `json:"value"`
-	}{{"replace", "/spec/versionInfo", vi}}
+	return tags
+}
 
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		t.err = errors.New("unable to marshal experiment versionInfo patch")
-		return t
+// standardTags is a helper function that returns the standard variables of the version with the given revision of the given component, which metric queries may use to select the version.
+// The configuration and service of the version are the labels of its Knative Revision; they are omitted if the Revision is nil.
+func standardTags(t *Target, component string, rev string, revision *unstructured.Unstructured) map[string]string {
+	tags := map[string]string{
+		"revision":         rev,
+		"namespace":        t.infService.GetNamespace(),
+		"inferenceService": t.infService.GetName(),
+		"component":        component,
+	}
+	if revision != nil {
+		for name, label := range map[string]string{
+			"configuration": "serving.knative.dev/configuration",
+			"service":       "serving.knative.dev/service",
+		} {
+			if value, ok := revision.GetLabels()[label]; ok {
+				tags[name] = value
+			}
+		}
+	}
+	return tags
+}
+
+// variableTags is a helper function that returns the variables declared in the variables annotation of the experiment for the version with the given revision.
+// Each variable is the result of its JSONPath expression evaluated against the target, after replacing $revision in the expression with the given revision.
+func variableTags(t *Target, rev string) map[string]string {
+	tags := map[string]string{}
+	variablesStr, ok := t.Exp.GetAnnotations()[experiment.VariablesAnnotation]
+	if !ok {
+		return tags
+	}
+	variables := map[string]string{}
+	if err := json.Unmarshal([]byte(variablesStr), &variables); err != nil {
+		t.LogEntry().Warn("ignoring invalid variables annotation: ", err)
+		return tags
+	}
+	for name, path := range variables {
+		value, err := evalJSONPath(name, strings.ReplaceAll(path, "$revision", rev), t.infService.Object)
+		if err != nil {
+			t.LogEntry().Warn("ignoring variable ", name, "; ", err)
+			continue
+		}
+		if value != "" {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// evalJSONPath is a helper function that returns the result of the given JSONPath expression evaluated against the given object.
+// The result is empty if the expression refers to fields which are missing in the object.
+func evalJSONPath(name string, path string, obj map[string]interface{}) (string, error) {
+	jp := jsonpath.New(name).AllowMissingKeys(true)
+	if err := jp.Parse(path); err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := jp.Execute(buf, obj); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// specTags is a helper function that returns the tags extracted from the predictor spec of the target.
+func specTags(t *Target) map[string]string {
+	tags := map[string]string{}
+	predictor, _, _ := unstructured.NestedMap(t.infService.Object, "spec", "predictor")
+	for _, framework := range frameworks {
+		spec, ok := predictor[framework].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tags["framework"] = framework
+		for name, fields := range map[string][]string{
+			"runtimeVersion": {"runtimeVersion"},
+			"storageUri":     {"storageUri"},
+			"cpuRequest":     {"resources", "requests", "cpu"},
+			"memoryRequest":  {"resources", "requests", "memory"},
+		} {
+			if value, found, err := unstructured.NestedString(spec, fields...); found && err == nil {
+				tags[name] = value
+			}
+		}
+		return tags
+	}
+	if _, ok := predictor["containers"]; ok {
+		tags["framework"] = "custom"
+	}
+	return tags
+}
+
+// getRevision is a helper function that fetches the Knative Revision with the given name in the namespace of the target.
+func getRevision(t *Target, rev string) (*unstructured.Unstructured, error) {
+	revision := &unstructured.Unstructured{}
+	revision.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "serving.knative.dev",
+		Kind:    "Revision",
+		Version: "v1",
+	})
+	if err := t.Get(client.ObjectKey{
+		Namespace: t.infService.GetNamespace(),
+		Name:      rev,
+	}, revision); err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// revisionTags is a helper function that returns the tags extracted from the given Knative Revision using the tag paths of the target.
+// If the Revision is nil, no tags are extracted.
+func revisionTags(t *Target, revision *unstructured.Unstructured) map[string]string {
+	tags := map[string]string{}
+	if revision == nil {
+		return tags
 	}
-	t.err = t.k8sclient.Patch(context.Background(), t.exp.Experiment, client.RawPatch(types.JSONPatchType, payloadBytes))
+	for name, path := range t.tagPaths {
+		if value, err := evalJSONPath(name, path, revision.Object); err == nil && value != "" {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// SetVersionInfoInExperiment sets version info in the experiment associated with this target.
+func (t *Target) SetVersionInfoInExperiment() target.Target {
+	t.SetVersionInfo(t.GetVersionInfo)
 	return t
 }
 
 // SetNewBaseline sets a new baseline (i.e., 'default' version) within the target
 func (t *Target) SetNewBaseline() target.Target {
-	if t.err != nil {
-		return t
+	steps := target.BaselineSteps{
+		IsSet:      func(recommended string) bool { return hasNewBaseline(t, recommended) },
+		IsRestored: func() bool { return isRestored(t) },
+		// requests which match are routed by the traffic split again before the new baseline is set
+		Prepare: t.removeMatchRoute,
+		Restore: func() { t.RestoreTrafficState() },
+		Shift:   func(string) { t.SetCanaryTrafficPercent(100) },
+		IsReady: func() bool { return getCond(t) },
+		Unready: "inference service became un-ready after cutover",
+	}
+	if t.finishMode == FinishModePromote {
+		steps.Promote = func(string) { t.promote() }
+	}
+	t.SetBaseline(t.infService, steps)
+	return t
+}
+
+// hasNewBaseline is a helper function for fetching the target and checking if it is ready with the given recommended baseline as its new baseline.
+// In match mode, the router must also no longer route matching requests to the candidate.
+func hasNewBaseline(t *Target, recommendedBaseline string) bool {
+	if match, err := getMatch(t); err != nil || match != nil && !hasMatchRoute(t, nil) {
+		return false
+	}
+	if recommendedBaseline != "canary" {
+		return isRestored(t)
+	}
+	// a promoted canary, including one promoted after a BlueGreen cutover, has no canaryTrafficPercent
+	if t.finishMode != FinishModePromote {
+		full := int64(100)
+		return hasCanaryTrafficPercent(t, &full)
+	}
+	rev, err := t.Exp.GetVersionTag("canary", "revision")
+	if err != nil {
+		return false
+	}
+	return hasCanaryTrafficPercent(t, nil) && isRolledOut(t, rev)
+}
+
+// isRestored is a helper function for fetching the target and checking if it is ready with the traffic state recorded in the snapshot annotation of the experiment.
+func isRestored(t *Target) bool {
+	snapshotStr, ok := t.Exp.GetAnnotations()[experiment.SnapshotAnnotation]
+	if !ok {
+		zero := int64(0)
+		return hasCanaryTrafficPercent(t, &zero)
 	}
-	if t.exp == nil {
-		t.err = errors.New("method SetNewBaseline called on a target with nil experiment")
+	state, err := snapshotTrafficState(snapshotStr)
+	return err == nil && hasTrafficState(t, state)
+}
+
+// snapshotTrafficState is a helper function that unmarshals the given traffic state snapshot and returns the values of spec.<component>.canaryTrafficPercent recorded in it.
+func snapshotTrafficState(snapshotStr string) (map[string]*int64, error) {
+	snapshot := Snapshot{}
+	if err := json.Unmarshal([]byte(snapshotStr), &snapshot); err != nil {
+		return nil, errors.New("unable to unmarshal traffic state snapshot; " + err.Error())
+	}
+	if len(snapshot.Components) == 0 {
+		return nil, errors.New("no components found in traffic state snapshot")
+	}
+	state := map[string]*int64{}
+	for component, cs := range snapshot.Components {
+		state[component] = cs.CanaryTrafficPercent
+	}
+	return state, nil
+}
+
+// removeCanaryTrafficPercent is a helper function that removes spec.<component>.canaryTrafficPercent from each traffic component of the target, if present.
+func removeCanaryTrafficPercent(t *Target) error {
+	state := map[string]*int64{}
+	for _, component := range trafficComponents(t) {
+		state[component] = nil
+	}
+	return setCanaryTrafficPercents(t, state)
+}
+
+// isRolledOut is a helper function for fetching the target and checking if the given revision is its latest rolled out revision.
+// The canary revisions of other traffic components recorded in the versionInfo of the experiment, if any, should also be rolled out.
+func isRolledOut(t *Target, rev string) bool {
+	if !getCond(t) {
+		return false
+	}
+	bRev, _, err := getRevisions(t)
+	if err != nil || bRev != rev {
+		return false
+	}
+	for _, component := range trafficComponents(t) {
+		if component == "predictor" {
+			continue
+		}
+		cRev, err := t.Exp.GetVersionTag("canary", component+"Revision")
+		if err != nil {
+			continue
+		}
+		if bRev, _, err := getComponentRevisions(t, component); err != nil || bRev != cRev {
+			return false
+		}
+	}
+	return true
+}
+
+// promote removes the field spec.<component>.canaryTrafficPercent from each traffic component so that KFServing rolls out the winning canary as the default revision.
+// After this step, the handler waits for (<=) 180 sec to ensure that the winning revision is the latest rolled out revision and InferenceService object is ready.
+// If any of the above steps fail, the method returns after setting an error.
+func (t *Target) promote() target.Target {
+	if t.Err != nil {
 		return t
 	}
-	if t.exp.IsSingleVersion() {
-		t.err = errors.New("method SetNewBaseline called on a target with a single-version experiment")
+	defer t.StartSpan("Promote")()
+	if t.infService == nil {
+		t.Err = errors.New("unable to promote canary; uninitialized inference service object")
 		return t
 	}
-	recommendedBaseline, err := t.exp.GetRecommendedBaseline()
+	// the winning revision is the canary revision recorded during start, or else the latest created revision
+	rev, err := t.Exp.GetVersionTag("canary", "revision")
 	if err != nil {
-		t.err = errors.New("error in getting recommended baseline from experiment")
+		if _, rev, err = getRevisions(t); err != nil {
+			t.Err = err
+			return t
+		}
+	}
+	if t.Err = removeCanaryTrafficPercent(t); t.Err != nil {
 		return t
 	}
-	if recommendedBaseline == "canary" {
-		return t.SetCanaryTrafficPercent(100)
+	if t.Poll(t.Retries, func() bool { return isRolledOut(t, rev) }) {
+		return t
+	}
+	if t.Err == nil {
+		t.Err = errors.New("post-promotion: revision " + rev + " is not the latest rolled out revision of a ready inference service even after 180 seconds")
+	}
+	return t
+}
+
+// RecordAssessedVersion records the revision assessed in a single-version experiment as an annotation of the experiment.
+// The assessed revision is the baseline revision recorded in the versionInfo of the experiment during start.
+func (t *Target) RecordAssessedVersion() target.Target {
+	rev := t.RecordAssessed("revision")
+	if t.Err == nil && t.infService != nil {
+		if bRev, _, err := getRevisions(t); err == nil && bRev != rev {
+			t.LogEntry().Warn("assessed revision ", rev, " is no longer the current revision ", bRev)
+		}
 	}
-	return t.SetCanaryTrafficPercent(0)
+	return t
+}
+
+// SnapshotTrafficState records the traffic state of the target in the snapshot annotation of the experiment.
+// The snapshot records each traffic component of the target, which are the components with canary revisions; so, it should be recorded after the candidate appears. Traffic is split on the recorded components for the rest of the experiment.
+func (t *Target) SnapshotTrafficState() target.Target {
+	t.Snapshot(t.infService, func() (interface{}, error) {
+		snapshot := Snapshot{Components: map[string]ComponentSnapshot{}}
+		for _, component := range trafficComponents(t) {
+			cs := ComponentSnapshot{}
+			p, found, err := unstructured.NestedInt64(t.infService.Object, "spec", component, "canaryTrafficPercent")
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				cs.CanaryTrafficPercent = &p
+			}
+			cs.LatestRolledoutRevision, cs.LatestCreatedRevision, _ = getComponentRevisions(t, component)
+			snapshot.Components[component] = cs
+		}
+		return snapshot, nil
+	})
+	return t
+}
+
+// RestoreTrafficState restores the traffic state of the target recorded in the snapshot annotation of the experiment.
+// Fields which were absent when the snapshot was recorded are removed from the target.
+// Experiments without a snapshot are restored by setting spec.<component>.canaryTrafficPercent of each traffic component to 0.
+// After this step, the handler waits for (<=) 180 sec to ensure InferenceService object is ready.
+// If any of the above steps fail, the method returns after setting an error.
+func (t *Target) RestoreTrafficState() target.Target {
+	t.Restore(t.infService, func() {
+		snapshotStr, ok := t.Exp.GetAnnotations()[experiment.SnapshotAnnotation]
+		if !ok {
+			t.LogEntry().Warn("traffic state snapshot not found in experiment; shifting all traffic to baseline")
+			t.SetCanaryTrafficPercent(0)
+			return
+		}
+		state, err := snapshotTrafficState(snapshotStr)
+		if err != nil {
+			t.Err = err
+			return
+		}
+		// fields which were absent before the experiment are removed
+		if t.Err = setCanaryTrafficPercents(t, state); t.Err != nil {
+			return
+		}
+		if !EnsureReadiness(t) && t.Err == nil {
+			t.Err = errors.New("post-patch: unable to ensure readiness of inference service even after 180 seconds")
+		}
+	})
+	return t
+}
+
+// Claim claims the target for the experiment by recording the experiment in the lock annotation of the target.
+// If the target is claimed by another experiment which still exists, the method returns after setting a *target.LockedError.
+// Locks of deleted experiments are stale; they are taken over by the experiment.
+func (t *Target) Claim() target.Target {
+	t.ClaimObject(t.infService)
+	return t
+}
+
+// Release releases the claim of the experiment on the target by removing the lock annotation of the target.
+// Locks held by other experiments are left unchanged.
+func (t *Target) Release() target.Target {
+	t.ReleaseObject(func() *unstructured.Unstructured {
+		t.Fetch(t.Exp.GetTargetRef())
+		return t.infService
+	})
+	return t
 }
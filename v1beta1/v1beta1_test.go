@@ -1,21 +1,33 @@
 package v1beta1
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math/rand"
+	"reflect"
 	"testing"
+	"testing/quick"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	etc3 "github.com/iter8-tools/etc3/api/v2alpha1"
 	"github.com/iter8-tools/iter8ctl/utils"
 
 	"github.com/iter8-tools/iter8-kfserving-handler/experiment"
+	"github.com/iter8-tools/iter8-kfserving-handler/fakekfserving"
 	"github.com/iter8-tools/iter8-kfserving-handler/target"
+	"github.com/iter8-tools/iter8-kfserving-handler/target/targettest"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
@@ -67,14 +79,14 @@ func TestSetK8sClient(t *testing.T) {
 	scheme := runtime.NewScheme()
 	c := fake.NewClientBuilder().WithScheme(scheme).Build()
 	x.SetK8sClient(c)
-	assert.Equal(t, x.k8sclient, c)
+	assert.Equal(t, x.K8sClient, c)
 }
 
 func TestSetExperiment(t *testing.T) {
 	x := TargetBuilder()
 	e := &experiment.Experiment{}
 	x.SetExperiment(e)
-	assert.Equal(t, x.exp, e)
+	assert.Equal(t, x.Exp, e)
 }
 
 func TestGetNN(t *testing.T) {
@@ -97,29 +109,67 @@ func TestGetNN(t *testing.T) {
 
 	namespace, name, err = getNN("")
 	assert.Error(t, err)
+
+	namespace, name, err = getNN("inferenceservices.serving.kubeflow.org/myns/myname")
+	assert.Equal(t, "myns", namespace)
+	assert.Equal(t, "myname", name)
+	assert.NoError(t, err)
+
+	for _, ref := range []string{"Deployment/myns/myname", "inferenceservices.example.com/myns/myname", "myns/my.name", "myns/1name", "Myns/myname"} {
+		_, _, err = getNN(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestGetNNAcceptsOnlyInferenceServiceRefs(t *testing.T) {
+	for _, ref := range []string{"myns/myname", "isvc/myns/myname", "v1beta1/myns/myname", "myns/my.name", "", "InferenceService/myns/myname", "trainedmodels/myns/myname"} {
+		namespace, name, err := getNN(ref)
+		if err != nil {
+			continue
+		}
+		// accepted references are valid target references of InferenceServices
+		r, err := target.ParseRef(ref)
+		assert.NoError(t, err, ref)
+		assert.True(t, isInferenceServiceKind(r), ref)
+		assert.Equal(t, r.Namespace+"/"+r.Name, namespace+"/"+name, ref)
+	}
+}
+
+func TestIsInferenceService(t *testing.T) {
+	c := getK8sClientWithMyTarget()
+	ok, err := IsInferenceService(c, "myns/myname")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = IsInferenceService(c, "myns/othername")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = IsInferenceService(c, "myname")
+	assert.NoError(t, err)
+	assert.False(t, ok)
 }
 
 func TestFetch(t *testing.T) {
 	c := getK8sClientWithMyTarget()
 	targ := TargetBuilder()
 	targ.SetK8sClient(c).Fetch("myns/myname")
-	assert.NoError(t, targ.err)
+	assert.NoError(t, targ.Err)
 }
 
 func TestFetchBadTarget(t *testing.T) {
 	c := getK8sClientWithMyTarget()
 	targ := TargetBuilder()
 	targ.SetK8sClient(c).Fetch("myname")
-	assert.Error(t, targ.err)
+	assert.Error(t, targ.Err)
 }
 
 func TestFetchNonExisting(t *testing.T) {
 	c := fake.NewClientBuilder().Build()
 	targ := TargetBuilder()
-	targ.retries = 3
-	targ.interval = 1
+	targ.Retries = 3
+	targ.Interval = 1
+	targ.SetClock(targettest.NewSteppingClock())
 	targ.SetK8sClient(c).Fetch("myns/myname")
-	assert.Error(t, targ.err)
+	assert.Error(t, targ.Err)
 }
 
 func TestGetCond(t *testing.T) {
@@ -132,9 +182,9 @@ func TestGetCond(t *testing.T) {
 		WithTarget("default/my-model").
 		WithStrategy(etc3.StrategyTypeCanary).
 		Build()
-	targ.exp = experiment.Builder(exp)
+	targ.Exp = experiment.Builder(exp)
 	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
-	assert.NoError(t, targ.err)
+	assert.NoError(t, targ.Err)
 	cond := getCond(targ)
 	assert.True(t, cond)
 }
@@ -149,10 +199,10 @@ func TestGetConditions(t *testing.T) {
 		WithTarget("default/my-model").
 		WithStrategy(etc3.StrategyTypeCanary).
 		Build()
-	targ.exp = experiment.Builder(exp)
-	t.Log("targetRef: ", targ.exp.GetTargetRef())
+	targ.Exp = experiment.Builder(exp)
+	t.Log("targetRef: ", targ.Exp.GetTargetRef())
 	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
-	assert.NoError(t, targ.err)
+	assert.NoError(t, targ.Err)
 	cond, err := GetConditions(targ)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, cond)
@@ -170,9 +220,9 @@ func TestInitializeTrafficSplit(t *testing.T) {
 		WithTarget("default/my-model").
 		WithStrategy(etc3.StrategyTypeCanary).
 		Build()
-	targ.exp = experiment.Builder(exp)
+	targ.Exp = experiment.Builder(exp)
 	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
-	assert.NoError(t, targ.err)
+	assert.NoError(t, targ.Err)
 
 	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
 	assert.True(t, b)
@@ -180,16 +230,85 @@ func TestInitializeTrafficSplit(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestEnsureCandidate(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").EnsureCandidate()
+	assert.NoError(t, targ.Err)
+}
+
+func TestEnsureCandidateNoNewRevision(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	targ.Interval = 1
+	targ.SetClock(targettest.NewSteppingClock())
+	targ.SetCandidateWait(2 * time.Second)
+	assert.Equal(t, uint(2), targ.CandidateRetries)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").EnsureCandidate()
+	var nce *target.NoCandidateError
+	assert.True(t, errors.As(targ.Err, &nce))
+	assert.Equal(t, "my-model-predictor-default-wl2cv", nce.Revision)
+}
+
+func TestGetVersionInfoNoCandidate(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	assert.NoError(t, targ.Err)
+	_, err = targ.GetVersionInfo()
+	var nce *target.NoCandidateError
+	assert.True(t, errors.As(err, &nce))
+}
+
 // used in the following two tests
 var expectedVersionInfo = &etc3.VersionInfo{
 	Baseline: etc3.VersionDetail{
 		Name: "default",
-		Tags: &map[string]string{"revision": "my-model-predictor-default-wl2cv"},
+		Tags: &map[string]string{
+			"revision":         "my-model-predictor-default-wl2cv",
+			"namespace":        "default",
+			"inferenceService": "my-model",
+			"component":        "predictor",
+		},
 	},
 	Candidates: []etc3.VersionDetail{
 		{
 			Name: "canary",
-			Tags: &map[string]string{"revision": "my-model-predictor-default-zwjbq"},
+			Tags: &map[string]string{
+				"revision":         "my-model-predictor-default-zwjbq",
+				"namespace":        "default",
+				"inferenceService": "my-model",
+				"component":        "predictor",
+				"framework":        "tensorflow",
+				"runtimeVersion":   "1.14.0",
+				"storageUri":       "gs://kfserving-samples/models/tensorflow/flowers-2",
+				"cpuRequest":       "1",
+				"memoryRequest":    "2Gi",
+			},
 			WeightObjRef: &v1.ObjectReference{
 				Kind:       "InferenceService",
 				Namespace:  "default",
@@ -211,9 +330,9 @@ func TestGetVersionInfo(t *testing.T) {
 		WithTarget("default/my-model").
 		WithStrategy(etc3.StrategyTypeCanary).
 		Build()
-	targ.exp = experiment.Builder(exp)
+	targ.Exp = experiment.Builder(exp)
 	targ.SetK8sClient(c).Fetch("default/my-model")
-	assert.NoError(t, targ.err)
+	assert.NoError(t, targ.Err)
 	vi, err := targ.GetVersionInfo()
 	assert.NotEmpty(t, vi)
 	assert.NoError(t, err)
@@ -231,15 +350,15 @@ func TestSetVersionInfoInExperiment(t *testing.T) {
 		WithTarget("default/my-model").
 		WithStrategy(etc3.StrategyTypeCanary).
 		Build()
-	targ.exp = experiment.Builder(exp)
-	err = c.Create(context.Background(), targ.exp.Experiment)
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
 	if err != nil {
 		t.Fatal("Cannot populate fake cluster with experiment", err)
 	}
-	assert.NotEqual(t, expectedVersionInfo, targ.exp.Spec.VersionInfo)
+	assert.NotEqual(t, expectedVersionInfo, targ.Exp.Spec.VersionInfo)
 	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit().SetVersionInfoInExperiment()
-	assert.NoError(t, targ.err)
-	assert.Equal(t, expectedVersionInfo, targ.exp.Spec.VersionInfo)
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, expectedVersionInfo, targ.Exp.Spec.VersionInfo)
 }
 
 func TestSetNewBaselineCanary(t *testing.T) {
@@ -254,15 +373,15 @@ func TestSetNewBaselineCanary(t *testing.T) {
 		Build()
 	rb := "canary"
 	exp.Status.RecommendedBaseline = &rb
-	targ.exp = experiment.Builder(exp)
-	err = c.Create(context.Background(), targ.exp.Experiment)
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
 	if err != nil {
 		t.Fatal("Cannot populate fake cluster with experiment", err)
 	}
-	assert.NotEqual(t, expectedVersionInfo, targ.exp.Spec.VersionInfo)
+	assert.NotEqual(t, expectedVersionInfo, targ.Exp.Spec.VersionInfo)
 	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit().SetVersionInfoInExperiment()
-	assert.NoError(t, targ.err)
-	assert.Equal(t, expectedVersionInfo, targ.exp.Spec.VersionInfo)
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, expectedVersionInfo, targ.Exp.Spec.VersionInfo)
 	targ.SetNewBaseline()
 
 	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
@@ -283,19 +402,1006 @@ func TestSetNewBaselineDefault(t *testing.T) {
 		Build()
 	rb := "default"
 	exp.Status.RecommendedBaseline = &rb
-	targ.exp = experiment.Builder(exp)
-	err = c.Create(context.Background(), targ.exp.Experiment)
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
 	if err != nil {
 		t.Fatal("Cannot populate fake cluster with experiment", err)
 	}
-	assert.NotEqual(t, expectedVersionInfo, targ.exp.Spec.VersionInfo)
+	assert.NotEqual(t, expectedVersionInfo, targ.Exp.Spec.VersionInfo)
 	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit().SetVersionInfoInExperiment()
-	assert.NoError(t, targ.err)
-	assert.Equal(t, expectedVersionInfo, targ.exp.Spec.VersionInfo)
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, expectedVersionInfo, targ.Exp.Spec.VersionInfo)
+	targ.SetNewBaseline()
+
+	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(0), i)
+	assert.NoError(t, err)
+}
+
+func TestInitializeTrafficSplitSingleVersion(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypePerformance).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+
+	_, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.False(t, b)
+	assert.NoError(t, err)
+}
+
+func TestInitializeTrafficSplitSingleVersionWithCanary(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypePerformance).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
+	assert.Error(t, targ.Err)
+}
+
+func TestRecordAssessedVersion(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypePerformance).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Empty(t, targ.Exp.Spec.VersionInfo.Candidates)
+	targ.RecordAssessedVersion()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, "my-model-predictor-default-wl2cv", targ.Exp.GetAnnotations()[experiment.AssessedRevisionAnnotation])
+}
+
+func TestRecordAssessedVersionMultiVersion(t *testing.T) {
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.RecordAssessedVersion()
+	assert.Error(t, targ.Err)
+}
+
+func TestInitializeTrafficSplitBlueGreen(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeBlueGreen).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+
+	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(0), i)
+	assert.NoError(t, err)
+}
+
+func TestSetNewBaselineBlueGreen(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	targ.Interval = 1
+	targ.SetClock(targettest.NewSteppingClock())
+	targ.SetVerificationWindow(2 * time.Second)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeBlueGreen).
+		Build()
+	rb := "canary"
+	exp.Status.RecommendedBaseline = &rb
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit().SetNewBaseline()
+	assert.NoError(t, targ.Err)
+
+	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(100), i)
+	assert.NoError(t, err)
+}
+
+func TestSetNewBaselineBlueGreenRevert(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	targ.Retries = 1
+	targ.Interval = 1
+	targ.SetClock(targettest.NewSteppingClock())
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeBlueGreen).
+		Build()
+	rb := "canary"
+	exp.Status.RecommendedBaseline = &rb
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	// the inference service becomes un-ready
+	err = c.Patch(context.Background(), targ.infService, client.RawPatch(types.MergePatchType,
+		[]byte(`{"status":{"conditions":[{"type":"Ready","status":"False"}]}}`)))
+	assert.NoError(t, err)
 	targ.SetNewBaseline()
+	assert.Error(t, targ.Err)
 
 	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
 	assert.True(t, b)
 	assert.Equal(t, int64(0), i)
 	assert.NoError(t, err)
 }
+
+func TestSetFinishMode(t *testing.T) {
+	targ := TargetBuilder()
+	assert.Equal(t, FinishModeTraffic, targ.finishMode)
+	targ.SetFinishMode(FinishModePromote)
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, FinishModePromote, targ.finishMode)
+	targ.SetFinishMode("invalid")
+	assert.Error(t, targ.Err)
+}
+
+func TestSetNewBaselinePromote(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	targ.SetFinishMode(FinishModePromote)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	rb := "canary"
+	exp.Status.RecommendedBaseline = &rb
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ.SetK8sClient(c).Fetch("default/my-model").InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	// KFServing rolls out the canary revision once canaryTrafficPercent is removed
+	err = c.Patch(context.Background(), targ.infService, client.RawPatch(types.MergePatchType,
+		[]byte(`{"status":{"components":{"predictor":{"latestRolledoutRevision":"my-model-predictor-default-zwjbq"}}}}`)))
+	assert.NoError(t, err)
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+
+	_, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.False(t, b)
+	assert.NoError(t, err)
+
+	// a subsequent experiment can set the traffic split again
+	targ.SetCanaryTrafficPercent(1)
+	assert.NoError(t, targ.Err)
+}
+
+func TestSetNewBaselinePromoteNotRolledOut(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	targ.Retries = 1
+	targ.Interval = 1
+	targ.SetClock(targettest.NewSteppingClock())
+	targ.SetFinishMode(FinishModePromote)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	rb := "canary"
+	exp.Status.RecommendedBaseline = &rb
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").SetNewBaseline()
+	assert.Error(t, targ.Err)
+}
+
+func TestSnapshotTrafficState(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ.SetK8sClient(c).Fetch("default/my-model").SnapshotTrafficState()
+	assert.NoError(t, targ.Err)
+	snapshot := Snapshot{}
+	err = json.Unmarshal([]byte(targ.Exp.GetAnnotations()[experiment.SnapshotAnnotation]), &snapshot)
+	assert.NoError(t, err)
+	one := int64(1)
+	assert.Equal(t, Snapshot{
+		Components: map[string]ComponentSnapshot{
+			"predictor": {
+				CanaryTrafficPercent:    &one,
+				LatestCreatedRevision:   "my-model-predictor-default-zwjbq",
+				LatestRolledoutRevision: "my-model-predictor-default-wl2cv",
+			},
+		},
+	}, snapshot)
+
+	// an existing snapshot is not overwritten
+	before := targ.Exp.GetAnnotations()[experiment.SnapshotAnnotation]
+	targ.SetCanaryTrafficPercent(50).SnapshotTrafficState()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, before, targ.Exp.GetAnnotations()[experiment.SnapshotAnnotation])
+}
+
+func TestRestoreTrafficState(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	rb := "default"
+	exp.Status.RecommendedBaseline = &rb
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ.SetK8sClient(c).Fetch("default/my-model").SnapshotTrafficState()
+	targ.SetCanaryTrafficPercent(50).SetNewBaseline()
+	assert.NoError(t, targ.Err)
+
+	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(1), i)
+	assert.NoError(t, err)
+}
+
+func TestRestoreTrafficStateAbsentField(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	err = c.Create(context.Background(), targ.Exp.Experiment)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	assert.NoError(t, removeCanaryTrafficPercent(targ))
+	targ.SnapshotTrafficState().InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	_, b, _ := unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	targ.RestoreTrafficState()
+	assert.NoError(t, targ.Err)
+	_, b, err = unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.False(t, b)
+	assert.NoError(t, err)
+}
+
+func TestRestoreTrafficStateNoSnapshotLogsWarning(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	logger, hook := test.NewNullLogger()
+	targ := TargetBuilder()
+	targ.SetLogger(logger.WithField("phase", "finish"))
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model").RestoreTrafficState()
+	assert.NoError(t, targ.Err)
+
+	entry := hook.LastEntry()
+	assert.NotNil(t, entry)
+	assert.Equal(t, log.WarnLevel, entry.Level)
+	assert.Equal(t, "finish", entry.Data["phase"])
+	assert.Equal(t, "myexp", entry.Data["experiment"])
+	assert.Equal(t, "default", entry.Data["namespace"])
+	assert.Equal(t, "default/my-model", entry.Data["target"])
+}
+
+// getResumableTarget returns a resumable target with an experiment of the given strategy, which is populated in the fake cluster.
+func getResumableTarget(t *testing.T, c client.Client, strategy etc3.StrategyType) *Target {
+	targ := TargetBuilder()
+	targ.SetResumable(true)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(strategy).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	err := c.Create(context.Background(), targ.Exp.Experiment)
+	if err != nil {
+		t.Fatal("Cannot populate fake cluster with experiment", err)
+	}
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	return targ
+}
+
+// rerun returns a new resumable target for the experiment of the given target, as in a rerun of the handler.
+func rerun(t *testing.T, c client.Client, targ *Target) *Target {
+	exp := &etc3.Experiment{}
+	err := c.Get(context.Background(), client.ObjectKeyFromObject(targ.Exp.Experiment), exp)
+	if err != nil {
+		t.Fatal("Cannot get experiment", err)
+	}
+	next := TargetBuilder()
+	next.SetResumable(true)
+	next.Exp = experiment.Builder(exp)
+	next.SetK8sClient(c).Fetch("default/my-model")
+	return next
+}
+
+func TestResumeStart(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []string{"InitializeTrafficSplit", "SetVersionInfoInExperiment"}, targ.CompletedSteps())
+
+	// completed steps are not run again
+	next := rerun(t, c, targ)
+	isvcVersion := next.infService.GetResourceVersion()
+	expVersion := next.Exp.GetResourceVersion()
+	next.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, isvcVersion, next.infService.GetResourceVersion())
+	assert.Equal(t, expVersion, next.Exp.GetResourceVersion())
+}
+
+func TestResumeStartLiveStateMismatch(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	// the traffic split changes after the step completed
+	err = c.Patch(context.Background(), targ.infService, client.RawPatch(types.MergePatchType,
+		[]byte(`{"spec":{"predictor":{"canaryTrafficPercent":50}}}`)))
+	assert.NoError(t, err)
+
+	next := rerun(t, c, targ)
+	next.InitializeTrafficSplit()
+	assert.NoError(t, next.Err)
+	i, b, err := unstructured.NestedInt64(next.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(1), i)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"InitializeTrafficSplit"}, next.CompletedSteps())
+}
+
+func TestResumeFinish(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	rb := "canary"
+	targ.Exp.Status.RecommendedBaseline = &rb
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, []string{"SetNewBaseline"}, targ.CompletedSteps())
+
+	next := rerun(t, c, targ)
+	next.Exp.Status.RecommendedBaseline = &rb
+	isvcVersion := next.infService.GetResourceVersion()
+	next.SetNewBaseline()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, isvcVersion, next.infService.GetResourceVersion())
+}
+
+func TestNotResumable(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.SetResumable(false)
+	targ.InitializeTrafficSplit()
+	assert.NoError(t, targ.Err)
+	assert.Empty(t, targ.CompletedSteps())
+}
+
+func TestClaimAndRelease(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.Claim()
+	assert.NoError(t, targ.Err)
+	lock, err := target.GetLock(targ.infService)
+	assert.NoError(t, err)
+	assert.Equal(t, &Lock{Namespace: "default", Name: "myexp"}, lock)
+	// claims are idempotent
+	targ.Claim()
+	assert.NoError(t, targ.Err)
+
+	// another experiment cannot claim the target
+	other := TargetBuilder()
+	otherExp := etc3.NewExperiment("otherexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	other.Exp = experiment.Builder(otherExp)
+	other.SetK8sClient(c).Fetch("default/my-model").Claim()
+	lockedErr, ok := other.Err.(*target.LockedError)
+	assert.True(t, ok)
+	assert.Equal(t, &target.LockedError{Namespace: "default", Name: "myexp"}, lockedErr)
+	// nor release it
+	other.Err = nil
+	other.Release()
+	assert.NoError(t, other.Err)
+	assert.Contains(t, other.infService.GetAnnotations(), LockAnnotation)
+
+	targ.Release()
+	assert.NoError(t, targ.Err)
+	assert.NotContains(t, targ.infService.GetAnnotations(), LockAnnotation)
+	other.Fetch("default/my-model").Claim()
+	assert.NoError(t, other.Err)
+}
+
+func TestReleaseAfterError(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.Claim()
+	assert.NoError(t, targ.Err)
+	// the claim is released, and the error which failed the target is kept
+	targ.Err = errors.New("unable to set new baseline")
+	targ.Release()
+	assert.EqualError(t, targ.Err, "unable to set new baseline")
+	assert.NotContains(t, targ.infService.GetAnnotations(), LockAnnotation)
+}
+
+func TestClaimStaleLock(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.Claim()
+	assert.NoError(t, targ.Err)
+	assert.NoError(t, c.Delete(context.Background(), targ.Exp.Experiment))
+
+	// an experiment with the same name is created after the lock holder is deleted
+	next := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	exp.SetUID("new-uid")
+	next.Exp = experiment.Builder(exp)
+	assert.NoError(t, c.Create(context.Background(), exp))
+	next.SetK8sClient(c).Fetch("default/my-model").Claim()
+	assert.NoError(t, next.Err)
+	lock, err := target.GetLock(next.infService)
+	assert.NoError(t, err)
+	assert.Equal(t, types.UID("new-uid"), lock.UID)
+}
+
+func TestGetVersionInfoRevisionTags(t *testing.T) {
+	c := targettest.NewClient(t, "canaryv1beta1.json", "revision-wl2cv.json", "revision-zwjbq.json")
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, &map[string]string{
+		"revision":          "my-model-predictor-default-wl2cv",
+		"namespace":         "default",
+		"inferenceService":  "my-model",
+		"component":         "predictor",
+		"configuration":     "my-model-predictor-default",
+		"service":           "my-model-predictor-default",
+		"image":             "tensorflow/serving:1.14.0",
+		"storageUri":        "gs://kfserving-samples/models/tensorflow/flowers",
+		"cpuRequest":        "1",
+		"memoryRequest":     "2Gi",
+		"creationTimestamp": "2021-01-12T16:20:41Z",
+	}, vi.Baseline.Tags)
+	assert.Equal(t, &map[string]string{
+		"revision":          "my-model-predictor-default-zwjbq",
+		"namespace":         "default",
+		"inferenceService":  "my-model",
+		"component":         "predictor",
+		"configuration":     "my-model-predictor-default",
+		"service":           "my-model-predictor-default",
+		"framework":         "tensorflow",
+		"runtimeVersion":    "1.14.0",
+		"image":             "tensorflow/serving:1.14.0",
+		"storageUri":        "gs://kfserving-samples/models/tensorflow/flowers-2",
+		"cpuRequest":        "1",
+		"memoryRequest":     "2Gi",
+		"creationTimestamp": "2021-01-12T16:25:23Z",
+	}, vi.Candidates[0].Tags)
+}
+
+func TestStandardTagsFromRevisionLabels(t *testing.T) {
+	c := targettest.NewClient(t, "canaryv1beta1.json", "revision-wl2cv.json")
+	revision := &unstructured.Unstructured{}
+	revision.SetGroupVersionKind(schema.GroupVersionKind{Group: "serving.knative.dev", Version: "v1", Kind: "Revision"})
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "my-model-predictor-default-wl2cv"}, revision))
+	// the configuration and service of a revision need not prefix its name
+	revision.SetLabels(map[string]string{
+		"serving.knative.dev/configuration": "my-configuration",
+		"serving.knative.dev/service":       "my-service",
+	})
+	assert.NoError(t, c.Update(context.Background(), revision))
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.SetK8sClient(c).SetExperiment(experiment.Builder(exp)).Fetch("default/my-model")
+	assert.NoError(t, targ.Err)
+
+	tags := *versionTags(targ, "transformer", "my-model-predictor-default-wl2cv", false)
+	assert.Equal(t, "transformer", tags["component"])
+	assert.Equal(t, "my-configuration", tags["configuration"])
+	assert.Equal(t, "my-service", tags["service"])
+
+	// a revision which cannot be fetched has no configuration or service
+	tags = *versionTags(targ, "predictor", "my-model-predictor-default-zwjbq", false)
+	assert.Equal(t, "predictor", tags["component"])
+	assert.NotContains(t, tags, "configuration")
+	assert.NotContains(t, tags, "service")
+}
+
+func TestSetTagPaths(t *testing.T) {
+	c := targettest.NewClient(t, "canaryv1beta1.json", "revision-wl2cv.json", "revision-zwjbq.json")
+	targ := TargetBuilder()
+	targ.SetTagPaths(map[string]string{
+		"configurationLabel": `{.metadata.labels.serving\.knative\.dev/configuration}`,
+		"missing":            "{.spec.missing}",
+	})
+	assert.NoError(t, targ.Err)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, &map[string]string{
+		"revision":           "my-model-predictor-default-wl2cv",
+		"namespace":          "default",
+		"inferenceService":   "my-model",
+		"component":          "predictor",
+		"configuration":      "my-model-predictor-default",
+		"service":            "my-model-predictor-default",
+		"configurationLabel": "my-model-predictor-default",
+	}, vi.Baseline.Tags)
+
+	targ = TargetBuilder()
+	targ.SetTagPaths(map[string]string{"invalid": "{.spec"})
+	assert.Error(t, targ.Err)
+}
+
+func TestGetVersionInfoVariables(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := TargetBuilder()
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	exp.SetAnnotations(map[string]string{
+		experiment.VariablesAnnotation: `{
+			"host": "{.status.url}",
+			"trafficTag": "{.status.components.predictor.traffic[?(@.revisionName==\"$revision\")].tag}",
+			"namespace": "{.spec.missing}",
+			"invalid": "{.status"
+		}`,
+	})
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	vi, err := targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://my-model.default.example.com", (*vi.Baseline.Tags)["host"])
+	assert.Equal(t, "prev", (*vi.Baseline.Tags)["trafficTag"])
+	assert.Equal(t, "latest", (*vi.Candidates[0].Tags)["trafficTag"])
+	// standard variables cannot be overridden
+	assert.Equal(t, "default", (*vi.Baseline.Tags)["namespace"])
+	assert.NotContains(t, *vi.Baseline.Tags, "invalid")
+
+	exp.SetAnnotations(map[string]string{experiment.VariablesAnnotation: "not json"})
+	vi, err = targ.GetVersionInfo()
+	assert.NoError(t, err)
+	assert.NotContains(t, *vi.Baseline.Tags, "host")
+}
+
+func TestTransformerCanary(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("transformerv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	targ.EnsureCandidate().SnapshotTrafficState().InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+
+	// traffic is split on the transformer, which has a canary revision
+	i, b, err := unstructured.NestedInt64(targ.infService.Object, "spec", "transformer", "canaryTrafficPercent")
+	assert.True(t, b)
+	assert.Equal(t, int64(1), i)
+	assert.NoError(t, err)
+	_, b, _ = unstructured.NestedInt64(targ.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.False(t, b)
+
+	vi := targ.Exp.Spec.VersionInfo
+	assert.Equal(t, "my-model-transformer-default-4xz8p", (*vi.Baseline.Tags)["transformerRevision"])
+	assert.Equal(t, "my-model-transformer-default-7kq2m", (*vi.Candidates[0].Tags)["transformerRevision"])
+	assert.Equal(t, "/spec/transformer/canaryTrafficPercent", vi.Candidates[0].WeightObjRef.FieldPath)
+
+	// baseline wins, and the traffic state of the transformer is restored
+	rb := "default"
+	targ.Exp.Status.RecommendedBaseline = &rb
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	_, b, _ = unstructured.NestedInt64(targ.infService.Object, "spec", "transformer", "canaryTrafficPercent")
+	assert.False(t, b)
+}
+
+func TestTransformerReadiness(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("transformerv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	targ := getResumableTarget(t, c, etc3.StrategyTypeCanary)
+	assert.True(t, getCond(targ))
+	err = c.Patch(context.Background(), targ.infService, client.RawPatch(types.MergePatchType,
+		[]byte(`{"status":{"conditions":[{"type":"Ready","status":"True"},{"type":"TransformerReady","status":"False"}]}}`)))
+	assert.NoError(t, err)
+	assert.False(t, getCond(targ))
+}
+
+func TestStartAndFinishWithFakeKFServing(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	fk := fakekfserving.Builder(c).SetDelay(200 * time.Millisecond)
+	targ := getResumableTarget(t, fk, etc3.StrategyTypeCanary)
+	targ.Interval = 1
+	targ.Retries = 3
+	targ.CandidateRetries = 3
+	targ.SetFinishMode(FinishModePromote)
+	// the user applies a new model with a canary traffic split after the experiment starts
+	isvc := targ.infService.DeepCopy()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		fk.Patch(context.Background(), isvc, client.RawPatch(types.MergePatchType,
+			[]byte(`{"spec":{"predictor":{"canaryTrafficPercent":10}}}`)))
+		fk.CreateRevision(context.Background(), client.ObjectKeyFromObject(isvc), "predictor")
+	}()
+	targ.EnsureCandidate().SnapshotTrafficState().InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	assert.Equal(t, "my-model-predictor-default-00001", (*targ.Exp.Spec.VersionInfo.Candidates[0].Tags)["revision"])
+
+	rb := "canary"
+	targ.Exp.Status.RecommendedBaseline = &rb
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	bRev, cRev, err := getRevisions(targ)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-model-predictor-default-00001", bRev)
+	assert.Equal(t, bRev, cRev)
+	fk.Wait()
+}
+
+func TestResumeBlueGreenPromoteWithFakeKFServing(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	fk := fakekfserving.Builder(c).SetDelay(100 * time.Millisecond)
+	targ := getResumableTarget(t, fk, etc3.StrategyTypeBlueGreen)
+	targ.Interval = 1
+	targ.Retries = 3
+	targ.VerifyRetries = 0
+	targ.SetFinishMode(FinishModePromote)
+	targ.InitializeTrafficSplit().SetVersionInfoInExperiment()
+	assert.NoError(t, targ.Err)
+	rb := "canary"
+	targ.Exp.Status.RecommendedBaseline = &rb
+	targ.SetNewBaseline()
+	assert.NoError(t, targ.Err)
+	fk.Wait()
+
+	// the promoted canary is recognized as the new baseline in a rerun, which skips the step
+	next := rerun(t, fk, targ)
+	next.SetFinishMode(FinishModePromote)
+	next.Exp.Status.RecommendedBaseline = &rb
+	isvcVersion := next.infService.GetResourceVersion()
+	next.SetNewBaseline()
+	assert.NoError(t, next.Err)
+	assert.Equal(t, isvcVersion, next.infService.GetResourceVersion())
+	_, found, _ := unstructured.NestedInt64(next.infService.Object, "spec", "predictor", "canaryTrafficPercent")
+	assert.False(t, found)
+}
+
+func TestInitializeTrafficSplitWithFakeKFServingReadinessFailure(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	fk := fakekfserving.Builder(c).SetDelay(100 * time.Millisecond).SetReadinessFailure(true)
+	targ := getResumableTarget(t, fk, etc3.StrategyTypeCanary)
+	targ.Interval = 1
+	targ.Retries = 1
+	targ.SetCanaryTrafficPercent(5)
+	assert.Error(t, targ.Err)
+	fk.Wait()
+
+	fk.SetReadinessFailure(false)
+	targ.Err = nil
+	targ.SetCanaryTrafficPercent(1)
+	assert.NoError(t, targ.Err)
+	fk.Wait()
+}
+
+// countingClient counts the Get requests made through it.
+type countingClient struct {
+	client.Client
+	gets int
+}
+
+func (c *countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	c.gets++
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestFetchTimeout(t *testing.T) {
+	c := &countingClient{Client: getK8sClientWithMyTarget()}
+	sc := targettest.NewSteppingClock()
+	start := sc.Now()
+	targ := TargetBuilder()
+	targ.SetClock(sc)
+	targ.SetK8sClient(c).Fetch("default/missing")
+	assert.Error(t, targ.Err)
+	// the default budget of 18 retries at intervals of 10 sec
+	assert.Equal(t, 180*time.Second, sc.Since(start))
+	assert.Equal(t, 19, c.gets)
+}
+
+func TestEnsureReadinessTimeout(t *testing.T) {
+	cl, err := getK8sClientWithTargetFromFile("canaryv1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	c := &countingClient{Client: cl}
+	sc := targettest.NewSteppingClock()
+	targ := TargetBuilder()
+	targ.SetClock(sc)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	err = c.Patch(context.Background(), targ.infService, client.RawPatch(types.MergePatchType,
+		[]byte(`{"status":{"conditions":[{"type":"Ready","status":"False"}]}}`)))
+	assert.NoError(t, err)
+	start := sc.Now()
+	c.gets = 0
+	assert.False(t, EnsureReadiness(targ))
+	assert.Equal(t, 180*time.Second, sc.Since(start))
+	assert.Equal(t, 19, c.gets)
+}
+
+func TestEnsureCandidateTimeout(t *testing.T) {
+	c, err := getK8sClientWithTargetFromFile("nocandidatev1beta1.json")
+	if err != nil {
+		t.Fatal("Cannot get k8s client with target from file")
+	}
+	sc := targettest.NewSteppingClock()
+	targ := TargetBuilder()
+	targ.SetClock(sc).SetCandidateWait(60 * time.Second)
+	exp := etc3.NewExperiment("myexp", "default").
+		WithTarget("default/my-model").
+		WithStrategy(etc3.StrategyTypeCanary).
+		Build()
+	targ.Exp = experiment.Builder(exp)
+	targ.SetK8sClient(c).Fetch("default/my-model")
+	start := sc.Now()
+	targ.EnsureCandidate()
+	var nce *target.NoCandidateError
+	assert.True(t, errors.As(targ.Err, &nce))
+	assert.Equal(t, 60*time.Second, sc.Since(start))
+}
+
+// trafficState is a random traffic state of the components of an InferenceService, along with a random InferenceService object.
+type trafficState struct {
+	obj   map[string]interface{}
+	state map[string]*int64
+}
+
+// Generate returns a random traffic state, whose components may be absent in the InferenceService object.
+func (trafficState) Generate(rand *rand.Rand, size int) reflect.Value {
+	ts := trafficState{
+		obj:   map[string]interface{}{"spec": map[string]interface{}{}},
+		state: map[string]*int64{},
+	}
+	for _, component := range components {
+		if rand.Intn(4) > 0 {
+			spec := map[string]interface{}{}
+			if rand.Intn(2) == 0 {
+				spec["canaryTrafficPercent"] = rand.Int63n(101)
+			}
+			ts.obj["spec"].(map[string]interface{})[component] = spec
+		}
+		switch rand.Intn(3) {
+		case 1:
+			ts.state[component] = nil
+		case 2:
+			p := rand.Int63n(101)
+			ts.state[component] = &p
+		}
+	}
+	return reflect.ValueOf(ts)
+}
+
+// applyPatch checks that the given patch is a valid RFC 6902 JSON patch which round-trips through JSON, and returns the result of applying it to the given document.
+func applyPatch(patch []byte, doc interface{}) (map[string]interface{}, error) {
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	roundTrip, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(roundTrip, patch) {
+		return nil, errors.New("patch does not round-trip: " + string(patch) + " became " + string(roundTrip))
+	}
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	result, err := decoded.Apply(docBytes)
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]interface{}{}
+	err = json.Unmarshal(result, &obj)
+	return obj, err
+}
+
+func TestCanaryTrafficPatchProperties(t *testing.T) {
+	err := quick.Check(func(ts trafficState) bool {
+		patch, err := canaryTrafficPatch(ts.obj, ts.state)
+		if err != nil {
+			return false
+		}
+		obj := ts.obj
+		if patch != nil {
+			if obj, err = applyPatch(patch, ts.obj); err != nil {
+				t.Log(err)
+				return false
+			}
+		}
+		// the patched object has the given traffic state in each of its components
+		for component, p := range ts.state {
+			if _, found, _ := unstructured.NestedMap(ts.obj, "spec", component); !found {
+				continue
+			}
+			val, found, _ := unstructured.NestedFieldNoCopy(obj, "spec", component, "canaryTrafficPercent")
+			if found != (p != nil) || (p != nil && val != float64(*p)) {
+				return false
+			}
+		}
+		return true
+	}, nil)
+	assert.NoError(t, err)
+}
+
+func TestVersionInfoPatchProperties(t *testing.T) {
+	err := quick.Check(func(baseline string, candidate string, tags map[string]string, path string) bool {
+		vi := &etc3.VersionInfo{
+			Baseline: etc3.VersionDetail{Name: baseline, Tags: &tags},
+			Candidates: []etc3.VersionDetail{{
+				Name:         candidate,
+				WeightObjRef: &v1.ObjectReference{FieldPath: path},
+			}},
+		}
+		patch, err := target.VersionInfoPatch(vi)
+		if err != nil {
+			return false
+		}
+		obj, err := applyPatch(patch, map[string]interface{}{"spec": map[string]interface{}{"versionInfo": nil}})
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		// the patched versionInfo equals the given versionInfo
+		viBytes, _ := json.Marshal(obj["spec"].(map[string]interface{})["versionInfo"])
+		patched := &etc3.VersionInfo{}
+		if err := json.Unmarshal(viBytes, patched); err != nil {
+			return false
+		}
+		return reflect.DeepEqual(vi, patched)
+	}, nil)
+	assert.NoError(t, err)
+}
+
+func TestVersionInfoPatchEscapes(t *testing.T) {
+	for _, tc := range [][4]string{
+		{"default", "canary", "revision", "my-model-predictor-default-wl2cv"},
+		{"", `"`, "\u2028", "/spec/predictor/canaryTrafficPercent"},
+	} {
+		tags := map[string]string{tc[2]: tc[3]}
+		vi := &etc3.VersionInfo{
+			Baseline:   etc3.VersionDetail{Name: tc[0], Tags: &tags},
+			Candidates: []etc3.VersionDetail{{Name: tc[1]}},
+		}
+		patch, err := target.VersionInfoPatch(vi)
+		assert.NoError(t, err)
+		_, err = applyPatch(patch, map[string]interface{}{"spec": map[string]interface{}{"versionInfo": nil}})
+		assert.NoError(t, err, string(patch))
+	}
+}